@@ -0,0 +1,135 @@
+package emailauth
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+/*
+ * Authentication-Results:
+ *  mx.example.com;
+ *  dkim=none;
+ *  dkim-adsp=discard header.from=example.com
+ *
+ * _adsp._domainkey.example.com. IN TXT "dkim=discardable"
+ */
+
+type ADSPResult struct {
+	Result   Result
+	Reason   string
+	Domain   string
+	Practice string
+}
+
+const (
+	adspUnknown     = "unknown"
+	adspAll         = "all"
+	adspDiscardable = "discardable"
+)
+
+/*
+ * Evaluates the Author Domain Signing Practices of the author domain
+ * against the results of DKIM verification (RFC 5617, section 4).
+ * ADSP has been moved to historic status, but its results are still
+ * expected in some Authentication-Results headers.
+ */
+func (v DKIMValidator) ValidateADSP(fromDomain string, dkimResults ...*DKIMResult) *ADSPResult {
+	return v.ValidateADSPContext(context.Background(), fromDomain, dkimResults...)
+}
+
+/*
+ * Like ValidateADSP, querying the practices with ctx. The result and
+ * queries are logged with the trace ID of ctx.
+ */
+func (v DKIMValidator) ValidateADSPContext(ctx context.Context, fromDomain string, dkimResults ...*DKIMResult) *ADSPResult {
+	resolver := traceResolver(ctx, v.Resolver, v.Logger, v.Metrics)
+	v.Resolver = resolver
+	result := v.validateADSP(fromDomain, dkimResults)
+	logVerdict(ctx, v.Logger, "dkim-adsp", result.Result, slog.String("from", result.Domain),
+		slog.String("practice", result.Practice), slog.String("result", result.Result.String()), slog.String("reason", result.Reason))
+	observeEvaluation(v.Metrics, "dkim-adsp", resolver, result.Result)
+	return result
+}
+
+func (v DKIMValidator) validateADSP(fromDomain string, dkimResults []*DKIMResult) *ADSPResult {
+	fromDomain = strings.TrimSuffix(strings.ToLower(fromDomain), ".")
+	for _, r := range dkimResults {
+		if r.Result == Pass && strings.EqualFold(r.Tags["d"], fromDomain) {
+			return newADSPResult(Pass, "Valid author domain signature", fromDomain, "")
+		}
+	}
+
+	resolver := resolverOrDefault(v.Resolver)
+	if errResult := checkADSPScope(resolver, fromDomain); errResult != nil {
+		return errResult
+	}
+
+	practice, errResult := findADSPRecord(resolver, fromDomain)
+	if errResult != nil {
+		return errResult
+	}
+
+	switch practice {
+	case adspAll:
+		return newADSPResult(Fail, "All mail is signed", fromDomain, practice)
+	case adspDiscardable:
+		return newADSPResult(Discard, "Unsigned mail is discardable", fromDomain, practice)
+	}
+	return newADSPResult(Unknown, "Unknown signing practices", fromDomain, practice)
+}
+
+/*
+ * Author domains that do not exist (NXDOMAIN) are out of scope for
+ * ADSP (RFC 5617, section 4.3).
+ */
+func checkADSPScope(resolver Resolver, domain string) *ADSPResult {
+	if isInvalidDomain(domain) {
+		return newADSPResult(Permerror, "Invalid author domain", domain, "")
+	}
+
+	exists, err := domainExists(resolver, domain)
+	if err != nil {
+		return newADSPResult(Temperror, err.Error(), domain, "")
+	}
+
+	if !exists {
+		return newADSPResult(Nxdomain, "Author domain does not exist", domain, "")
+	}
+	return nil
+}
+
+func findADSPRecord(resolver Resolver, domain string) (string, *ADSPResult) {
+	records, err := resolver.LookupTXT(context.Background(), "_adsp._domainkey."+domain)
+	if err != nil {
+		if isTemporaryDNSError(err) {
+			return "", newADSPResult(Temperror, err.Error(), domain, "")
+		}
+		return "", newADSPResult(None, "No ADSP record", domain, "")
+	}
+
+	for _, record := range records {
+		tags, err := parseTagList(record)
+		if err != nil {
+			continue
+		}
+
+		practice, ok := tags["dkim"]
+		if !ok {
+			continue
+		}
+
+		// unknown practices are treated like "unknown" (section 4.2.1)
+		switch practice {
+		case adspAll, adspDiscardable:
+			return practice, nil
+		}
+		return adspUnknown, nil
+	}
+
+	return "", newADSPResult(None, "No ADSP record", domain, "")
+}
+
+func newADSPResult(result Result, reason string, domain string, practice string) *ADSPResult {
+	return &ADSPResult{Result: result, Reason: reason, Domain: domain, Practice: practice}
+}
@@ -0,0 +1,76 @@
+package emailauth
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+/*
+ * noRecordsResolver answers the address and MX lookups of names with
+ * TXT records with NODATA, as DNSClient does.
+ */
+type noRecordsResolver struct {
+	fakeResolver
+}
+
+func (r noRecordsResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if _, err := r.fakeResolver.LookupHost(ctx, host); err != nil {
+		return nil, err
+	}
+	return nil, &net.DNSError{Err: dnsNoRecords, Name: host, IsNotFound: true}
+}
+
+func (r noRecordsResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if _, err := r.fakeResolver.LookupHost(ctx, name); err != nil {
+		return nil, err
+	}
+	return nil, &net.DNSError{Err: dnsNoRecords, Name: name, IsNotFound: true}
+}
+
+func TestValidateADSP(t *testing.T) {
+	v := DKIMValidator{Resolver: fakeResolver{
+		"_adsp._domainkey.all.example":         {"dkim=all"},
+		"_adsp._domainkey.discardable.example": {"v=spf1 -all", "dkim=discardable"},
+		"_adsp._domainkey.unknown.example":     {"dkim=whatever"},
+		"none.example":                         {"v=spf1 -all"},
+	}}
+
+	expected := map[string]Result{
+		"all.example":         Fail,
+		"discardable.example": Discard,
+		"unknown.example":     Unknown,
+		"none.example":        None,
+		"nx.example":          Nxdomain,
+	}
+
+	signed := newDKIMResult(Pass, "")
+	signed.Tags["d"] = "third-party.example"
+	for domain, result := range expected {
+		adsp := v.ValidateADSP(domain, signed)
+		if adsp.Result != result {
+			t.Errorf("Expected '%s' for '%s' but got '%s' (%s)", result, domain, adsp.Result, adsp.Reason)
+		}
+	}
+
+	signed.Tags["d"] = "discardable.example"
+	if adsp := v.ValidateADSP("discardable.example", newDKIMResult(None, ""), signed); adsp.Result != Pass {
+		t.Errorf("Expected 'pass' but got '%s' (%s)", adsp.Result, adsp.Reason)
+	}
+
+	signed.Result = Fail
+	if adsp := v.ValidateADSP("discardable.example", signed); adsp.Result != Discard {
+		t.Errorf("Expected 'discard' but got '%s' (%s)", adsp.Result, adsp.Reason)
+	}
+}
+
+func TestADSPScope(t *testing.T) {
+	// a domain without address and MX records exists
+	v := DKIMValidator{Resolver: noRecordsResolver{fakeResolver{"_adsp._domainkey.nodata.example": {"dkim=all"}}}}
+	if adsp := v.ValidateADSP("nodata.example"); adsp.Result != Fail {
+		t.Errorf("Expected 'fail' but got '%s' (%s)", adsp.Result, adsp.Reason)
+	}
+	if adsp := v.ValidateADSP("nx.example"); adsp.Result != Nxdomain {
+		t.Errorf("Expected 'nxdomain' but got '%s' (%s)", adsp.Result, adsp.Reason)
+	}
+}
@@ -0,0 +1,426 @@
+package emailauth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * ARC-Authentication-Results: i=1; lists.example.org;
+ *  spf=pass smtp.mailfrom=example.com; dkim=pass header.d=example.com; dmarc=pass header.from=example.com
+ * ARC-Message-Signature: i=1; a=rsa-sha256; c=relaxed/relaxed; d=example.org; s=arc;
+ *  h=From:To:Subject:Date:Message-ID; bh=...; b=...
+ * ARC-Seal: i=1; a=rsa-sha256; cv=none; d=example.org; s=arc; t=1467244800; b=...
+ */
+
+type ARCResult struct {
+	Result     Result // none, pass or fail
+	Reason     string
+	OldestPass int       // lowest instance whose message signature still verifies, 0 if all do
+	Sets       []*ARCSet // ordered by instance
+}
+
+/*
+ * ARCSet holds the header fields added by one ARC intermediary. The
+ * tags of seal and message signature are kept as parsed;
+ * AuthenticationResults is the value following the instance tag.
+ */
+type ARCSet struct {
+	Instance              int
+	Seal                  map[string]string
+	MessageSignature      map[string]string
+	AuthenticationResults string
+
+	rawSeal             HeaderField
+	rawMessageSignature HeaderField
+	rawResults          HeaderField
+}
+
+type ARCValidator struct {
+	Resolver  Resolver
+	KeyPolicy *DKIMKeyPolicy
+	Logger    *slog.Logger
+	Metrics   Metrics
+}
+
+const (
+	arcSealHeader             = "ARC-Seal"
+	arcMessageSignatureHeader = "ARC-Message-Signature"
+	arcResultsHeader          = "ARC-Authentication-Results"
+	maxARCInstances           = 50
+)
+
+/*
+ * Validates the ARC chain of a message (RFC 8617, section 5.2). The
+ * body is read to verify the message signatures.
+ */
+func (v ARCValidator) Validate(mail *Message) *ARCResult {
+	return v.ValidateContext(context.Background(), mail)
+}
+
+/*
+ * Like Validate, looking up the keys with ctx. The result and queries
+ * are logged with the trace ID of ctx.
+ */
+func (v ARCValidator) ValidateContext(ctx context.Context, mail *Message) *ARCResult {
+	resolver := traceResolver(ctx, v.Resolver, v.Logger, v.Metrics)
+	v.Resolver = resolver
+	result := v.validate(mail)
+	observeEvaluation(v.Metrics, "arc", resolver, result.Result)
+	logVerdict(ctx, v.Logger, "arc", result.Result,
+		slog.Int("sets", len(result.Sets)),
+		slog.String("result", result.Result.String()),
+		slog.Int("oldest-pass", result.OldestPass),
+		slog.String("reason", result.Reason))
+	return result
+}
+
+func (v ARCValidator) validate(mail *Message) *ARCResult {
+	header := mail.Fields()
+	sets, err := parseARCSets(header)
+	if err != nil {
+		return newARCResult(Fail, err.Error())
+	}
+
+	if len(sets) == 0 {
+		return newARCResult(None, "No ARC sets")
+	}
+
+	result := newARCResult(Fail, "")
+	result.Sets = sets
+	latest := sets[len(sets)-1]
+	if strings.EqualFold(latest.Seal["cv"], "fail") {
+		result.Reason = fmt.Sprintf("Chain marked as failed in instance %d", latest.Instance)
+		return result
+	}
+
+	if err := checkARCChainStatus(sets); err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+
+	signatures := make([]*dkimSignature, len(sets))
+	bodies := make([]*arcBodyHash, len(sets))
+	writers := make([]io.Writer, 0, len(sets))
+	for i, set := range sets {
+		sig, err := newARCSignature(set.MessageSignature, true)
+		if err != nil {
+			if set == latest {
+				result.Reason = fmt.Sprintf("Invalid message signature %d: %s", set.Instance, err.Error())
+				return result
+			}
+			continue
+		}
+
+		signatures[i] = sig
+		bodies[i] = &arcBodyHash{hash: sig.Hash.New()}
+		bodies[i].body = newBodyCanonicalizer(bodies[i].hash, sig.BodyCanon == "relaxed", sig.Length)
+		writers = append(writers, bodies[i].body)
+	}
+
+	if mail.Body != nil {
+		if _, err := io.Copy(io.MultiWriter(writers...), mail.Body); err != nil {
+			result.Reason = err.Error()
+			return result
+		}
+	}
+
+	// the latest message signature must verify, earlier ones determine
+	// the oldest instance that still passes
+	for i := len(sets) - 1; i >= 0; i-- {
+		err := v.verifyMessageSignature(header, sets[i], signatures[i], bodies[i])
+		if err == nil {
+			continue
+		}
+
+		if i == len(sets)-1 {
+			result.Reason = fmt.Sprintf("Message signature %d: %s", sets[i].Instance, err.Error())
+			return result
+		}
+		result.OldestPass = sets[i].Instance + 1
+		break
+	}
+
+	for i := len(sets) - 1; i >= 0; i-- {
+		if err := v.verifySeal(sets, i); err != nil {
+			result.Reason = fmt.Sprintf("Seal %d: %s", sets[i].Instance, err.Error())
+			return result
+		}
+	}
+
+	result.Result = Pass
+	return result
+}
+
+/*
+ * Returns the ARC set of the given instance, or nil.
+ */
+func (r *ARCResult) Set(instance int) *ARCSet {
+	for _, set := range r.Sets {
+		if set.Instance == instance {
+			return set
+		}
+	}
+	return nil
+}
+
+type arcBodyHash struct {
+	hash hash.Hash
+	body *bodyCanonicalizer
+}
+
+func (v ARCValidator) verifyMessageSignature(header Header, set *ARCSet, sig *dkimSignature, body *arcBodyHash) error {
+	if sig == nil {
+		return errors.New("Invalid signature")
+	}
+
+	if err := body.body.Close(); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(body.hash.Sum(nil), sig.BodyHash) {
+		return errors.New("Body hash did not verify")
+	}
+
+	key, err := v.findKey(sig)
+	if err != nil {
+		return err
+	}
+
+	digest := signedHeaderHash(header, sig, set.rawMessageSignature)
+	if err := verifySignature(key, sig.Hash, digest, sig.Signature); err != nil {
+		return errors.New("Signature did not verify")
+	}
+	return nil
+}
+
+func (v ARCValidator) verifySeal(sets []*ARCSet, idx int) error {
+	sig, err := newARCSignature(sets[idx].Seal, false)
+	if err != nil {
+		return err
+	}
+
+	key, err := v.findKey(sig)
+	if err != nil {
+		return err
+	}
+
+	digest := arcSealHash(sets[:idx+1], sig.Hash)
+	if err := verifySignature(key, sig.Hash, digest, sig.Signature); err != nil {
+		return errors.New("Signature did not verify")
+	}
+	return nil
+}
+
+func (v ARCValidator) findKey(sig *dkimSignature) (*DKIMKey, error) {
+	key, errResult := findDKIMKey(v.Resolver, sig.Selector, sig.Domain)
+	if errResult != nil {
+		return nil, errors.New(errResult.Reason)
+	}
+
+	if errResult := checkDKIMKey(key, sig); errResult != nil {
+		return nil, errors.New(errResult.Reason)
+	}
+
+	policy := v.KeyPolicy
+	if policy == nil {
+		policy = &DefaultDKIMKeyPolicy
+	}
+	if errResult := policy.check(key, sig); errResult != nil {
+		return nil, errors.New(errResult.Reason)
+	}
+	return key, nil
+}
+
+/*
+ * Computes the hash signed by the seal of the last given set: the
+ * ARC sets in increasing instance order, each as results, message
+ * signature and seal, with an empty "b=" tag in the last seal. The
+ * relaxed header canonicalization is always used (RFC 8617, section
+ * 5.1.1).
+ */
+func arcSealHash(sets []*ARCSet, algorithm crypto.Hash) []byte {
+	h := algorithm.New()
+	for i, set := range sets {
+		io.WriteString(h, canonicalizeField(set.rawResults, true))
+		io.WriteString(h, "\r\n")
+		io.WriteString(h, canonicalizeField(set.rawMessageSignature, true))
+		io.WriteString(h, "\r\n")
+
+		if i < len(sets)-1 {
+			io.WriteString(h, canonicalizeField(set.rawSeal, true))
+			io.WriteString(h, "\r\n")
+		} else {
+			io.WriteString(h, canonicalizeField(unsignedField(set.rawSeal), true))
+		}
+	}
+	return h.Sum(nil)
+}
+
+/*
+ * Collects the ARC sets of a message ordered by instance. Each
+ * instance from 1 to the highest one must be complete and unique
+ * (RFC 8617, section 5.2, step 3).
+ */
+func parseARCSets(header Header) ([]*ARCSet, error) {
+	byInstance := make(map[int]*ARCSet)
+	set := func(instance int) *ARCSet {
+		if byInstance[instance] == nil {
+			byInstance[instance] = &ARCSet{Instance: instance}
+		}
+		return byInstance[instance]
+	}
+
+	for _, field := range header.Fields(arcSealHeader) {
+		tags, instance, err := parseARCTags(field.Value())
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", arcSealHeader, err.Error())
+		}
+
+		s := set(instance)
+		if s.Seal != nil {
+			return nil, fmt.Errorf("Duplicate %s for instance %d", arcSealHeader, instance)
+		}
+		s.Seal, s.rawSeal = tags, field
+	}
+
+	for _, field := range header.Fields(arcMessageSignatureHeader) {
+		tags, instance, err := parseARCTags(field.Value())
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", arcMessageSignatureHeader, err.Error())
+		}
+
+		s := set(instance)
+		if s.MessageSignature != nil {
+			return nil, fmt.Errorf("Duplicate %s for instance %d", arcMessageSignatureHeader, instance)
+		}
+		s.MessageSignature, s.rawMessageSignature = tags, field
+	}
+
+	for _, field := range header.Fields(arcResultsHeader) {
+		parts := strings.SplitN(field.Value(), ";", 2)
+		instance, err := parseARCInstance(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", arcResultsHeader, err.Error())
+		}
+
+		s := set(instance)
+		if s.rawResults.Raw != "" {
+			return nil, fmt.Errorf("Duplicate %s for instance %d", arcResultsHeader, instance)
+		}
+		s.rawResults = field
+		if len(parts) == 2 {
+			s.AuthenticationResults = unfoldHeaderValue(parts[1])
+		}
+	}
+
+	sets := make([]*ARCSet, 0, len(byInstance))
+	for _, s := range byInstance {
+		sets = append(sets, s)
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].Instance < sets[j].Instance })
+
+	for i, s := range sets {
+		if s.Instance != i+1 {
+			return nil, fmt.Errorf("Missing ARC set %d", i+1)
+		}
+
+		if s.Seal == nil || s.MessageSignature == nil || s.rawResults.Raw == "" {
+			return nil, fmt.Errorf("Incomplete ARC set %d", s.Instance)
+		}
+	}
+
+	return sets, nil
+}
+
+func parseARCTags(raw string) (map[string]string, int, error) {
+	tags, err := parseTagList(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if _, ok := tags["i"]; !ok {
+		return nil, 0, errors.New("Missing instance")
+	}
+
+	instance, err := parseARCInstance("i=" + tags["i"])
+	if err != nil {
+		return nil, 0, err
+	}
+	return tags, instance, nil
+}
+
+func parseARCInstance(tag string) (int, error) {
+	parts := strings.SplitN(tag, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) != "i" {
+		return 0, errors.New("Missing instance")
+	}
+
+	instance, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || instance < 1 || instance > maxARCInstances {
+		return 0, fmt.Errorf("Invalid instance: %s", sanitizeDomainForPrinting(strings.TrimSpace(parts[1])))
+	}
+	return instance, nil
+}
+
+/*
+ * Checks the chain validation status of each seal: "none" for the
+ * first instance and "pass" for all others (RFC 8617, section 5.2,
+ * step 3).
+ */
+func checkARCChainStatus(sets []*ARCSet) error {
+	for _, s := range sets {
+		cv := strings.ToLower(s.Seal["cv"])
+		if (s.Instance == 1 && cv != "none") || (s.Instance > 1 && cv != "pass") {
+			return fmt.Errorf("Invalid chain validation status in instance %d: %s", s.Instance, s.Seal["cv"])
+		}
+	}
+	return nil
+}
+
+/*
+ * Parses an ARC-Message-Signature or ARC-Seal. Unlike DKIM, there is
+ * no version tag and "i=" is the instance; seals sign no header list
+ * and no body (RFC 8617, sections 4.1.2 and 4.1.3).
+ */
+func newARCSignature(tags map[string]string, messageSignature bool) (*dkimSignature, error) {
+	required := []string{"i", "a", "b", "d", "s"}
+	if messageSignature {
+		required = append(required, "bh", "h")
+	} else {
+		if _, ok := tags["h"]; ok {
+			return nil, errors.New("Header list not allowed in seal")
+		}
+		required = append(required, "cv")
+	}
+
+	for _, name := range required {
+		if _, ok := tags[name]; !ok {
+			return nil, fmt.Errorf("Missing required tag: %s", name)
+		}
+	}
+
+	sig, err := newDKIMSignature(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if !messageSignature {
+		sig.HeaderCanon = "relaxed"
+	}
+	sig.Identity = "@" + sig.Domain
+	return sig, nil
+}
+
+func newARCResult(result Result, reason string) *ARCResult {
+	return &ARCResult{Result: result, Reason: reason}
+}
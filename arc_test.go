@@ -0,0 +1,162 @@
+package emailauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+/*
+ * Adds an ARC set to the message, using the same canonicalization code
+ * as the validator.
+ */
+func sealTestMessage(t *testing.T, message *Message, key *rsa.PrivateKey, instance int, cv string) {
+	bh, err := dkimBodyHash(strings.NewReader(testMessageBody), &dkimSignature{Hash: crypto.SHA256, BodyCanon: "relaxed", Length: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aar := fmt.Sprintf("i=%d; relay%d.example.org; spf=pass smtp.mailfrom=example.com", instance, instance)
+
+	unsigned := fmt.Sprintf("i=%d; a=rsa-sha256; c=relaxed/relaxed; d=example.org; s=arc; h=From:To:Subject:Date:Message-ID; bh=%s; b=",
+		instance, base64.StdEncoding.EncodeToString(bh))
+	sig, err := newARCSignature(mustParseTags(t, unsigned+"AA=="), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := message.Fields()
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, signedHeaderHash(header, sig, NewHeaderField(arcMessageSignatureHeader, unsigned)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ams := unsigned + base64.StdEncoding.EncodeToString(signature)
+
+	unsigned = fmt.Sprintf("i=%d; a=rsa-sha256; cv=%s; d=example.org; s=arc; t=1467244800; b=", instance, cv)
+	sets, err := parseARCSets(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets = append(sets, &ARCSet{
+		rawResults:          NewHeaderField(arcResultsHeader, aar),
+		rawMessageSignature: NewHeaderField(arcMessageSignatureHeader, ams),
+		rawSeal:             NewHeaderField(arcSealHeader, unsigned),
+	})
+	signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, arcSealHash(sets, crypto.SHA256))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message.PrependHeader(arcResultsHeader, aar)
+	message.PrependHeader(arcMessageSignatureHeader, ams)
+	message.PrependHeader(arcSealHeader, unsigned+base64.StdEncoding.EncodeToString(signature))
+}
+
+func mustParseTags(t *testing.T, value string) map[string]string {
+	tags, err := parseTagList(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tags
+}
+
+func validateTestARC(v ARCValidator, message *Message) *ARCResult {
+	message.Body = strings.NewReader(testMessageBody)
+	return v.Validate(message)
+}
+
+func TestARCValidate(t *testing.T) {
+	key, pub := newTestKey(t, 1024)
+	v := ARCValidator{Resolver: fakeResolver{"arc._domainkey.example.org": {"v=DKIM1; k=rsa; p=" + pub}}}
+
+	message := newTestMessage()
+	result := validateTestARC(v, message)
+	if result.Result != None {
+		t.Errorf("Expected 'none' but got '%s' (%s)", result.Result, result.Reason)
+	}
+
+	sealTestMessage(t, message, key, 1, "none")
+	result = validateTestARC(v, message)
+	if result.Result != Pass || result.OldestPass != 0 || len(result.Sets) != 1 {
+		t.Errorf("Expected 'pass' but got '%s' (%s)", result.Result, result.Reason)
+	}
+
+	// a modification between the two intermediaries
+	message.Headers.Set("Subject", "[list] Is dinner ready?")
+	sealTestMessage(t, message, key, 2, "pass")
+	result = validateTestARC(v, message)
+	if result.Result != Pass || result.OldestPass != 2 {
+		t.Errorf("Expected 'pass' with oldest pass 2 but got '%s' %d (%s)", result.Result, result.OldestPass, result.Reason)
+	}
+	assertStringEquals("relay1.example.org; spf=pass smtp.mailfrom=example.com", result.Set(1).AuthenticationResults, t)
+	assertStringEquals("example.org", result.Set(2).Seal["d"], t)
+
+	message.Headers.Set("Subject", "Modified")
+	result = validateTestARC(v, message)
+	if result.Result != Fail || !strings.HasPrefix(result.Reason, "Message signature 2") {
+		t.Errorf("Expected message signature failure but got '%s' (%s)", result.Result, result.Reason)
+	}
+}
+
+func TestARCValidateSeals(t *testing.T) {
+	key, pub := newTestKey(t, 1024)
+	v := ARCValidator{Resolver: fakeResolver{"arc._domainkey.example.org": {"v=DKIM1; k=rsa; p=" + pub}}}
+
+	message := newTestMessage()
+	sealTestMessage(t, message, key, 1, "none")
+	sealTestMessage(t, message, key, 2, "pass")
+
+	results := (*message.Headers)["Arc-Authentication-Results"]
+	results[0] = strings.Replace(results[0], "spf=pass", "spf=fail", 1)
+	result := validateTestARC(v, message)
+	if result.Result != Fail || !strings.HasPrefix(result.Reason, "Seal 2") {
+		t.Errorf("Expected seal failure but got '%s' (%s)", result.Result, result.Reason)
+	}
+
+	message = newTestMessage()
+	sealTestMessage(t, message, key, 1, "none")
+	sealTestMessage(t, message, key, 2, "fail")
+	result = validateTestARC(v, message)
+	if result.Result != Fail || result.Reason != "Chain marked as failed in instance 2" {
+		t.Errorf("Expected chain failure but got '%s' (%s)", result.Result, result.Reason)
+	}
+
+	message = newTestMessage()
+	sealTestMessage(t, message, key, 1, "pass")
+	result = validateTestARC(v, message)
+	if result.Result != Fail || !strings.HasPrefix(result.Reason, "Invalid chain validation status") {
+		t.Errorf("Expected invalid chain status but got '%s' (%s)", result.Result, result.Reason)
+	}
+}
+
+func TestParseARCSets(t *testing.T) {
+	for _, c := range []struct {
+		seals   []string
+		reason  string
+		results []string
+	}{
+		{[]string{"i=2; cv=none"}, "Missing ARC set 1", []string{"i=2; example.org"}},
+		{[]string{"i=1; cv=none", "i=1; cv=none"}, "Duplicate ARC-Seal for instance 1", []string{"i=1; example.org"}},
+		{[]string{"i=51; cv=pass"}, "Invalid ARC-Seal: Invalid instance: 51", nil},
+		{[]string{"cv=none"}, "Invalid ARC-Seal: Missing instance", nil},
+		{[]string{"i=1; cv=none"}, "Incomplete ARC set 1", nil},
+	} {
+		message := newTestMessage()
+		for _, seal := range c.seals {
+			message.Headers.Add(arcSealHeader, seal)
+		}
+		for _, results := range c.results {
+			message.Headers.Add(arcResultsHeader, results)
+		}
+
+		_, err := parseARCSets(message.Fields())
+		if err == nil || err.Error() != c.reason {
+			t.Errorf("Expected '%s' but got %v", c.reason, err)
+		}
+	}
+}
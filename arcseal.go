@@ -0,0 +1,211 @@
+package emailauth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * ARCSealer adds an ARC set to messages passing through an
+ * intermediary (RFC 8617, section 5.1). Key is an RSA or Ed25519
+ * private key whose public key is published at
+ * <Selector>._domainkey.<Domain>. Headers lists the header fields to
+ * sign with the message signature; only those present are signed.
+ */
+type ARCSealer struct {
+	AuthServID string
+	Domain     string
+	Selector   string
+	Key        crypto.Signer
+	Headers    []string
+	Now        func() time.Time
+}
+
+var defaultARCSignedHeaders = []string{
+	"From", "Sender", "Reply-To", "To", "Cc", "Subject", "Date", "Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding", "DKIM-Signature",
+}
+
+/*
+ * Adds the next ARC set to the message, based on the results of
+ * validating it. The chain validation status is taken from results.ARC,
+ * which must be the result of validating the current chain. The body
+ * is read to compute the body hash. The added header fields are also
+ * returned, to be prepended to the message in the given order.
+ */
+func (s *ARCSealer) Seal(message *Message, results *AuthenticationResults) ([]string, error) {
+	if message.Headers == nil {
+		return nil, errors.New("Missing header")
+	}
+
+	if results == nil || results.ARC == nil {
+		return nil, errors.New("Missing ARC validation result")
+	}
+
+	algorithm, err := arcSigningAlgorithm(s.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := message.Fields()
+	instance, err := nextARCInstance(header)
+	if err != nil {
+		return nil, err
+	}
+
+	cv := "none"
+	switch results.ARC.Result {
+	case Pass:
+		cv = "pass"
+	case Fail:
+		cv = "fail"
+	}
+
+	if (cv == "none" && instance > 1) || (cv == "pass" && instance == 1) {
+		return nil, fmt.Errorf("Validation result %s does not match chain of %d sets", results.ARC.Result, instance-1)
+	}
+
+	bodySig := &dkimSignature{Hash: crypto.SHA256, BodyCanon: "relaxed", Length: -1}
+	bh, err := dkimBodyHash(message.Body, bodySig)
+	if err != nil {
+		return nil, err
+	}
+
+	ar := *results
+	if s.AuthServID != "" {
+		ar.AuthServID = s.AuthServID
+	}
+	aar := fmt.Sprintf("i=%d; %s", instance, ar.String())
+
+	timestamp := s.now().Unix()
+	unsigned := fmt.Sprintf("i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=", instance, algorithm, s.Domain,
+		s.Selector, timestamp, strings.Join(s.signedHeaders(header), ":"), base64.StdEncoding.EncodeToString(bh))
+	tags, err := parseTagList(unsigned + "AA==")
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := newARCSignature(tags, true)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := s.sign(signedHeaderHash(header, sig, NewHeaderField(arcMessageSignatureHeader, unsigned)))
+	if err != nil {
+		return nil, err
+	}
+	ams := unsigned + signature
+
+	unsigned = fmt.Sprintf("i=%d; a=%s; cv=%s; d=%s; s=%s; t=%d; b=", instance, algorithm, cv, s.Domain, s.Selector, timestamp)
+	set := &ARCSet{
+		rawResults:          NewHeaderField(arcResultsHeader, aar),
+		rawMessageSignature: NewHeaderField(arcMessageSignatureHeader, ams),
+		rawSeal:             NewHeaderField(arcSealHeader, unsigned),
+	}
+	sets, err := parseARCSets(header)
+	if err != nil && cv != "fail" {
+		return nil, err
+	}
+
+	if err == nil {
+		signature, err = s.sign(arcSealHash(append(sets, set), crypto.SHA256))
+	} else {
+		// a broken chain cannot be hashed, only the new set is sealed
+		signature, err = s.sign(arcSealHash([]*ARCSet{set}, crypto.SHA256))
+	}
+	if err != nil {
+		return nil, err
+	}
+	seal := unsigned + signature
+
+	message.PrependHeader(arcResultsHeader, aar)
+	message.PrependHeader(arcMessageSignatureHeader, ams)
+	message.PrependHeader(arcSealHeader, seal)
+
+	return []string{
+		arcSealHeader + ": " + seal,
+		arcMessageSignatureHeader + ": " + ams,
+		arcResultsHeader + ": " + aar,
+	}, nil
+}
+
+func (s *ARCSealer) signedHeaders(header Header) []string {
+	names := s.Headers
+	if len(names) == 0 {
+		names = defaultARCSignedHeaders
+	}
+
+	var signed []string
+	for _, name := range names {
+		for range header.Fields(name) {
+			signed = append(signed, name)
+		}
+	}
+	return signed
+}
+
+func (s *ARCSealer) sign(digest []byte) (string, error) {
+	opts := crypto.SignerOpts(crypto.SHA256)
+	if _, ok := s.Key.(ed25519.PrivateKey); ok {
+		opts = crypto.Hash(0)
+	}
+
+	signature, err := s.Key.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+func (s *ARCSealer) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+func arcSigningAlgorithm(key crypto.Signer) (string, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	}
+	return "", errors.New("Unsupported key type")
+}
+
+/*
+ * Returns the instance of the next ARC set, one above the highest
+ * instance found in the seals.
+ */
+func nextARCInstance(header Header) (int, error) {
+	highest, cv := 0, ""
+	for _, raw := range header.Values(arcSealHeader) {
+		tags, err := parseTagList(raw)
+		if err != nil {
+			continue
+		}
+
+		if i, err := strconv.Atoi(strings.TrimSpace(tags["i"])); err == nil && i > highest {
+			highest, cv = i, tags["cv"]
+		}
+	}
+
+	// RFC 8617, section 5.1.2: no sets are added to a failed chain
+	if strings.EqualFold(cv, "fail") {
+		return 0, errors.New("Chain has already failed")
+	}
+
+	if highest >= maxARCInstances {
+		return 0, errors.New("Maximum number of ARC sets reached")
+	}
+	return highest + 1, nil
+}
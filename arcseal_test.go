@@ -0,0 +1,90 @@
+package emailauth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestARCSeal(t *testing.T) {
+	rsaKey, rsaPub := newTestKey(t, 1024)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := ARCValidator{Resolver: fakeResolver{
+		"arc._domainkey.lists.example.org": {"v=DKIM1; k=rsa; p=" + rsaPub},
+		"arc._domainkey.relay.example.net": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+	}}
+	now := func() time.Time { return time.Unix(1467244800, 0) }
+
+	message := newTestMessage()
+	first := &ARCSealer{Domain: "lists.example.org", Selector: "arc", Key: rsaKey, Now: now}
+	results := &AuthenticationResults{
+		AuthServID: "lists.example.org",
+		SPF:        &SPFResult{Result: Pass, Domain: "football.example.com"},
+		ARC:        validateTestARC(v, message),
+	}
+
+	message.Body = strings.NewReader(testMessageBody)
+	fields, err := first.Seal(message, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "ARC-Seal: i=1; a=rsa-sha256; cv=none; d=lists.example.org; s=arc; t=1467244800; b=") {
+		t.Errorf("Unexpected header fields: %v", fields)
+	}
+	assertStringEquals("ARC-Authentication-Results: i=1; lists.example.org; spf=pass smtp.mailfrom=football.example.com; arc=none", fields[2], t)
+
+	result := validateTestARC(v, message)
+	if result.Result != Pass {
+		t.Fatalf("Expected 'pass' but got '%s' (%s)", result.Result, result.Reason)
+	}
+
+	message.Headers.Set("Subject", "[list] Is dinner ready?")
+	second := &ARCSealer{AuthServID: "mx.relay.example.net", Domain: "relay.example.net", Selector: "arc", Key: edKey, Now: now}
+	message.Body = strings.NewReader(testMessageBody)
+	fields, err = second.Seal(message, &AuthenticationResults{ARC: result})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(fields[0], "i=2; a=ed25519-sha256; cv=pass;") {
+		t.Errorf("Unexpected seal: %s", fields[0])
+	}
+
+	result = validateTestARC(v, message)
+	if result.Result != Pass || result.OldestPass != 2 {
+		t.Errorf("Expected 'pass' with oldest pass 2 but got '%s' %d (%s)", result.Result, result.OldestPass, result.Reason)
+	}
+	assertStringEquals("mx.relay.example.net; arc=pass", result.Set(2).AuthenticationResults, t)
+
+	message.Body = strings.NewReader(testMessageBody)
+	if _, err := second.Seal(message, &AuthenticationResults{ARC: newARCResult(None, "")}); err == nil {
+		t.Error("Expected error for validation result not matching the chain")
+	}
+}
+
+func TestARCSealFailedChain(t *testing.T) {
+	key, _ := newTestKey(t, 1024)
+	sealer := &ARCSealer{AuthServID: "relay.example.net", Domain: "relay.example.net", Selector: "arc", Key: key}
+
+	message := newTestMessage()
+	message.Headers.Add(arcSealHeader, "i=1; a=rsa-sha256; cv=none; d=example.org; s=arc; b=AA==")
+	message.Body = strings.NewReader(testMessageBody)
+	fields, err := sealer.Seal(message, &AuthenticationResults{ARC: newARCResult(Fail, "Incomplete ARC set 1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(fields[0], "i=2; a=rsa-sha256; cv=fail;") {
+		t.Errorf("Unexpected seal: %s", fields[0])
+	}
+
+	message.Body = strings.NewReader(testMessageBody)
+	if _, err := sealer.Seal(message, &AuthenticationResults{ARC: newARCResult(Fail, "")}); err == nil || err.Error() != "Chain has already failed" {
+		t.Errorf("Expected failed chain error but got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package emailauth
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+/*
+ * Authentication-Results:
+ *  mx.example.com;
+ *  dkim=pass header.d=esp.example.net;
+ *  dkim-atps=pass header.from=example.com
+ *
+ * DKIM-Signature:
+ *  v=1; a=rsa-sha256; d=esp.example.net; s=sel; atps=example.com; atps-h=sha256; ...
+ *
+ * <base32(sha256("esp.example.net"))>._atps.example.com. IN TXT "v=ATPS1;"
+ */
+
+type ATPSResult struct {
+	Result Result
+	Reason string
+	Domain string
+}
+
+/*
+ * Checks whether the author domain authorized the signing domain of
+ * a valid third-party signature (RFC 6541). The result is "none" for
+ * invalid or first-party signatures and "neutral" for third-party
+ * signatures that do not ask for ATPS evaluation.
+ */
+func (v DKIMValidator) ValidateATPS(dkimResult *DKIMResult, fromDomain string) *ATPSResult {
+	return v.ValidateATPSContext(context.Background(), dkimResult, fromDomain)
+}
+
+/*
+ * Like ValidateATPS, looking up the authorization with ctx. The result
+ * and queries are logged with the trace ID of ctx.
+ */
+func (v DKIMValidator) ValidateATPSContext(ctx context.Context, dkimResult *DKIMResult, fromDomain string) *ATPSResult {
+	resolver := traceResolver(ctx, v.Resolver, v.Logger, v.Metrics)
+	v.Resolver = resolver
+	result := v.validateATPS(dkimResult, fromDomain)
+	logVerdict(ctx, v.Logger, "dkim-atps", result.Result, slog.String("from", result.Domain),
+		slog.String("result", result.Result.String()), slog.String("reason", result.Reason))
+	observeEvaluation(v.Metrics, "dkim-atps", resolver, result.Result)
+	return result
+}
+
+func (v DKIMValidator) validateATPS(dkimResult *DKIMResult, fromDomain string) *ATPSResult {
+	fromDomain = strings.TrimSuffix(strings.ToLower(fromDomain), ".")
+	if dkimResult.Result != Pass {
+		return newATPSResult(None, "No valid signature", fromDomain)
+	}
+
+	signingDomain := strings.ToLower(dkimResult.Tags["d"])
+	if signingDomain == fromDomain {
+		return newATPSResult(None, "Not a third-party signature", fromDomain)
+	}
+
+	atps, ok := dkimResult.Tags["atps"]
+	if !ok {
+		return newATPSResult(Neutral, "No ATPS tag", fromDomain)
+	}
+
+	if !strings.EqualFold(strings.TrimSuffix(atps, "."), fromDomain) {
+		return newATPSResult(Neutral, "ATPS tag does not match author domain", fromDomain)
+	}
+
+	label, err := atpsLabel(signingDomain, dkimResult.Tags["atps-h"])
+	if err != nil {
+		return newATPSResult(Permerror, err.Error(), fromDomain)
+	}
+
+	name := label + "._atps." + fromDomain
+	records, err := resolverOrDefault(v.Resolver).LookupTXT(context.Background(), name)
+	if err != nil {
+		if isTemporaryDNSError(err) {
+			return newATPSResult(Temperror, err.Error(), fromDomain)
+		}
+		return newATPSResult(Fail, "No ATPS record", fromDomain)
+	}
+
+	for _, record := range records {
+		tags, err := parseTagList(record)
+		if err != nil || tags["v"] != "ATPS1" {
+			continue
+		}
+
+		if d, ok := tags["d"]; ok && !strings.EqualFold(d, signingDomain) {
+			continue
+		}
+
+		return newATPSResult(Pass, fmt.Sprintf("%s authorized by %s", signingDomain, fromDomain), fromDomain)
+	}
+
+	return newATPSResult(Fail, "No valid ATPS record", fromDomain)
+}
+
+/*
+ * Returns the DNS label under which the author domain publishes its
+ * authorization of the signing domain (RFC 6541, section 4.3).
+ */
+func atpsLabel(signingDomain string, hash string) (string, error) {
+	var sum []byte
+	switch hash {
+	case "none":
+		return signingDomain, nil
+	case "sha1":
+		s := sha1.Sum([]byte(signingDomain))
+		sum = s[:]
+	case "sha256":
+		s := sha256.Sum256([]byte(signingDomain))
+		sum = s[:]
+	case "":
+		return "", errors.New("Missing atps-h tag")
+	default:
+		return "", fmt.Errorf("Unsupported ATPS hash algorithm: %s", hash)
+	}
+
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum)), nil
+}
+
+func newATPSResult(result Result, reason string, domain string) *ATPSResult {
+	return &ATPSResult{Result: result, Reason: reason, Domain: domain}
+}
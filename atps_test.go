@@ -0,0 +1,66 @@
+package emailauth
+
+import (
+	"testing"
+)
+
+func TestValidateATPS(t *testing.T) {
+	label, err := atpsLabel("esp.example.net", "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := DKIMValidator{Resolver: fakeResolver{
+		label + "._atps.example.com":        {"v=ATPS1; d=esp.example.net"},
+		"esp.example.net._atps.example.org": {"v=ATPS1"},
+	}}
+
+	dkimResult := newDKIMResult(Pass, "")
+	dkimResult.Tags["d"] = "esp.example.net"
+	dkimResult.Tags["atps"] = "example.com"
+	dkimResult.Tags["atps-h"] = "sha256"
+
+	expected := map[string]Result{
+		"example.com":     Pass,
+		"example.net":     Neutral,
+		"esp.example.net": None,
+	}
+	for from, result := range expected {
+		atps := v.ValidateATPS(dkimResult, from)
+		if atps.Result != result {
+			t.Errorf("Expected '%s' for '%s' but got '%s' (%s)", result, from, atps.Result, atps.Reason)
+		}
+	}
+
+	dkimResult.Tags["atps"] = "example.org"
+	dkimResult.Tags["atps-h"] = "none"
+	if atps := v.ValidateATPS(dkimResult, "example.org"); atps.Result != Pass {
+		t.Errorf("Expected 'pass' but got '%s' (%s)", atps.Result, atps.Reason)
+	}
+
+	dkimResult.Tags["atps-h"] = "sha1"
+	if atps := v.ValidateATPS(dkimResult, "example.org"); atps.Result != Fail {
+		t.Errorf("Expected 'fail' but got '%s' (%s)", atps.Result, atps.Reason)
+	}
+
+	dkimResult.Result = Fail
+	if atps := v.ValidateATPS(dkimResult, "example.org"); atps.Result != None {
+		t.Errorf("Expected 'none' but got '%s' (%s)", atps.Result, atps.Reason)
+	}
+}
+
+func TestATPSLabel(t *testing.T) {
+	label, _ := atpsLabel("example.net", "sha1")
+	if len(label) != 32 {
+		t.Errorf("Expected 32 characters but got '%s'", label)
+	}
+
+	label, _ = atpsLabel("example.net", "sha256")
+	if len(label) != 52 {
+		t.Errorf("Expected 52 characters but got '%s'", label)
+	}
+
+	if _, err := atpsLabel("example.net", "md5"); err == nil {
+		t.Error("Unsupported hash was accepted")
+	}
+}
@@ -0,0 +1,235 @@
+package emailauth
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+ * Authentication-Results: mx.example.com;
+ *  spf=pass smtp.mailfrom=example.com;
+ *  dkim=pass reason="1024-bit key; unprotected key" header.d=example.com header.i=@example.com header.b=LvCYfMPA;
+ *  dmarc=pass (p=REJECT sp=REJECT dis=NONE) header.from=example.com;
+ *  arc=pass
+ *
+ * With a trace ID, the authserv-id is followed by a comment:
+ *
+ * Authentication-Results: mx.example.com (trace-id 5f0c3a9e81d2b674);
+ *  spf=pass smtp.mailfrom=example.com
+ */
+
+/*
+ * AuthenticationResults collects the results of the validators for
+ * an Authentication-Results or ARC-Authentication-Results header field
+ * (RFC 8601). Results that are nil are left out. TraceID is added as
+ * a comment if set.
+ */
+type AuthenticationResults struct {
+	AuthServID string
+	TraceID    string
+	SPF        *SPFResult
+	DKIM       []*DKIMResult
+	ADSP       *ADSPResult
+	ATPS       []*ATPSResult
+	DMARC      *DMARCResult
+	ARC        *ARCResult
+}
+
+/*
+ * Returns the header field value, starting with the authserv-id.
+ */
+func (a *AuthenticationResults) String() string {
+	results := a.results()
+	if len(results) == 0 {
+		results = []string{"none"}
+	}
+	authServID := a.AuthServID
+	if a.TraceID != "" {
+		authServID += " (trace-id " + a.TraceID + ")"
+	}
+	return authServID + "; " + strings.Join(results, "; ")
+}
+
+func (a *AuthenticationResults) results() []string {
+	var results []string
+	if a.SPF != nil {
+		results = append(results, authResult("spf", a.SPF.Result, "", "", "smtp.mailfrom", a.SPF.Domain))
+	}
+
+	for _, r := range a.DKIM {
+		props := []string{"header.d", r.Tags["d"], "header.i", r.Tags["i"]}
+		if b := removeWhitespace(r.Tags["b"]); b != "" {
+			if len(b) > 8 {
+				b = b[:8]
+			}
+			props = append(props, "header.b", b)
+		}
+		results = append(results, authResult("dkim", r.Result, r.Reason, "", props...))
+	}
+
+	if a.ADSP != nil {
+		results = append(results, authResult("dkim-adsp", a.ADSP.Result, "", "", "header.from", a.ADSP.Domain))
+	}
+
+	for _, r := range a.ATPS {
+		results = append(results, authResult("dkim-atps", r.Result, "", "", "header.from", r.Domain))
+	}
+
+	if a.DMARC != nil {
+		results = append(results, authResult("dmarc", a.DMARC.Result, "", a.DMARC.Comment(), "header.from", a.DMARC.Domain))
+	}
+
+	if a.ARC != nil {
+		var props []string
+		if a.ARC.OldestPass > 0 {
+			props = append(props, "header.oldest-pass", fmt.Sprint(a.ARC.OldestPass))
+		}
+		results = append(results, authResult("arc", a.ARC.Result, "", "", props...))
+	}
+
+	return results
+}
+
+/*
+ * Formats a single result. props are pairs of property names and
+ * values; empty values are left out.
+ */
+func authResult(method string, result Result, reason string, comment string, props ...string) string {
+	s := method + "=" + result.String()
+	if comment != "" {
+		s += " " + comment
+	}
+
+	if reason != "" {
+		s += " reason=" + quoteAuthValue(reason)
+	}
+
+	for i := 0; i+1 < len(props); i += 2 {
+		if props[i+1] != "" {
+			s += " " + props[i] + "=" + props[i+1]
+		}
+	}
+	return s
+}
+
+func quoteAuthValue(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return "\"" + value + "\""
+}
+
+type authResultInfo struct {
+	Method string
+	Result Result
+	Props  map[string]string
+}
+
+/*
+ * Parses the results of an Authentication-Results header field value.
+ * The authserv-id and comments are skipped.
+ */
+func parseAuthResults(value string) []*authResultInfo {
+	var results []*authResultInfo
+	for _, resinfo := range splitAuthResults(stripAuthComments(value)) {
+		fields := splitAuthFields(resinfo)
+		if len(fields) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(fields[0], "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		r := &authResultInfo{Method: strings.ToLower(parts[0]), Result: Result(strings.ToLower(parts[1])), Props: make(map[string]string)}
+		for _, field := range fields[1:] {
+			if prop := strings.SplitN(field, "=", 2); len(prop) == 2 {
+				r.Props[strings.ToLower(prop[0])] = unquoteAuthValue(prop[1])
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func stripAuthComments(value string) string {
+	var b strings.Builder
+	depth, quoted, escaped := 0, false, false
+	for _, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && (quoted || depth > 0):
+			escaped = true
+		case c == '"' && depth == 0:
+			quoted = !quoted
+		case c == '(' && !quoted:
+			depth++
+			continue
+		case c == ')' && !quoted && depth > 0:
+			depth--
+			continue
+		}
+		if depth == 0 {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func splitAuthResults(value string) []string {
+	var results []string
+	start, quoted, escaped := 0, false, false
+	for i, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			results = append(results, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(results, value[start:])
+}
+
+func splitAuthFields(value string) []string {
+	var fields []string
+	var field strings.Builder
+	quoted, escaped := false, false
+	for _, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case (c == ' ' || c == '\t' || c == '\r' || c == '\n') && !quoted:
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+			continue
+		}
+		field.WriteRune(c)
+	}
+
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+func unquoteAuthValue(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+
+	value = value[1 : len(value)-1]
+	value = strings.Replace(value, "\\\"", "\"", -1)
+	return strings.Replace(value, "\\\\", "\\", -1)
+}
@@ -0,0 +1,46 @@
+package emailauth
+
+import (
+	"testing"
+)
+
+func TestAuthenticationResults(t *testing.T) {
+	dmarc := newDMARCResult(Pass, "")
+	dmarc.Domain = "example.com"
+	dmarc.Tags = map[string]string{"p": "reject", "sp": "quarantine"}
+
+	results := &AuthenticationResults{
+		AuthServID: "mx.example.net",
+		SPF:        &SPFResult{Result: Softfail, Domain: "bounces.example.com"},
+		DKIM: []*DKIMResult{
+			{Result: Pass, Reason: "1024-bit key; unprotected key", Tags: map[string]string{"d": "example.com", "i": "@example.com", "b": "LvCYfMPAp0mh6Abf\r\n nlOL5"}},
+			{Result: Fail, Reason: `Body "hash" did not verify`, Tags: map[string]string{"d": "esp.example"}},
+		},
+		DMARC: dmarc,
+		ARC:   &ARCResult{Result: Pass, OldestPass: 2},
+	}
+
+	assertStringEquals("mx.example.net; spf=softfail smtp.mailfrom=bounces.example.com; "+
+		`dkim=pass reason="1024-bit key; unprotected key" header.d=example.com header.i=@example.com header.b=LvCYfMPA; `+
+		`dkim=fail reason="Body \"hash\" did not verify" header.d=esp.example; `+
+		"dmarc=pass (p=REJECT sp=QUARANTINE dis=NONE) header.from=example.com; arc=pass header.oldest-pass=2", results.String(), t)
+
+	assertStringEquals("mx.example.net; none", (&AuthenticationResults{AuthServID: "mx.example.net"}).String(), t)
+}
+
+func TestParseAuthResults(t *testing.T) {
+	results := parseAuthResults(`mx.example.net 1; spf=pass (sender (IP) is 192.0.2.1; ok) smtp.mailfrom=example.com; ` +
+		`dkim=fail reason="a \"quoted\"; header.d=evil.example" header.d=example.com; DMARC=Pass header.from=Example.com`)
+
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+
+	assertStringEquals("spf", results[0].Method, t)
+	assertStringEquals("example.com", results[0].Props["smtp.mailfrom"], t)
+	assertStringEquals("example.com", results[1].Props["header.d"], t)
+	assertStringEquals(`a "quoted"; header.d=evil.example`, results[1].Props["reason"], t)
+	assertStringEquals("dmarc", results[2].Method, t)
+	assertStringEquals("pass", results[2].Result.String(), t)
+	assertStringEquals("Example.com", results[2].Props["header.from"], t)
+}
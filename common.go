@@ -1,8 +1,11 @@
 package emailauth
 
 import (
-	"io"
-	"net/textproto"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
 )
 
 type Result string
@@ -20,9 +23,193 @@ const (
 	Softfail  = Result("softfail")
 	Temperror = Result("temperror")
 	Permerror = Result("permerror")
+
+	// DKIM-ADSP (RFC 5617, section 5.4)
+	Unknown  = Result("unknown")
+	Discard  = Result("discard")
+	Nxdomain = Result("nxdomain")
 )
 
-type Message struct {
-	Headers *textproto.MIMEHeader
-	Body    io.Reader
+/*
+ * Envelope holds the SMTP session data of a message.
+ */
+type Envelope struct {
+	ClientIP net.IP
+	Helo     string
+	MailFrom string
+	RcptTo   []string
+}
+
+/*
+ * Resolver is the DNS interface used by the validators. LookupTXT
+ * returns one string per TXT record, with the character-strings of
+ * a record already concatenated. *net.Resolver satisfies it.
+ */
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+func resolverOrDefault(resolver Resolver) Resolver {
+	if resolver == nil {
+		return net.DefaultResolver
+	}
+	return resolver
+}
+
+/*
+ * Checks whether a domain exists, i.e. the lookups of its addresses
+ * and MX records are not answered with NXDOMAIN. An error is only
+ * returned if that could not be determined. Resolvers not telling
+ * NXDOMAIN and NODATA apart, like the system resolver, report domains
+ * without address and MX records as missing.
+ */
+func domainExists(resolver Resolver, domain string) (bool, error) {
+	_, err := resolver.LookupHost(context.Background(), domain)
+	if err == nil || isNoRecordsDNSError(err) {
+		return true, nil
+	}
+
+	if isTemporaryDNSError(err) {
+		return false, err
+	}
+
+	_, err = resolver.LookupMX(context.Background(), domain)
+	if err == nil || isNoRecordsDNSError(err) {
+		return true, nil
+	}
+
+	if isNotFoundDNSError(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+/*
+ * Checks whether a domain resolves to an address or an MX record. An
+ * error is only returned if that could not be determined.
+ */
+func hasAddressOrMX(resolver Resolver, domain string) (bool, error) {
+	_, err := resolver.LookupHost(context.Background(), domain)
+	if err == nil {
+		return true, nil
+	}
+
+	if isTemporaryDNSError(err) {
+		return false, err
+	}
+
+	_, err = resolver.LookupMX(context.Background(), domain)
+	if err == nil {
+		return true, nil
+	}
+
+	if isNotFoundDNSError(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// the error of DNSClient for names without records of a type (NODATA)
+const dnsNoRecords = "no such record"
+
+func isNotFoundDNSError(err error) bool {
+	if err, ok := err.(*net.DNSError); ok {
+		return err.IsNotFound
+	}
+	return false
+}
+
+func isNoRecordsDNSError(err error) bool {
+	if err, ok := err.(*net.DNSError); ok {
+		return err.IsNotFound && err.Err == dnsNoRecords
+	}
+	return false
+}
+
+func isTemporaryDNSError(err error) bool {
+	if err, ok := err.(*net.DNSError); ok {
+		return err.IsTimeout || err.IsTemporary
+	}
+	return false
+}
+
+/*
+ * Parses a tag=value list as used by DKIM signatures and key records
+ * (RFC 6376, section 3.2) and the DMARC and ATPS records derived from
+ * it. Whitespace around names and values is removed, tag names are
+ * case-sensitive and must not be repeated.
+ */
+/*
+ * Returns the name of the first tag of a tag list, or an empty string.
+ */
+func firstTagName(list string) string {
+	for _, spec := range strings.Split(list, ";") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			name, _, _ := strings.Cut(spec, "=")
+			return strings.TrimSpace(name)
+		}
+	}
+	return ""
+}
+
+func parseTagList(list string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(list, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		idx := strings.IndexByte(spec, '=')
+		if idx < 1 {
+			return nil, fmt.Errorf("Invalid tag: %s", spec)
+		}
+
+		name := strings.TrimSpace(spec[:idx])
+		if !isValidTagName(name) {
+			return nil, fmt.Errorf("Invalid tag name: %s", name)
+		}
+
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("Duplicate tag: %s", name)
+		}
+
+		tags[name] = strings.TrimSpace(spec[idx+1:])
+	}
+
+	if len(tags) == 0 {
+		return nil, errors.New("Empty tag list")
+	}
+
+	return tags, nil
+}
+
+func isValidTagName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i, c := range name {
+		isAlpha := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if i == 0 && !isAlpha {
+			return false
+		}
+		// '-' is not in the RFC 6376 grammar but used by RFC 6541 (atps-h)
+		if !isAlpha && !(c >= '0' && c <= '9') && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func removeWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
 }
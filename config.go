@@ -0,0 +1,817 @@
+package emailauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+/*
+ * Configuration file of the validators and the milter daemon:
+ *
+ *  authserv-id = "mx.example.com"
+ *
+ *  [dns]
+ *  servers = ["127.0.0.1", "[::1]:53"]
+ *  timeout = "5s"
+ *  cache-size = 10000
+ *  max-lookups = 30
+ *
+ *  [milter]
+ *  listen = "inet:127.0.0.1:8891"
+ *  timeout = "10m"
+ *  reject = true
+ *  trace-comment = true
+ *
+ *  [dkim]
+ *  max-signatures = 10
+ *  min-rsa-bits = 1024
+ *
+ *  [dmarc]
+ *  public-suffix-list = "/usr/share/publicsuffix/public_suffix_list.dat"
+ *
+ *  [arc]
+ *  enabled = true
+ *  trusted-sealers = ["lists.example.org"]
+ *
+ *  [log]
+ *  level = "info"
+ *  file = "/var/log/emailauth.log"
+ *  max-size-mb = 100
+ *  syslog = true
+ *
+ *  [metrics]
+ *  listen = "127.0.0.1:9899"
+ *
+ * The reporters and the ARC sealer are configured for programs using
+ * them with their own delivery, the daemon rejects these sections:
+ *
+ *  [dmarc.reports]
+ *  enabled = true
+ *  org-name = "Example Inc."
+ *  email = "dmarc-reports@example.com"
+ *
+ *  [arc.sealer]
+ *  domain = "example.com"
+ *  selector = "arc"
+ *  key-file = "/etc/emailauth/arc.pem"
+ */
+
+type Config struct {
+	AuthServID string        `toml:"authserv-id"`
+	DNS        DNSConfig     `toml:"dns"`
+	Milter     MilterConfig  `toml:"milter"`
+	DKIM       DKIMConfig    `toml:"dkim"`
+	DMARC      DMARCConfig   `toml:"dmarc"`
+	ARC        ARCConfig     `toml:"arc"`
+	Log        LogConfig     `toml:"log"`
+	Metrics    MetricsConfig `toml:"metrics"`
+
+	resolver         Resolver
+	publicSuffixList *PublicSuffixList
+	sealerKey        crypto.Signer
+	logger           *slog.Logger
+	metrics          Metrics
+}
+
+/*
+ * DNSConfig selects the DNS servers to query instead of the system
+ * resolver. Timeout limits each lookup, MaxLookups the lookups of
+ * each validator per message (0 for no limit). Up to CacheSize answers are
+ * cached, for their TTL but at most MaxTTL; negative answers without
+ * TTL for NegativeTTL. The system resolver reports no TTLs, its
+ * answers are cached for five minutes. CacheSize 0 disables the cache.
+ */
+type DNSConfig struct {
+	Servers     []string `toml:"servers"`
+	Timeout     Duration `toml:"timeout"`
+	CacheSize   int      `toml:"cache-size"`
+	MaxLookups  int      `toml:"max-lookups"`
+	MaxTTL      Duration `toml:"max-ttl"`
+	NegativeTTL Duration `toml:"negative-ttl"`
+}
+
+/*
+ * MilterConfig holds the listen address of the daemon, either
+ * "inet:host:port" or "unix:/path". Timeout limits the time waiting
+ * for the next command of the MTA. TraceComment adds the trace ID of
+ * each message to its Authentication-Results header field.
+ */
+type MilterConfig struct {
+	Listen       string   `toml:"listen"`
+	Timeout      Duration `toml:"timeout"`
+	Reject       bool     `toml:"reject"`
+	Quarantine   bool     `toml:"quarantine"`
+	TraceComment bool     `toml:"trace-comment"`
+}
+
+type DKIMConfig struct {
+	MaxSignatures  int  `toml:"max-signatures"`
+	MinRSABits     int  `toml:"min-rsa-bits"`
+	WeakRSABits    int  `toml:"weak-rsa-bits"`
+	AllowSHA1      bool `toml:"allow-sha1"`
+	IgnoreTestMode bool `toml:"ignore-test-mode"`
+}
+
+type DMARCConfig struct {
+	PublicSuffixList string               `toml:"public-suffix-list"`
+	Reports          ReportConfig         `toml:"reports"`
+	FailureReports   FailureReportsConfig `toml:"failure-reports"`
+}
+
+type ReportConfig struct {
+	Enabled          bool     `toml:"enabled"`
+	OrgName          string   `toml:"org-name"`
+	Email            string   `toml:"email"`
+	ExtraContactInfo string   `toml:"extra-contact-info"`
+	CheckInterval    Duration `toml:"check-interval"`
+}
+
+type FailureReportsConfig struct {
+	Enabled      bool   `toml:"enabled"`
+	ReportingMTA string `toml:"reporting-mta"`
+	From         string `toml:"from"`
+	HeadersOnly  bool   `toml:"headers-only"`
+	RedactSecret string `toml:"redact-secret"`
+}
+
+type ARCConfig struct {
+	Enabled        bool         `toml:"enabled"`
+	TrustedSealers []string     `toml:"trusted-sealers"`
+	Sealer         SealerConfig `toml:"sealer"`
+}
+
+/*
+ * SealerConfig holds the signing key of the ARC sealer, a PEM encoded
+ * RSA or Ed25519 private key (PKCS #1 or PKCS #8).
+ */
+type SealerConfig struct {
+	Domain   string   `toml:"domain"`
+	Selector string   `toml:"selector"`
+	KeyFile  string   `toml:"key-file"`
+	Headers  []string `toml:"headers"`
+}
+
+/*
+ * LogConfig selects the log level and the sinks: a file and/or syslog,
+ * standard error if neither is set. The file is rotated once it
+ * exceeds MaxSizeMB megabytes, keeping MaxBackups old files.
+ * SyslogAddress is empty for the local syslog daemon, otherwise
+ * "udp:host:port", "tcp:host:port" or "unix:/path".
+ */
+type LogConfig struct {
+	Level         string `toml:"level"`
+	File          string `toml:"file"`
+	MaxSizeMB     int    `toml:"max-size-mb"`
+	MaxBackups    int    `toml:"max-backups"`
+	Syslog        bool   `toml:"syslog"`
+	SyslogAddress string `toml:"syslog-address"`
+	SyslogTag     string `toml:"syslog-tag"`
+}
+
+/*
+ * MetricsConfig holds the "host:port" address serving the metrics
+ * over HTTP at /metrics, none if empty.
+ */
+type MetricsConfig struct {
+	Listen string `toml:"listen"`
+}
+
+/*
+ * Duration is a time.Duration read from strings like "1m30s".
+ */
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("Invalid duration: %s", text)
+	}
+	d.Duration = duration
+	return nil
+}
+
+/*
+ * ConfigError points at the offending key of a configuration.
+ */
+type ConfigError struct {
+	Key     string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return e.Key + ": " + e.Message
+}
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+func DefaultConfig() *Config {
+	return &Config{
+		DNS:    DNSConfig{Timeout: Duration{5 * time.Second}, CacheSize: defaultCacheEntries},
+		Milter: MilterConfig{Listen: "inet:127.0.0.1:8891", Timeout: Duration{10 * time.Minute}},
+		DKIM: DKIMConfig{
+			MaxSignatures: defaultMaxSignatures,
+			MinRSABits:    DefaultDKIMKeyPolicy.MinRSABits,
+			WeakRSABits:   DefaultDKIMKeyPolicy.WeakRSABits,
+		},
+		Log: LogConfig{Level: "info", MaxBackups: 5},
+	}
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(string(data))
+}
+
+/*
+ * Parses a configuration on top of the defaults and validates it.
+ * Files referenced by the configuration are loaded.
+ */
+func ParseConfig(data string) (*Config, error) {
+	var primitives map[string]toml.Primitive
+	md, err := toml.Decode(data, &primitives)
+	if err != nil {
+		return nil, err
+	}
+
+	config := DefaultConfig()
+	if err := decodeConfigTable(&md, primitives, nil, reflect.ValueOf(config).Elem()); err != nil {
+		return nil, err
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+/*
+ * Decodes a table key by key into the tagged fields of a struct, so
+ * that errors and unknown keys can be reported with their full name.
+ */
+func decodeConfigTable(md *toml.MetaData, table map[string]toml.Primitive, path []string, target reflect.Value) error {
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < target.NumField(); i++ {
+		if tag := target.Type().Field(i).Tag.Get("toml"); tag != "" {
+			fields[tag] = target.Field(i)
+		}
+	}
+
+	names := make([]string, 0, len(table))
+	for name := range table {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		keyPath := append(append([]string(nil), path...), name)
+		key := strings.Join(keyPath, ".")
+		field, ok := fields[name]
+		if !ok {
+			return &ConfigError{Key: key, Message: "Unknown key"}
+		}
+
+		if field.Kind() == reflect.Struct && !reflect.PointerTo(field.Type()).Implements(textUnmarshalerType) {
+			var nested map[string]toml.Primitive
+			// implicitly defined tables have no type
+			if t := md.Type(keyPath...); (t != "" && t != "Hash") || md.PrimitiveDecode(table[name], &nested) != nil {
+				return &ConfigError{Key: key, Message: "Expected a table"}
+			}
+			if err := decodeConfigTable(md, nested, keyPath, field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// unmarshaled here, as the decoder adds its position to their errors
+		if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			var text string
+			if err := md.PrimitiveDecode(table[name], &text); err != nil {
+				return &ConfigError{Key: key, Message: "Expected a string"}
+			}
+			if err := u.UnmarshalText([]byte(text)); err != nil {
+				return &ConfigError{Key: key, Message: err.Error()}
+			}
+			continue
+		}
+
+		if err := md.PrimitiveDecode(table[name], field.Addr().Interface()); err != nil {
+			return &ConfigError{Key: key, Message: err.Error()}
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if strings.ContainsAny(c.AuthServID, " \t\r\n;()\"") {
+		return &ConfigError{Key: "authserv-id", Message: "Invalid authserv-id"}
+	}
+
+	for i, server := range c.DNS.Servers {
+		address, err := dnsServerAddress(server)
+		if err != nil {
+			return &ConfigError{Key: fmt.Sprintf("dns.servers[%d]", i), Message: err.Error()}
+		}
+		c.DNS.Servers[i] = address
+	}
+
+	durations := []struct {
+		key      string
+		duration Duration
+	}{
+		{"dns.timeout", c.DNS.Timeout},
+		{"dns.max-ttl", c.DNS.MaxTTL},
+		{"dns.negative-ttl", c.DNS.NegativeTTL},
+		{"milter.timeout", c.Milter.Timeout},
+		{"dmarc.reports.check-interval", c.DMARC.Reports.CheckInterval},
+	}
+	for _, d := range durations {
+		if d.duration.Duration < 0 {
+			return &ConfigError{Key: d.key, Message: "Negative duration"}
+		}
+	}
+
+	if c.DNS.CacheSize < 0 {
+		return &ConfigError{Key: "dns.cache-size", Message: "Must not be negative"}
+	}
+
+	if c.DNS.MaxLookups < 0 {
+		return &ConfigError{Key: "dns.max-lookups", Message: "Must not be negative"}
+	}
+
+	if _, _, err := c.ListenAddress(); err != nil {
+		return &ConfigError{Key: "milter.listen", Message: err.Error()}
+	}
+
+	if c.DKIM.MaxSignatures < 1 {
+		return &ConfigError{Key: "dkim.max-signatures", Message: "Must be at least 1"}
+	}
+
+	if c.DKIM.MinRSABits < 0 {
+		return &ConfigError{Key: "dkim.min-rsa-bits", Message: "Must not be negative"}
+	}
+
+	if c.DKIM.WeakRSABits < c.DKIM.MinRSABits {
+		return &ConfigError{Key: "dkim.weak-rsa-bits", Message: "Must not be below dkim.min-rsa-bits"}
+	}
+
+	if err := c.validateReports(); err != nil {
+		return err
+	}
+
+	for i, domain := range c.ARC.TrustedSealers {
+		if !isValidDomain(domain) {
+			return &ConfigError{Key: fmt.Sprintf("arc.trusted-sealers[%d]", i), Message: "Invalid domain: " + sanitizeDomainForPrinting(domain)}
+		}
+	}
+
+	if err := c.loadSealerKey(); err != nil {
+		return err
+	}
+
+	if err := c.validateLog(); err != nil {
+		return err
+	}
+
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			return &ConfigError{Key: "metrics.listen", Message: "Invalid listen address: " + c.Metrics.Listen}
+		}
+	}
+
+	if c.DMARC.PublicSuffixList != "" {
+		f, err := os.Open(c.DMARC.PublicSuffixList)
+		if err != nil {
+			return &ConfigError{Key: "dmarc.public-suffix-list", Message: err.Error()}
+		}
+		defer f.Close()
+
+		if c.publicSuffixList, err = LoadPublicSuffixList(f); err != nil {
+			return &ConfigError{Key: "dmarc.public-suffix-list", Message: err.Error()}
+		}
+	}
+
+	c.resolver = c.newResolver()
+	return nil
+}
+
+func (c *Config) validateReports() error {
+	reports := c.DMARC.Reports
+	if reports.Enabled {
+		if reports.OrgName == "" {
+			return &ConfigError{Key: "dmarc.reports.org-name", Message: "Required for aggregate reports"}
+		}
+		if !strings.Contains(reports.Email, "@") {
+			return &ConfigError{Key: "dmarc.reports.email", Message: "Expected an email address"}
+		}
+	}
+
+	failure := c.DMARC.FailureReports
+	if failure.Enabled {
+		if !strings.Contains(failure.From, "@") {
+			return &ConfigError{Key: "dmarc.failure-reports.from", Message: "Expected an email address"}
+		}
+		if failure.ReportingMTA == "" {
+			return &ConfigError{Key: "dmarc.failure-reports.reporting-mta", Message: "Required for failure reports"}
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateLog() error {
+	if !containsFold(logLevels, c.Log.Level) {
+		return &ConfigError{Key: "log.level", Message: "Expected one of " + strings.Join(logLevels, ", ")}
+	}
+
+	if c.Log.MaxSizeMB < 0 {
+		return &ConfigError{Key: "log.max-size-mb", Message: "Must not be negative"}
+	}
+
+	if c.Log.MaxBackups < 0 {
+		return &ConfigError{Key: "log.max-backups", Message: "Must not be negative"}
+	}
+
+	if _, _, err := c.syslogAddress(); err != nil {
+		return &ConfigError{Key: "log.syslog-address", Message: err.Error()}
+	}
+	return nil
+}
+
+func (c *Config) syslogAddress() (string, string, error) {
+	address := c.Log.SyslogAddress
+	if address == "" {
+		return "", "", nil
+	}
+
+	idx := strings.IndexByte(address, ':')
+	if idx < 0 {
+		return "", "", fmt.Errorf("Invalid syslog address: %s", address)
+	}
+
+	switch network := address[:idx]; network {
+	case "udp", "tcp":
+		if _, _, err := net.SplitHostPort(address[idx+1:]); err != nil {
+			return "", "", fmt.Errorf("Invalid syslog address: %s", address)
+		}
+		return network, address[idx+1:], nil
+	case "unix":
+		// local daemon at a non-standard path
+		return "", address[idx+1:], nil
+	}
+	return "", "", fmt.Errorf("Invalid syslog address: %s", address)
+}
+
+/*
+ * Opens the configured log sinks and passes the logger to the
+ * validators created afterwards. The returned closer closes the sinks.
+ */
+func (c *Config) OpenLogger() (*slog.Logger, io.Closer, error) {
+	level, err := ParseLogLevel(c.Log.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handlers fanoutHandler
+	var sinks closers
+	if c.Log.File != "" {
+		f, err := OpenRotatingFile(c.Log.File, int64(c.Log.MaxSizeMB)<<20, c.Log.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		handlers = append(handlers, slog.NewTextHandler(f, opts))
+		sinks = append(sinks, f)
+	}
+
+	if c.Log.Syslog {
+		network, address, _ := c.syslogAddress()
+		h, err := NewSyslogHandler(network, address, c.Log.SyslogTag, opts)
+		if err != nil {
+			sinks.Close()
+			return nil, nil, err
+		}
+		handlers = append(handlers, h)
+		sinks = append(sinks, h)
+	}
+
+	if len(handlers) == 0 {
+		handlers = append(handlers, slog.NewTextHandler(os.Stderr, opts))
+	}
+
+	var logger *slog.Logger
+	if len(handlers) == 1 {
+		logger = slog.New(handlers[0])
+	} else {
+		logger = slog.New(handlers)
+	}
+
+	c.logger = logger
+	return logger, sinks, nil
+}
+
+/*
+ * Sets the logger passed to the validators created afterwards, e.g.
+ * one with an own handler.
+ */
+func (c *Config) SetLogger(logger *slog.Logger) {
+	c.logger = logger
+}
+
+func (c *Config) Logger() *slog.Logger {
+	return c.logger
+}
+
+/*
+ * Sets the metrics passed to the validators created afterwards.
+ */
+func (c *Config) SetMetrics(metrics Metrics) {
+	c.metrics = metrics
+}
+
+func (c *Config) loadSealerKey() error {
+	sealer := c.ARC.Sealer
+	if sealer.Domain == "" && sealer.Selector == "" && sealer.KeyFile == "" {
+		return nil
+	}
+
+	if !isValidDomain(sealer.Domain) {
+		return &ConfigError{Key: "arc.sealer.domain", Message: "Invalid domain: " + sanitizeDomainForPrinting(sealer.Domain)}
+	}
+
+	if sealer.Selector == "" {
+		return &ConfigError{Key: "arc.sealer.selector", Message: "Required for sealing"}
+	}
+
+	if sealer.KeyFile == "" {
+		return &ConfigError{Key: "arc.sealer.key-file", Message: "Required for sealing"}
+	}
+
+	key, err := loadSigningKey(sealer.KeyFile)
+	if err != nil {
+		return &ConfigError{Key: "arc.sealer.key-file", Message: err.Error()}
+	}
+	c.sealerKey = key
+	return nil
+}
+
+/*
+ * Reads a PEM encoded RSA or Ed25519 private key.
+ */
+func loadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		}
+		return nil, errors.New("Unsupported key type")
+	}
+	return nil, fmt.Errorf("Unsupported PEM type: %s", block.Type)
+}
+
+func dnsServerAddress(server string) (string, error) {
+	if ip := net.ParseIP(strings.Trim(server, "[]")); ip != nil {
+		return net.JoinHostPort(ip.String(), "53"), nil
+	}
+
+	host, port, err := net.SplitHostPort(server)
+	if err != nil || net.ParseIP(host) == nil || port == "" {
+		return "", fmt.Errorf("Invalid server address: %s", server)
+	}
+	return server, nil
+}
+
+/*
+ * Returns network and address to listen on for the milter.
+ */
+func (c *Config) ListenAddress() (string, string, error) {
+	listen := c.Milter.Listen
+	idx := strings.IndexByte(listen, ':')
+	if idx < 0 {
+		return "", "", fmt.Errorf("Invalid listen address: %s", listen)
+	}
+
+	switch scheme, address := listen[:idx], listen[idx+1:]; scheme {
+	case "inet", "inet6":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("Invalid listen address: %s", listen)
+		}
+		return "tcp", address, nil
+	case "unix", "local":
+		if address == "" {
+			return "", "", fmt.Errorf("Invalid listen address: %s", listen)
+		}
+		return "unix", address, nil
+	}
+
+	// host:port without scheme
+	if _, _, err := net.SplitHostPort(listen); err != nil {
+		return "", "", fmt.Errorf("Invalid listen address: %s", listen)
+	}
+	return "tcp", listen, nil
+}
+
+func (c *Config) newResolver() Resolver {
+	var resolver Resolver = net.DefaultResolver
+	if len(c.DNS.Servers) > 0 {
+		resolver = &DNSClient{Servers: c.DNS.Servers, Timeout: c.DNS.Timeout.Duration}
+	}
+
+	if c.DNS.Timeout.Duration > 0 {
+		resolver = &timeoutResolver{Resolver: resolver, timeout: c.DNS.Timeout.Duration}
+	}
+
+	if c.DNS.CacheSize > 0 {
+		resolver = &CachingResolver{
+			Resolver:    resolver,
+			MaxEntries:  c.DNS.CacheSize,
+			NegativeTTL: c.DNS.NegativeTTL.Duration,
+			MaxTTL:      c.DNS.MaxTTL.Duration,
+		}
+	}
+	return resolver
+}
+
+/*
+ * Returns the resolver shared by all validators of the configuration.
+ */
+func (c *Config) Resolver() Resolver {
+	if c.resolver == nil {
+		c.resolver = c.newResolver()
+	}
+	return c.resolver
+}
+
+/*
+ * Sets the resolver used by the validators created afterwards, e.g.
+ * to keep the cache of a previous configuration.
+ */
+func (c *Config) SetResolver(resolver Resolver) {
+	c.resolver = resolver
+}
+
+func (c *Config) SPFValidator() SPFValidator {
+	return SPFValidator{Resolver: c.Resolver(), Logger: c.logger, Metrics: c.metrics}
+}
+
+func (c *Config) DKIMKeyPolicy() *DKIMKeyPolicy {
+	return &DKIMKeyPolicy{
+		MinRSABits:     c.DKIM.MinRSABits,
+		WeakRSABits:    c.DKIM.WeakRSABits,
+		AllowSHA1:      c.DKIM.AllowSHA1,
+		IgnoreTestMode: c.DKIM.IgnoreTestMode,
+	}
+}
+
+func (c *Config) DKIMValidator() DKIMValidator {
+	return DKIMValidator{Resolver: c.Resolver(), KeyPolicy: c.DKIMKeyPolicy(), MaxSignatures: c.DKIM.MaxSignatures, Logger: c.logger, Metrics: c.metrics}
+}
+
+func (c *Config) DMARCValidator() DMARCValidator {
+	return DMARCValidator{Resolver: c.Resolver(), PublicSuffixList: c.publicSuffixList, TrustedARCSealers: c.ARC.TrustedSealers, Logger: c.logger, Metrics: c.metrics}
+}
+
+/*
+ * Returns the ARC validator, or nil if ARC is not enabled.
+ */
+func (c *Config) ARCValidator() *ARCValidator {
+	if !c.ARC.Enabled {
+		return nil
+	}
+	return &ARCValidator{Resolver: c.Resolver(), KeyPolicy: c.DKIMKeyPolicy(), Logger: c.logger, Metrics: c.metrics}
+}
+
+/*
+ * Returns the ARC sealer, or nil if no signing key is configured.
+ */
+func (c *Config) ARCSealer() *ARCSealer {
+	if c.sealerKey == nil {
+		return nil
+	}
+
+	sealer := c.ARC.Sealer
+	return &ARCSealer{AuthServID: c.AuthServID, Domain: sealer.Domain, Selector: sealer.Selector, Key: c.sealerKey, Headers: sealer.Headers}
+}
+
+/*
+ * Returns the aggregate reporter recording to store, or nil if
+ * aggregate reports are not enabled.
+ */
+func (c *Config) AggregateReporter(store ReportStore) *AggregateReporter {
+	if !c.DMARC.Reports.Enabled {
+		return nil
+	}
+
+	reports := c.DMARC.Reports
+	return &AggregateReporter{
+		Store:            store,
+		Validator:        c.DMARCValidator(),
+		OrgName:          reports.OrgName,
+		Email:            reports.Email,
+		ExtraContactInfo: reports.ExtraContactInfo,
+		CheckInterval:    reports.CheckInterval.Duration,
+	}
+}
+
+/*
+ * Returns the failure reporter, or nil if failure reports are not
+ * enabled.
+ */
+func (c *Config) FailureReporter() *FailureReporter {
+	failure := c.DMARC.FailureReports
+	if !failure.Enabled {
+		return nil
+	}
+
+	reporter := &FailureReporter{Validator: c.DMARCValidator(), ReportingMTA: failure.ReportingMTA, From: failure.From, HeadersOnly: failure.HeadersOnly}
+	if failure.RedactSecret != "" {
+		reporter.RedactLocalPart = NewLocalPartRedactor([]byte(failure.RedactSecret))
+	}
+	return reporter
+}
+
+/*
+ * Returns a milter running the configured validators.
+ */
+func (c *Config) NewMilter() *Milter {
+	return &Milter{
+		AuthServID:      c.AuthServID,
+		SPF:             c.SPFValidator(),
+		DKIM:            c.DKIMValidator(),
+		DMARC:           c.DMARCValidator(),
+		ARC:             c.ARCValidator(),
+		RejectDMARC:     c.Milter.Reject,
+		QuarantineDMARC: c.Milter.Quarantine,
+		Timeout:         c.Milter.Timeout.Duration,
+		MaxLookups:      c.DNS.MaxLookups,
+		TraceComment:    c.Milter.TraceComment,
+	}
+}
+
+/*
+ * timeoutResolver limits the duration of each lookup.
+ */
+type timeoutResolver struct {
+	Resolver
+	timeout time.Duration
+}
+
+func (r *timeoutResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return r.Resolver.LookupTXT(ctx, name)
+}
+
+func (r *timeoutResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return r.Resolver.LookupHost(ctx, host)
+}
+
+func (r *timeoutResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return r.Resolver.LookupMX(ctx, name)
+}
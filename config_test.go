@@ -0,0 +1,309 @@
+package emailauth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig(`
+authserv-id = "mx.example.com"
+
+[dns]
+servers = ["192.0.2.53", "[2001:db8::53]:5353"]
+timeout = "2s"
+max-lookups = 30
+
+[milter]
+listen = "unix:/run/emailauth/milter.sock"
+reject = true
+
+[dkim]
+min-rsa-bits = 2048
+weak-rsa-bits = 2048
+
+[dmarc.reports]
+enabled = true
+org-name = "Example Inc."
+email = "dmarc-reports@example.com"
+check-interval = "10m"
+
+[arc]
+enabled = true
+trusted-sealers = ["lists.example.org"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertStringEquals("mx.example.com", config.AuthServID, t)
+	assertStringEquals("192.0.2.53:53", config.DNS.Servers[0], t)
+	assertStringEquals("[2001:db8::53]:5353", config.DNS.Servers[1], t)
+	if config.DNS.Timeout.Duration != 2*time.Second || config.Milter.Timeout.Duration != 10*time.Minute {
+		t.Errorf("Unexpected timeouts: %v, %v", config.DNS.Timeout, config.Milter.Timeout)
+	}
+
+	network, address, err := config.ListenAddress()
+	if err != nil || network != "unix" || address != "/run/emailauth/milter.sock" {
+		t.Errorf("Unexpected listen address: %s %s (%v)", network, address, err)
+	}
+
+	if cache, ok := config.Resolver().(*CachingResolver); !ok || cache.MaxEntries != defaultCacheEntries {
+		t.Errorf("Unexpected resolver: %+v", config.Resolver())
+	}
+
+	m := config.NewMilter()
+	if !m.RejectDMARC || m.ARC == nil || m.Reporter != nil || m.MaxLookups != 30 {
+		t.Errorf("Unexpected milter: %+v", m)
+	}
+	if r := config.AggregateReporter(NewMemoryReportStore()); r == nil || r.CheckInterval != 10*time.Minute || r.OrgName != "Example Inc." {
+		t.Errorf("Unexpected reporter: %+v", r)
+	}
+	if m.DKIM.KeyPolicy.MinRSABits != 2048 || m.DKIM.MaxSignatures != defaultMaxSignatures {
+		t.Errorf("Unexpected validators: %+v, %+v", m.DKIM, m.SPF)
+	}
+	if len(m.DMARC.TrustedARCSealers) != 1 || m.DMARC.Resolver != m.DKIM.Resolver || m.SPF.Resolver != m.DKIM.Resolver {
+		t.Errorf("Unexpected DMARC validator: %+v", m.DMARC)
+	}
+
+	if config.ARCSealer() != nil || config.FailureReporter() != nil {
+		t.Error("Expected no sealer and no failure reporter")
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for data, expected := range map[string]string{
+		"[dns]\ntimeout = \"5 seconds\"":          "dns.timeout: Invalid duration: 5 seconds",
+		"[dns]\ntimeout = 5":                      "dns.timeout: Expected a string",
+		"[dns]\nservers = [\"dns.example.com\"]":  "dns.servers[0]: Invalid server address: dns.example.com",
+		"[dns]\ncache-size = -1":                  "dns.cache-size: Must not be negative",
+		"[dns]\nmax-lookups = -1":                 "dns.max-lookups: Must not be negative",
+		"[dmarc.report]\nenabled = true":          "dmarc.report: Unknown key",
+		"dkim = 1":                                "dkim: Expected a table",
+		"[dkim]\nweak-rsa-bits = 512":             "dkim.weak-rsa-bits: Must not be below dkim.min-rsa-bits",
+		"[milter]\nlisten = \"inet:8891\"":        "milter.listen: Invalid listen address: inet:8891",
+		"[milter]\ntimeout = \"-1s\"":             "milter.timeout: Negative duration",
+		"[dmarc.reports]\nenabled = true":         "dmarc.reports.org-name: Required for aggregate reports",
+		"[arc]\ntrusted-sealers = [\"a..b\"]":     "arc.trusted-sealers[0]: Invalid domain: a..b",
+		"[arc.sealer]\ndomain = \"example.com\"":  "arc.sealer.selector: Required for sealing",
+		"[log]\nlevel = \"verbose\"":              "log.level: Expected one of debug, info, warn, error",
+		"[metrics]\nlisten = \"9899\"":            "metrics.listen: Invalid listen address: 9899",
+		"authserv-id = \"mx.example.com; other\"": "authserv-id: Invalid authserv-id",
+	} {
+		_, err := ParseConfig(data)
+		if err == nil {
+			t.Errorf("Expected error for %q", data)
+			continue
+		}
+		assertStringEquals(expected, err.Error(), t)
+	}
+
+	// type errors of the decoder are prefixed with the key
+	if _, err := ParseConfig("[dmarc.reports]\norg-name = 1"); err == nil || !strings.HasPrefix(err.Error(), "dmarc.reports.org-name: ") {
+		t.Errorf("Expected type error but got %v", err)
+	}
+
+	// syntax errors carry the line
+	if _, err := ParseConfig("[dns]\ntimeout = 5s"); err == nil {
+		t.Error("Expected syntax error")
+	}
+}
+
+func TestConfigSealerKey(t *testing.T) {
+	rsaKey, _ := newTestKey(t, 1024)
+	rsaFile := writeTestFile(t, "rsa.pem", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edFile := writeTestFile(t, "ed25519.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	for _, file := range []string{rsaFile, edFile} {
+		config, err := ParseConfig("authserv-id = \"relay.example.net\"\n[arc.sealer]\ndomain = \"example.net\"\nselector = \"arc\"\nkey-file = \"" + file + "\"")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sealer := config.ARCSealer()
+		if sealer == nil || sealer.Key == nil || sealer.AuthServID != "relay.example.net" {
+			t.Errorf("Unexpected sealer: %+v", sealer)
+		}
+	}
+
+	certFile := writeTestFile(t, "cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{0}}))
+	_, err = ParseConfig("[arc.sealer]\ndomain = \"example.net\"\nselector = \"arc\"\nkey-file = \"" + certFile + "\"")
+	if err == nil || err.Error() != "arc.sealer.key-file: Unsupported PEM type: CERTIFICATE" {
+		t.Errorf("Expected key file error but got %v", err)
+	}
+}
+
+func TestConfigResolver(t *testing.T) {
+	config := DefaultConfig()
+	cache, ok := config.Resolver().(*CachingResolver)
+	if !ok {
+		t.Fatalf("Unexpected resolver: %+v", config.Resolver())
+	}
+	if r, ok := cache.Resolver.(*timeoutResolver); !ok || r.Resolver != net.DefaultResolver {
+		t.Errorf("Expected the system resolver but got %+v", cache.Resolver)
+	}
+
+	config = DefaultConfig()
+	config.DNS.Servers = []string{"192.0.2.53:53"}
+	config.DNS.CacheSize = 0
+	if r, ok := config.Resolver().(*timeoutResolver); !ok {
+		t.Errorf("Unexpected resolver: %+v", config.Resolver())
+	} else if client, ok := r.Resolver.(*DNSClient); !ok || client.Servers[0] != "192.0.2.53:53" {
+		t.Errorf("Expected a client of the configured servers but got %+v", r.Resolver)
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	for listen, expected := range map[string]string{
+		"inet:127.0.0.1:8891": "tcp 127.0.0.1:8891",
+		"inet6:[::1]:8891":    "tcp [::1]:8891",
+		"local:/run/milter":   "unix /run/milter",
+		"localhost:8891":      "tcp localhost:8891",
+	} {
+		config := DefaultConfig()
+		config.Milter.Listen = listen
+		network, address, err := config.ListenAddress()
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", listen, err)
+			continue
+		}
+		assertStringEquals(expected, network+" "+address, t)
+	}
+}
+
+func TestDaemonReload(t *testing.T) {
+	path := writeTestFile(t, "emailauth.toml", []byte("authserv-id = \"mx1.example.com\""))
+	d, err := NewDaemon(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStringEquals("mx1.example.com", d.current().milter.AuthServID, t)
+	resolver := d.Config().Resolver()
+
+	if err := os.WriteFile(path, []byte("authserv-id = \"mx2.example.com\""), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	assertStringEquals("mx2.example.com", d.Config().AuthServID, t)
+	assertStringEquals("mx2.example.com", d.current().milter.AuthServID, t)
+	if d.Config().Resolver() != resolver {
+		t.Error("Expected the DNS cache to be kept")
+	}
+	if d.current().milter.DMARC.Metrics != d.Metrics || d.Metrics.cache != resolver {
+		t.Error("Expected the metrics of the daemon")
+	}
+
+	// an invalid configuration keeps the current one
+	if err := os.WriteFile(path, []byte("[log]\nlevel = \"verbose\""), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Reload(); err == nil {
+		t.Error("Expected error for invalid configuration")
+	}
+	assertStringEquals("mx2.example.com", d.Config().AuthServID, t)
+
+	// reports are not delivered by the daemon
+	if err := os.WriteFile(path, []byte("[dmarc.reports]\nenabled = true\norg-name = \"Example\"\nemail = \"dmarc@example.com\""), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Reload(); err == nil || err.Error() != "dmarc.reports.enabled: Not supported by the daemon" {
+		t.Errorf("Expected error for aggregate reports but got %v", err)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	file := writeTestFile(t, "milter.sock", []byte("data"))
+	removeStaleSocket(file)
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Expected regular file to be kept: %v", err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "milter.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	removeStaleSocket(socket)
+	if _, err := os.Lstat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected stale socket to be removed: %v", err)
+	}
+}
+
+func TestDaemonReloadLogSinks(t *testing.T) {
+	dir := t.TempDir()
+	oldLog, newLog := filepath.Join(dir, "old.log"), filepath.Join(dir, "new.log")
+	path := writeTestFile(t, "emailauth.toml", []byte("[log]\nfile = \""+oldLog+"\""))
+	d, err := NewDaemon(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go d.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sinks, logger := d.current().sinks, d.Config().Logger()
+	for sinks.connections() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := os.WriteFile(path, []byte("[log]\nfile = \""+newLog+"\""), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the established connection still logs to the old file
+	logger.Info("established")
+	if data, _ := os.ReadFile(oldLog); !strings.Contains(string(data), "established") {
+		t.Errorf("Expected log entry of established connection in:\n%s", data)
+	}
+
+	conn.Close()
+	for sinks.connections() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	logger.Info("closed")
+	if data, _ := os.ReadFile(oldLog); strings.Contains(string(data), "closed") {
+		t.Error("Expected old log file to be closed")
+	}
+}
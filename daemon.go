@@ -0,0 +1,264 @@
+package emailauth
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+/*
+ * Daemon serves the milter with the configuration read from Path.
+ * Reload replaces the configuration: connections accepted afterwards
+ * use the new one, established connections keep the old one. The
+ * listen address is only read when starting, the log sinks and the
+ * DNS cache are only replaced if their configuration changed. Replaced
+ * log sinks are closed once the connections using them are done. The
+ * validators report to Metrics, kept across reloads.
+ *
+ * The daemon neither delivers DMARC reports nor seals messages, so
+ * configurations enabling the reporters or the ARC sealer are rejected.
+ */
+type Daemon struct {
+	Path    string
+	Metrics *PrometheusMetrics
+
+	mu    sync.Mutex   // orders replacing the state and serving with it
+	state atomic.Value // *daemonState
+}
+
+type daemonState struct {
+	config *Config
+	milter *Milter
+	sinks  *logSinks
+}
+
+/*
+ * logSinks are shared by the configurations with the same log settings.
+ * Once replaced, they are closed after the last connection using them.
+ */
+type logSinks struct {
+	closer   io.Closer
+	mu       sync.Mutex
+	conns    int
+	replaced bool
+}
+
+func (s *logSinks) acquire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns++
+}
+
+func (s *logSinks) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns--
+	if s.conns == 0 && s.replaced {
+		s.closer.Close()
+	}
+}
+
+func (s *logSinks) replace() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replaced = true
+	if s.conns == 0 {
+		s.closer.Close()
+	}
+}
+
+func (s *logSinks) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+/*
+ * Creates a daemon with metrics and loads its configuration.
+ */
+func NewDaemon(path string) (*Daemon, error) {
+	d := &Daemon{Path: path, Metrics: NewPrometheusMetrics()}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Daemon) Config() *Config {
+	return d.current().config
+}
+
+/*
+ * Loads the configuration file again. If it is invalid, the current
+ * configuration is kept and the error returned.
+ */
+func (d *Daemon) Reload() error {
+	config, err := LoadConfig(d.Path)
+	if err != nil {
+		return err
+	}
+	if err := checkDaemonConfig(config); err != nil {
+		return err
+	}
+
+	previous, _ := d.state.Load().(*daemonState)
+	state := &daemonState{config: config}
+	reuse := previous != nil && previous.config.Log == config.Log
+	if reuse {
+		config.SetLogger(previous.config.Logger())
+		state.sinks = previous.sinks
+	} else {
+		_, closer, err := config.OpenLogger()
+		if err != nil {
+			return &ConfigError{Key: "log", Message: err.Error()}
+		}
+		state.sinks = &logSinks{closer: closer}
+	}
+
+	if previous != nil && reflect.DeepEqual(previous.config.DNS, config.DNS) {
+		config.SetResolver(previous.config.Resolver())
+	}
+
+	if d.Metrics != nil {
+		config.SetMetrics(d.Metrics)
+		cache, _ := config.Resolver().(*CachingResolver)
+		d.Metrics.SetCache(cache)
+	}
+
+	state.milter = config.NewMilter()
+	d.mu.Lock()
+	d.state.Store(state)
+	d.mu.Unlock()
+
+	if previous != nil {
+		// established connections keep logging to the previous sinks
+		if !reuse {
+			previous.sinks.replace()
+		}
+		config.Logger().Info("configuration reloaded", slog.String("path", d.Path))
+	}
+	return nil
+}
+
+func checkDaemonConfig(config *Config) error {
+	switch {
+	case config.DMARC.Reports.Enabled:
+		return &ConfigError{Key: "dmarc.reports.enabled", Message: "Not supported by the daemon"}
+	case config.DMARC.FailureReports.Enabled:
+		return &ConfigError{Key: "dmarc.failure-reports.enabled", Message: "Not supported by the daemon"}
+	case config.ARCSealer() != nil:
+		return &ConfigError{Key: "arc.sealer", Message: "Not supported by the daemon"}
+	}
+	return nil
+}
+
+/*
+ * Closes the log sinks.
+ */
+func (d *Daemon) Close() error {
+	return d.current().sinks.closer.Close()
+}
+
+/*
+ * Reloads the configuration on SIGHUP until ctx is done. Errors of
+ * failed reloads are passed to onError.
+ */
+func (d *Daemon) ReloadOnSignal(ctx context.Context, onError func(error)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			if err := d.Reload(); err != nil {
+				d.Config().Logger().Error("configuration reload failed", slog.String("path", d.Path), slog.String("error", err.Error()))
+				if onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}
+}
+
+/*
+ * Listens on the configured address and serves connections until the
+ * listener fails. A stale unix socket is removed first. The metrics
+ * are served if an address is configured for them.
+ */
+func (d *Daemon) ListenAndServe() error {
+	network, address, err := d.Config().ListenAddress()
+	if err != nil {
+		return err
+	}
+
+	if listen := d.Config().Metrics.Listen; listen != "" && d.Metrics != nil {
+		ml, err := net.Listen("tcp", listen)
+		if err != nil {
+			return err
+		}
+		defer ml.Close()
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", d.Metrics)
+		go http.Serve(ml, mux)
+	}
+
+	if network == "unix" {
+		removeStaleSocket(address)
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return d.Serve(l)
+}
+
+/*
+ * Removes the socket left at path by a previous run. Other files are
+ * kept, so that listening on them fails.
+ */
+func removeStaleSocket(path string) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+/*
+ * Accepts connections from the MTA and serves each of them with the
+ * milter of the current configuration.
+ */
+func (d *Daemon) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		d.mu.Lock()
+		state := d.current()
+		state.sinks.acquire()
+		d.mu.Unlock()
+
+		go func() {
+			defer state.sinks.release()
+			state.milter.ServeConn(conn)
+		}()
+	}
+}
+
+func (d *Daemon) current() *daemonState {
+	return d.state.Load().(*daemonState)
+}
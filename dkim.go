@@ -1,5 +1,26 @@
 package emailauth
 
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
 /*
  * Authentication-Results:
  *  open-xchange.com;
@@ -30,10 +51,613 @@ type DKIMResult struct {
 }
 
 type DKIMValidator struct {
+	Resolver      Resolver
+	KeyPolicy     *DKIMKeyPolicy
+	MaxSignatures int
+	Logger        *slog.Logger
+	Metrics       Metrics
+}
+
+type dkimSignature struct {
+	Tags        map[string]string
+	Algorithm   string
+	KeyType     string
+	Hash        crypto.Hash
+	HashName    string
+	Signature   []byte
+	BodyHash    []byte
+	HeaderCanon string
+	BodyCanon   string
+	Domain      string
+	Selector    string
+	Identity    string
+	Headers     []string
+	Length      int64
+}
+
+const (
+	signatureHeader      = "DKIM-Signature"
+	defaultMaxSignatures = 10
+)
+
+var signatureValueExp = regexp.MustCompile("(^|;)([ \t\r\n]*b[ \t\r\n]*=)[^;]*")
+
+/*
+ * Verifies the DKIM signatures of a message and returns one result
+ * per signature, in the order the signatures appear. At most
+ * MaxSignatures signatures are evaluated. Key lookups and signature
+ * checks run concurrently while the body is read once.
+ */
+func (v DKIMValidator) Validate(mail *Message) []*DKIMResult {
+	return v.ValidateContext(context.Background(), mail)
+}
+
+/*
+ * Like Validate, looking up the keys with ctx. The results and queries
+ * are logged with the trace ID of ctx.
+ */
+func (v DKIMValidator) ValidateContext(ctx context.Context, mail *Message) []*DKIMResult {
+	resolver := traceResolver(ctx, v.Resolver, v.Logger, v.Metrics)
+	v.Resolver = resolver
+	results := v.validate(mail)
+	verdicts := make([]Result, len(results))
+	for i, r := range results {
+		attrs := append(dkimLogAttrs(r.Tags), slog.String("result", r.Result.String()), slog.String("reason", r.Reason))
+		logVerdict(ctx, v.Logger, "dkim", r.Result, attrs...)
+		verdicts[i] = r.Result
+	}
+	observeEvaluation(v.Metrics, "dkim", resolver, verdicts...)
+	return results
+}
+
+func (v DKIMValidator) validate(mail *Message) []*DKIMResult {
+	header := mail.Fields()
+	signatures := header.Fields(signatureHeader)
+
+	if len(signatures) == 0 {
+		return []*DKIMResult{newDKIMResult(None, "No signature")}
+	}
+
+	if len(signatures) > v.maxSignatures() {
+		signatures = signatures[:v.maxSignatures()]
+	}
+
+	verifications := make([]*dkimVerification, len(signatures))
+	writers := make([]io.Writer, 0, len(signatures))
+	for i, field := range signatures {
+		vf := &dkimVerification{signature: field}
+		verifications[i] = vf
+
+		sig, err := parseDKIMSignature(field.Value())
+		if err != nil {
+			vf.result = newDKIMResult(Permerror, err.Error())
+			continue
+		}
+
+		vf.sig = sig
+		vf.bodyHash = sig.Hash.New()
+		vf.body = newBodyCanonicalizer(vf.bodyHash, sig.BodyCanon == "relaxed", sig.Length)
+		writers = append(writers, vf.body)
+	}
+
+	bodyDone := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, vf := range verifications {
+		if vf.sig == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(vf *dkimVerification) {
+			defer wg.Done()
+			vf.result = v.verify(header, vf, bodyDone)
+		}(vf)
+	}
+
+	var bodyErr error
+	if mail.Body != nil && len(writers) > 0 {
+		_, bodyErr = io.Copy(io.MultiWriter(writers...), mail.Body)
+	}
+
+	for _, vf := range verifications {
+		if vf.sig != nil {
+			vf.bodyErr = bodyErr
+			if vf.bodyErr == nil {
+				vf.bodyErr = vf.body.Close()
+			}
+		}
+	}
+
+	close(bodyDone)
+	wg.Wait()
+
+	results := make([]*DKIMResult, len(verifications))
+	for i, vf := range verifications {
+		results[i] = vf.result
+	}
+	return results
+}
+
+/*
+ * Returns the most favorable result of the signatures made by the
+ * given domain, or nil if the domain did not sign the message.
+ */
+func BestDKIMResult(results []*DKIMResult, domain string) *DKIMResult {
+	domain = strings.TrimSuffix(domain, ".")
+	var best *DKIMResult
+	for _, r := range results {
+		if !strings.EqualFold(r.Tags["d"], domain) {
+			continue
+		}
+
+		if best == nil || dkimResultRank(r.Result) < dkimResultRank(best.Result) {
+			best = r
+		}
+	}
+	return best
+}
+
+var dkimResultRanks = []Result{Pass, Fail, Policy, Neutral, Temperror, Permerror, None}
+
+func dkimResultRank(result Result) int {
+	for i, r := range dkimResultRanks {
+		if r == result {
+			return i
+		}
+	}
+	return len(dkimResultRanks)
+}
+
+type dkimVerification struct {
+	signature HeaderField
+	sig       *dkimSignature
+	bodyHash  hash.Hash
+	body      *bodyCanonicalizer
+	bodyErr   error
+	result    *DKIMResult
+}
+
+/*
+ * Verifies a single signature. The body hash is only looked at after
+ * bodyDone has been closed, everything before that runs while the
+ * body is still being read.
+ */
+func (v DKIMValidator) verify(header Header, vf *dkimVerification, bodyDone <-chan struct{}) *DKIMResult {
+	sig := vf.sig
+	key, errResult := findDKIMKey(v.Resolver, sig.Selector, sig.Domain)
+	if errResult != nil {
+		return sig.result(errResult.Result, errResult.Reason)
+	}
+
+	if errResult := checkDKIMKey(key, sig); errResult != nil {
+		return errResult
+	}
+
+	policy := v.keyPolicy()
+	if errResult := policy.check(key, sig); errResult != nil {
+		return errResult
+	}
+
+	failure := Fail
+	if key.IsTesting() && !policy.IgnoreTestMode {
+		// RFC 6376, section 3.6.1: test mode signatures must not be
+		// treated differently from unsigned mail
+		failure = Neutral
+	}
+
+	<-bodyDone
+	if vf.bodyErr != nil {
+		return sig.result(failure, vf.bodyErr.Error())
+	}
+
+	if !bytes.Equal(vf.bodyHash.Sum(nil), sig.BodyHash) {
+		return sig.result(failure, "Body hash did not verify")
+	}
+
+	headerHash := dkimHeaderHash(header, sig, vf.signature)
+	if err := verifySignature(key, sig.Hash, headerHash, sig.Signature); err != nil {
+		return sig.result(failure, "Signature did not verify")
+	}
+
+	reasons := []string{fmt.Sprintf("%d-bit key", key.Bits())}
+	if policy.isWeak(key) {
+		reasons = append(reasons, "weak key")
+	}
+	if key.IsTesting() {
+		reasons = append(reasons, "test mode")
+	}
+	reasons = append(reasons, "unprotected key")
+	return sig.result(Pass, strings.Join(reasons, "; "))
+}
+
+func (v DKIMValidator) maxSignatures() int {
+	if v.MaxSignatures <= 0 {
+		return defaultMaxSignatures
+	}
+	return v.MaxSignatures
+}
+
+func (v DKIMValidator) keyPolicy() *DKIMKeyPolicy {
+	if v.KeyPolicy == nil {
+		return &DefaultDKIMKeyPolicy
+	}
+	return v.KeyPolicy
+}
+
+/*
+ * Checks the restrictions a key record imposes on the signatures it
+ * may verify (RFC 6376, section 6.1.2).
+ */
+func checkDKIMKey(key *DKIMKey, sig *dkimSignature) *DKIMResult {
+	if key.IsRevoked() {
+		return sig.result(Permerror, "Key revoked")
+	}
+
+	if key.KeyType != sig.KeyType {
+		return sig.result(Permerror, "Inappropriate key type")
+	}
+
+	if !key.AllowsHash(sig.HashName) {
+		return sig.result(Permerror, "Inappropriate hash algorithm")
+	}
+
+	if !key.AllowsService("email") {
+		return sig.result(Permerror, "Inappropriate service type")
+	}
+
+	if key.IsStrict() && !strings.EqualFold(domainOfIdentity(sig.Identity), sig.Domain) {
+		return sig.result(Permerror, "Identity domain does not match signing domain")
+	}
+
+	return nil
+}
+
+func (sig *dkimSignature) result(result Result, reason string) *DKIMResult {
+	r := newDKIMResult(result, reason)
+	for k, v := range sig.Tags {
+		r.Tags[k] = v
+	}
+	return r
+}
+
+/*
+ * Parses and validates a DKIM-Signature header field value
+ * (RFC 6376, sections 3.5 and 6.1.1).
+ */
+func parseDKIMSignature(value string) (*dkimSignature, error) {
+	tags, err := parseTagList(value)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[name]; !ok {
+			return nil, fmt.Errorf("Missing required tag: %s", name)
+		}
+	}
+
+	if tags["v"] != "1" {
+		return nil, errors.New("Incompatible version")
+	}
+
+	sig, err := newDKIMSignature(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	sig.Identity = "@" + sig.Domain
+	if i, ok := tags["i"]; ok {
+		sig.Identity = i
+		id := strings.TrimSuffix(strings.ToLower(domainOfIdentity(i)), ".")
+		if id != sig.Domain && !strings.HasSuffix(id, "."+sig.Domain) {
+			return nil, errors.New("Identity domain does not match signing domain")
+		}
+	}
+
+	if !containsFold(sig.Headers, "from") {
+		return nil, errors.New("From field not signed")
+	}
+
+	return sig, nil
+}
+
+/*
+ * Parses the tags shared by DKIM signatures and ARC signatures and
+ * seals. Presence of the required tags must have been checked.
+ */
+func newDKIMSignature(tags map[string]string) (*dkimSignature, error) {
+	var err error
+	sig := &dkimSignature{Tags: tags, Length: -1}
+	if err := sig.parseAlgorithm(tags["a"]); err != nil {
+		return nil, err
+	}
+
+	sig.Signature, err = base64.StdEncoding.DecodeString(removeWhitespace(tags["b"]))
+	if err != nil || len(sig.Signature) == 0 {
+		return nil, errors.New("Invalid signature data")
+	}
+
+	if bh, ok := tags["bh"]; ok {
+		sig.BodyHash, err = base64.StdEncoding.DecodeString(removeWhitespace(bh))
+		if err != nil || len(sig.BodyHash) == 0 {
+			return nil, errors.New("Invalid body hash")
+		}
+	}
+
+	sig.HeaderCanon, sig.BodyCanon = "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(c, "/", 2)
+		sig.HeaderCanon = parts[0]
+		if len(parts) == 2 {
+			sig.BodyCanon = parts[1]
+		}
+		if !isValidCanonicalization(sig.HeaderCanon) || !isValidCanonicalization(sig.BodyCanon) {
+			return nil, errors.New("Invalid canonicalization")
+		}
+	}
+
+	sig.Domain = strings.TrimSuffix(strings.ToLower(tags["d"]), ".")
+	if isInvalidDomain(sig.Domain) {
+		return nil, errors.New("Invalid signing domain")
+	}
+
+	sig.Selector = tags["s"]
+	if sig.Selector == "" {
+		return nil, errors.New("Invalid selector")
+	}
+
+	for _, h := range strings.Split(tags["h"], ":") {
+		h = strings.TrimSpace(h)
+		if h != "" {
+			sig.Headers = append(sig.Headers, h)
+		}
+	}
+
+	if l, ok := tags["l"]; ok {
+		sig.Length, err = strconv.ParseInt(l, 10, 64)
+		if err != nil || sig.Length < 0 {
+			return nil, errors.New("Invalid body length")
+		}
+	}
+
+	if q, ok := tags["q"]; ok && !containsFold(splitColonList(q), "dns/txt") {
+		return nil, errors.New("Unsupported query method")
+	}
+
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid expiration")
+		}
+
+		if t, ok := tags["t"]; ok {
+			signed, err := strconv.ParseInt(t, 10, 64)
+			if err != nil || signed > expires {
+				return nil, errors.New("Invalid expiration")
+			}
+		}
+
+		if expires < time.Now().Unix() {
+			return nil, errors.New("Signature expired")
+		}
+	}
+
+	return sig, nil
+}
+
+func (sig *dkimSignature) parseAlgorithm(a string) error {
+	sig.Algorithm = strings.ToLower(a)
+	switch sig.Algorithm {
+	case "rsa-sha1":
+		sig.KeyType, sig.HashName, sig.Hash = "rsa", "sha1", crypto.SHA1
+	case "rsa-sha256":
+		sig.KeyType, sig.HashName, sig.Hash = "rsa", "sha256", crypto.SHA256
+	case "ed25519-sha256":
+		sig.KeyType, sig.HashName, sig.Hash = "ed25519", "sha256", crypto.SHA256
+	default:
+		return fmt.Errorf("Unsupported algorithm: %s", a)
+	}
+	return nil
+}
+
+func isValidCanonicalization(c string) bool {
+	return c == "simple" || c == "relaxed"
+}
+
+func domainOfIdentity(identity string) string {
+	if idx := strings.LastIndexByte(identity, '@'); idx >= 0 {
+		return identity[idx+1:]
+	}
+	return identity
+}
+
+func verifySignature(key *DKIMKey, hash crypto.Hash, digest []byte, signature []byte) error {
+	switch pub := key.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, digest, signature) {
+			return errors.New("Invalid signature")
+		}
+		return nil
+	}
+	return errors.New("Unsupported key type")
+}
+
+/*
+ * Computes the hash over the signed header fields followed by the
+ * signature header field itself with an empty "b=" tag
+ * (RFC 6376, section 3.7). Header fields are selected bottom-up;
+ * names listed more often than present contribute nothing.
+ */
+func dkimHeaderHash(header Header, sig *dkimSignature, signature HeaderField) []byte {
+	return signedHeaderHash(header, sig, signature)
+}
+
+func signedHeaderHash(header Header, sig *dkimSignature, signature HeaderField) []byte {
+	relaxed := sig.HeaderCanon == "relaxed"
+	h := sig.Hash.New()
+	used := make(map[string]int)
+	for _, name := range sig.Headers {
+		key := strings.ToLower(name)
+		fields := header.Fields(key)
+		idx := len(fields) - 1 - used[key]
+		if idx < 0 {
+			continue
+		}
+		used[key]++
+		io.WriteString(h, canonicalizeField(fields[idx], relaxed))
+		io.WriteString(h, "\r\n")
+	}
+
+	io.WriteString(h, canonicalizeField(unsignedField(signature), relaxed))
+	return h.Sum(nil)
+}
+
+/*
+ * Returns the signature header field with an empty "b=" tag.
+ */
+func unsignedField(signature HeaderField) HeaderField {
+	value := signature.Value()
+	unsigned := signatureValueExp.ReplaceAllString(value, "$1$2")
+	return HeaderField{Name: signature.Name, Raw: signature.Raw[:len(signature.Raw)-len(value)] + unsigned}
+}
+
+/*
+ * Returns the canonical form of a header field as it appears in the
+ * message; the simple canonicalization leaves it unchanged.
+ */
+func canonicalizeField(field HeaderField, relaxed bool) string {
+	if !relaxed {
+		return field.Raw
+	}
+	return canonicalizeHeader(field.Name, field.Value(), true)
+}
+
+/*
+ * Returns the canonical form of a header field without the trailing
+ * CRLF (RFC 6376, section 3.4).
+ */
+func canonicalizeHeader(name string, value string, relaxed bool) string {
+	if !relaxed {
+		return name + ": " + value
+	}
+
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = strings.Replace(value, "\n", "", -1)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + string(compressWhitespace([]byte(value), true))
 }
 
-func (v DKIMValidator) Validate(mail *Message) *DKIMResult {
-	return newDKIMResult(None, "Not implemented")
+func dkimBodyHash(body io.Reader, sig *dkimSignature) ([]byte, error) {
+	h := sig.Hash.New()
+	c := newBodyCanonicalizer(h, sig.BodyCanon == "relaxed", sig.Length)
+	if body != nil {
+		if _, err := io.Copy(c, body); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.Close(); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+/*
+ * bodyCanonicalizer streams a message body through the simple or
+ * relaxed body canonicalization (RFC 6376, section 3.4.3 and 3.4.4).
+ * Only the current line and the number of pending empty lines are
+ * kept in memory. Bare LF line endings are treated as CRLF.
+ */
+type bodyCanonicalizer struct {
+	w       io.Writer
+	relaxed bool
+	limit   int64
+	length  int64
+	line    []byte
+	blanks  int
+}
+
+var crlf = []byte("\r\n")
+
+func newBodyCanonicalizer(w io.Writer, relaxed bool, limit int64) *bodyCanonicalizer {
+	return &bodyCanonicalizer{w: w, relaxed: relaxed, limit: limit}
+}
+
+func (c *bodyCanonicalizer) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' {
+			c.flushLine()
+		} else {
+			c.line = append(c.line, b)
+		}
+	}
+	return len(p), nil
+}
+
+func (c *bodyCanonicalizer) Close() error {
+	if len(c.line) > 0 {
+		c.flushLine()
+	}
+
+	if c.length == 0 && !c.relaxed {
+		c.emit(crlf)
+	}
+
+	if c.limit > c.length {
+		return errors.New("Body length tag exceeds body")
+	}
+	return nil
+}
+
+func (c *bodyCanonicalizer) flushLine() {
+	line := bytes.TrimSuffix(c.line, []byte{'\r'})
+	if c.relaxed {
+		line = compressWhitespace(line, false)
+	}
+
+	if len(line) == 0 {
+		c.blanks++
+	} else {
+		for ; c.blanks > 0; c.blanks-- {
+			c.emit(crlf)
+		}
+		c.emit(line)
+		c.emit(crlf)
+	}
+	c.line = c.line[:0]
+}
+
+func (c *bodyCanonicalizer) emit(p []byte) {
+	if c.limit >= 0 && c.length+int64(len(p)) > c.limit {
+		if c.length < c.limit {
+			c.w.Write(p[:c.limit-c.length])
+		}
+	} else {
+		c.w.Write(p)
+	}
+	c.length += int64(len(p))
+}
+
+/*
+ * Reduces all sequences of whitespace to a single space and removes
+ * trailing whitespace, and leading whitespace if trimLeft is set.
+ */
+func compressWhitespace(line []byte, trimLeft bool) []byte {
+	result := make([]byte, 0, len(line))
+	inWSP := false
+	for _, b := range line {
+		if b == ' ' || b == '\t' {
+			inWSP = true
+			continue
+		}
+		if inWSP && (len(result) > 0 || !trimLeft) {
+			result = append(result, ' ')
+		}
+		inWSP = false
+		result = append(result, b)
+	}
+	return result
 }
 
 func newDKIMResult(result Result, reason string) *DKIMResult {
@@ -0,0 +1,397 @@
+package emailauth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r[strings.ToLower(name)]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+/*
+ * Names exist if they or any of their subdomains have TXT records.
+ */
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	host = strings.ToLower(host)
+	for name := range r {
+		if name == host || strings.HasSuffix(name, "."+host) {
+			return []string{"192.0.2.1"}, nil
+		}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if _, err := r.LookupHost(ctx, name); err != nil {
+		return nil, err
+	}
+	return []*net.MX{{Host: "mx." + name, Pref: 10}}, nil
+}
+
+const testMessageBody = "Hi.\r\n\r\nWe lost the game. Are you hungry yet?\r\n\r\nJoe.\r\n"
+
+func newTestMessage() *Message {
+	headers := textproto.MIMEHeader{}
+	headers.Add("From", "Joe SixPack <joe@football.example.com>")
+	headers.Add("To", "Suzie Q <suzie@shopping.example.net>")
+	headers.Add("Subject", "Is dinner ready?")
+	headers.Add("Date", "Fri, 11 Jul 2003 21:00:37 -0700 (PDT)")
+	headers.Add("Message-ID", "<20030712040037.46341.5F8J@football.example.com>")
+	return &Message{Headers: &headers, Body: strings.NewReader(testMessageBody)}
+}
+
+func newTestKey(t *testing.T, bits int) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, base64.StdEncoding.EncodeToString(der)
+}
+
+/*
+ * Adds a DKIM-Signature header to the message, using the same
+ * canonicalization code as the verifier.
+ */
+func signTestMessage(t *testing.T, message *Message, key *rsa.PrivateKey, tags string) {
+	bodySig := &dkimSignature{Hash: crypto.SHA256, BodyCanon: "relaxed", Length: -1}
+	if strings.Contains(tags, "c=simple/simple") {
+		bodySig.BodyCanon = "simple"
+	}
+	bh, err := dkimBodyHash(strings.NewReader(testMessageBody), bodySig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned := tags + "; bh=" + base64.StdEncoding.EncodeToString(bh) + "; b="
+	sig, err := parseDKIMSignature(unsigned + "AA==")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// named as listed by Fields for messages without raw header fields
+	name := signatureHeader
+	if message.RawHeaders == nil {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+	}
+
+	digest := dkimHeaderHash(message.Fields(), sig, NewHeaderField(name, unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message.PrependHeader(signatureHeader, unsigned+base64.StdEncoding.EncodeToString(signature))
+}
+
+func TestDKIMValidate(t *testing.T) {
+	key, pub := newTestKey(t, 1024)
+	resolver := fakeResolver{"brisbane._domainkey.example.com": {"v=DKIM1; k=rsa; p=" + pub}}
+
+	for _, c := range []string{"relaxed/relaxed", "simple/simple"} {
+		message := newTestMessage()
+		signTestMessage(t, message, key, "v=1; a=rsa-sha256; c="+c+"; d=example.com; s=brisbane; h=From:To:Subject:Date:Message-ID")
+
+		result := DKIMValidator{Resolver: resolver}.Validate(message)[0]
+		if result.Result != Pass {
+			t.Errorf("Expected 'pass' for %s but got '%s' (%s)", c, result.Result, result.Reason)
+		}
+		assertStringEquals("1024-bit key; weak key; unprotected key", result.Reason, t)
+		assertStringEquals("example.com", result.Tags["d"], t)
+	}
+}
+
+func TestDKIMValidateModified(t *testing.T) {
+	key, pub := newTestKey(t, 1024)
+	resolver := fakeResolver{"brisbane._domainkey.example.com": {"v=DKIM1; p=" + pub}}
+
+	message := newTestMessage()
+	signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=brisbane; h=From:Subject")
+	message.Headers.Set("Subject", "Is dinner ready now?")
+	result := DKIMValidator{Resolver: resolver}.Validate(message)[0]
+	if result.Result != Fail {
+		t.Errorf("Expected 'fail' but got '%s' (%s)", result.Result, result.Reason)
+	}
+
+	message = newTestMessage()
+	signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=brisbane; h=From:Subject")
+	message.Body = strings.NewReader(testMessageBody + "P.S.\r\n")
+	result = DKIMValidator{Resolver: resolver}.Validate(message)[0]
+	if result.Result != Fail {
+		t.Errorf("Expected 'fail' but got '%s' (%s)", result.Result, result.Reason)
+	}
+}
+
+func TestDKIMKeyPolicy(t *testing.T) {
+	key, pub := newTestKey(t, 1024)
+	resolver := fakeResolver{
+		"brisbane._domainkey.example.com": {"v=DKIM1; p=" + pub},
+		"testing._domainkey.example.com":  {"v=DKIM1; t=y; p=" + pub},
+	}
+
+	message := newTestMessage()
+	signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=brisbane; h=From")
+	policy := &DKIMKeyPolicy{MinRSABits: 2048, WeakRSABits: 2048}
+	result := DKIMValidator{Resolver: resolver, KeyPolicy: policy}.Validate(message)[0]
+	if result.Result != Policy {
+		t.Errorf("Expected 'policy' but got '%s' (%s)", result.Result, result.Reason)
+	}
+	assertStringEquals("1024-bit key; key too small", result.Reason, t)
+
+	message = newTestMessage()
+	signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=brisbane; h=From")
+	policy = &DKIMKeyPolicy{MinRSABits: 1024, WeakRSABits: 512}
+	result = DKIMValidator{Resolver: resolver, KeyPolicy: policy}.Validate(message)[0]
+	if result.Result != Pass {
+		t.Errorf("Expected 'pass' but got '%s' (%s)", result.Result, result.Reason)
+	}
+	assertStringEquals("1024-bit key; unprotected key", result.Reason, t)
+
+	message = newTestMessage()
+	message.Headers.Add(signatureHeader, "v=1; a=rsa-sha1; d=example.com; s=brisbane; h=From; bh=AA==; b=AA==")
+	result = DKIMValidator{Resolver: resolver}.Validate(message)[0]
+	if result.Result != Policy {
+		t.Errorf("Expected 'policy' but got '%s' (%s)", result.Result, result.Reason)
+	}
+
+	message = newTestMessage()
+	signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=testing; h=From")
+	message.Body = strings.NewReader("Modified")
+	result = DKIMValidator{Resolver: resolver}.Validate(message)[0]
+	if result.Result != Neutral {
+		t.Errorf("Expected 'neutral' but got '%s' (%s)", result.Result, result.Reason)
+	}
+
+	message = newTestMessage()
+	signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=testing; h=From")
+	message.Body = strings.NewReader("Modified")
+	result = DKIMValidator{Resolver: resolver, KeyPolicy: &DKIMKeyPolicy{IgnoreTestMode: true}}.Validate(message)[0]
+	if result.Result != Fail {
+		t.Errorf("Expected 'fail' but got '%s' (%s)", result.Result, result.Reason)
+	}
+}
+
+func TestDKIMKeyRestrictions(t *testing.T) {
+	key, pub := newTestKey(t, 1024)
+	records := map[string]string{
+		"revoked":  "v=DKIM1; p=",
+		"hash":     "v=DKIM1; h=sha1; p=" + pub,
+		"service":  "v=DKIM1; s=other; p=" + pub,
+		"strict":   "v=DKIM1; t=s; p=" + pub,
+		"keytype":  "v=DKIM1; k=ed25519; p=" + pub,
+		"notfound": "",
+	}
+
+	for selector, record := range records {
+		resolver := fakeResolver{}
+		if record != "" {
+			resolver[selector+"._domainkey.example.com"] = []string{record}
+		}
+
+		message := newTestMessage()
+		signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; i=@sub.example.com; s="+selector+"; h=From")
+		result := DKIMValidator{Resolver: resolver}.Validate(message)[0]
+		if result.Result != Permerror {
+			t.Errorf("Expected 'permerror' for '%s' but got '%s' (%s)", selector, result.Result, result.Reason)
+		}
+	}
+}
+
+func TestDKIMValidateUnsigned(t *testing.T) {
+	result := DKIMValidator{Resolver: fakeResolver{}}.Validate(newTestMessage())[0]
+	if result.Result != None {
+		t.Errorf("Expected 'none' but got '%s'", result.Result)
+	}
+}
+
+func TestParseDKIMKey(t *testing.T) {
+	_, pub := newTestKey(t, 1024)
+	// split like a multi-string TXT record in a zone file
+	record := "v=DKIM1; k=rsa; h=sha1:sha256; s=email; t=y:s; n=notes; p=" + pub[:40] + " " + pub[40:]
+	key, err := ParseDKIMKey(record)
+	if err != nil {
+		t.Fatalf("Parsing error: %s", err.Error())
+	}
+
+	if key.Bits() != 1024 {
+		t.Errorf("Expected 1024-bit key but got %d", key.Bits())
+	}
+	assertBoolEquals(true, key.IsTesting(), t)
+	assertBoolEquals(true, key.IsStrict(), t)
+	assertBoolEquals(true, key.AllowsHash("sha256"), t)
+	assertBoolEquals(true, key.AllowsService("email"), t)
+	assertBoolEquals(false, key.IsRevoked(), t)
+	assertStringEquals("notes", key.Notes, t)
+
+	key, err = ParseDKIMKey("v=DKIM1; p=")
+	if err != nil || !key.IsRevoked() {
+		t.Error("Empty key was not recognized as revoked")
+	}
+
+	invalid := []string{"p=" + pub + "; v=DKIM1", "vx=1; v=DKIM1; p=" + pub, "v=DKIM2; p=" + pub, "v=DKIM1", "v=DKIM1; k=dsa; p=" + pub, "v=DKIM1; p=$$$"}
+	for _, record := range invalid {
+		if _, err := ParseDKIMKey(record); err == nil {
+			t.Errorf("Invalid record was parsed: '%s'", record)
+		}
+	}
+}
+
+func TestBodyCanonicalization(t *testing.T) {
+	// RFC 6376, section 3.4.5
+	body := " C \r\nD \t E\r\n\r\n\r\n"
+	expected := map[bool]string{true: " C\r\nD E\r\n", false: " C \r\nD \t E\r\n"}
+	for relaxed, canonical := range expected {
+		var buf bytes.Buffer
+		c := newBodyCanonicalizer(&buf, relaxed, -1)
+		c.Write([]byte(body))
+		c.Close()
+		assertStringEquals(canonical, buf.String(), t)
+	}
+
+	// the hashes of an empty body (RFC 6376, sections 3.4.3 and 3.4.4)
+	emptyBodyHashes := map[string]string{
+		"simple":  "frcCV1k9oG9oKj3dpUqdJg1PxRT2RSN/XKdLCPjaYaY=",
+		"relaxed": "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+	}
+	for canon, expected := range emptyBodyHashes {
+		for _, body := range []string{"", "\r\n\r\n"} {
+			h, err := dkimBodyHash(strings.NewReader(body), &dkimSignature{Hash: crypto.SHA256, BodyCanon: canon, Length: -1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertStringEquals(expected, base64.StdEncoding.EncodeToString(h), t)
+		}
+	}
+}
+
+func TestHeaderCanonicalization(t *testing.T) {
+	assertStringEquals("a:X", canonicalizeHeader("A", " X", true), t)
+	assertStringEquals("b:Y Z", canonicalizeHeader("B ", "Y\t\r\n\tZ  ", true), t)
+	assertStringEquals("Subject: Hello  World", canonicalizeHeader("Subject", "Hello  World", false), t)
+
+	// RFC 6376, section 3.4.5
+	message := readTestMessage(t, "A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n")
+	expected := map[bool]string{true: "a:X\r\nb:Y Z\r\n", false: "A: X\r\nB : Y\t\r\n\tZ  \r\n"}
+	for relaxed, canonical := range expected {
+		var buf strings.Builder
+		for _, field := range message.RawHeaders {
+			buf.WriteString(canonicalizeField(field, relaxed) + "\r\n")
+		}
+		assertStringEquals(canonical, buf.String(), t)
+	}
+}
+
+/*
+ * The signed message of RFC 8463, appendix A.
+ */
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=test; t=1528637909; h=from : to : subject :\r\n" +
+	" date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=F45dVWDfMbQDGHJFlXUNB2HKfbCeLRyhDXgFpEL8GwpsRe0IeIixNTe3\r\n" +
+	" DhCVlUrSjV4BwcVcOF6+FF3Zo9Rpo1tFOeS9mPYQTnGdaSGsgeefOsk2Jz\r\n" +
+	" dA+L10TeYt9BgDfQNZtKdN1WO//KgIqXP7OdEFE4LjFYNcUxZQ4FADY+8=\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+func TestDKIMValidateRFC8463(t *testing.T) {
+	resolver := fakeResolver{
+		"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+		"test._domainkey.football.example.com":     {"v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDkHlOQoBTzWRiGs5V6NpP3idY6Wk08a5qhdR6wy5bdOKb2jLQiY/J16JYi0Qvx/byYzCNb3W91y3FutACDfzwQ/BC/e/8uBsCR+yz1Lxj+PL6lHvqMKrM3rG4hstT5QjvHO9PzoxZyVYLzBfO2EeC3Ip3G+2kryOTIKT+l/K4w3QIDAQAB"},
+	}
+
+	results := DKIMValidator{Resolver: resolver}.Validate(readTestMessage(t, rfc8463Message))
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results but got %d", len(results))
+	}
+	for _, result := range results {
+		if result.Result != Pass {
+			t.Errorf("Expected 'pass' for selector %s but got '%s' (%s)", result.Tags["s"], result.Result, result.Reason)
+		}
+	}
+}
+
+func TestDKIMValidateMultipleSignatures(t *testing.T) {
+	key, pub := newTestKey(t, 1024)
+	resolver := fakeResolver{
+		"author._domainkey.example.com": {"v=DKIM1; p=" + pub},
+		"esp._domainkey.esp.example":    {"v=DKIM1; p=" + pub},
+	}
+
+	message := newTestMessage()
+	signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=author; h=From:Subject")
+	signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=simple/simple; d=esp.example; s=esp; h=From:To")
+	message.Headers.Add(signatureHeader, "v=1; a=rsa-sha256; d=example.com; s=missing; h=From; bh=AA==; b=AA==")
+	message.Headers.Add(signatureHeader, "v=2")
+
+	results := DKIMValidator{Resolver: resolver}.Validate(message)
+	expected := []Result{Pass, Pass, Permerror, Permerror}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results but got %d", len(expected), len(results))
+	}
+
+	for i, r := range results {
+		if r.Result != expected[i] {
+			t.Errorf("Expected '%s' for signature %d but got '%s' (%s)", expected[i], i, r.Result, r.Reason)
+		}
+	}
+
+	best := BestDKIMResult(results, "Example.com")
+	if best == nil || best.Result != Pass || best.Tags["s"] != "author" {
+		t.Error("Wrong best result for example.com")
+	}
+
+	if BestDKIMResult(results, "example.net") != nil {
+		t.Error("Got result for domain that did not sign")
+	}
+
+	results = DKIMValidator{Resolver: resolver, MaxSignatures: 1}.Validate(newTestMessage())
+	if len(results) != 1 || results[0].Result != None {
+		t.Error("Expected a single 'none' result")
+	}
+
+	message = newTestMessage()
+	for i := 0; i < 3; i++ {
+		signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=author; h=From")
+	}
+	if results = (DKIMValidator{Resolver: resolver, MaxSignatures: 2}).Validate(message); len(results) != 2 {
+		t.Errorf("Expected 2 results but got %d", len(results))
+	}
+}
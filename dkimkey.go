@@ -0,0 +1,239 @@
+package emailauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+ * selector._domainkey.example.com. IN TXT
+ *  "v=DKIM1; k=rsa; h=sha256; s=email; t=s; "
+ *  "p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDwIRP/UC3SBsEmGqZ9ZJW3/DkMoGeLnQg1fWn7/zYt"
+ *  "IxN2SnFCjxOCKG9v3b4jYfcTNh5ijSsq631uBItLa7od+v/RtdC2UzJ1lWT947qR+Rcac2gbto/NMqJ0fzfVjH4OuKhi"
+ *  "tdY9tf6mcwGjaNBcWToIMmPSPDdQPNUYckcQ2QIDAQAB"
+ */
+
+type DKIMKey struct {
+	Version        string
+	KeyType        string
+	HashAlgorithms []string
+	ServiceTypes   []string
+	Flags          []string
+	Notes          string
+	PublicKey      crypto.PublicKey
+}
+
+/*
+ * DKIMKeyPolicy describes which keys and algorithms a validator
+ * accepts. Signatures violating it are reported as "policy".
+ * RSA keys of up to WeakRSABits bits are accepted but flagged as
+ * weak. Failing signatures made with test keys (t=y) are reported as
+ * "neutral" unless IgnoreTestMode is set.
+ */
+type DKIMKeyPolicy struct {
+	MinRSABits     int
+	WeakRSABits    int
+	AllowSHA1      bool
+	IgnoreTestMode bool
+}
+
+// RFC 8301, section 3.1 and 3.2
+var DefaultDKIMKeyPolicy = DKIMKeyPolicy{MinRSABits: 1024, WeakRSABits: 1024}
+
+/*
+ * Parses a DKIM key record (RFC 6376, section 3.6.1). A record with
+ * an empty "p=" tag is valid and denotes a revoked key; its PublicKey
+ * is nil.
+ */
+func ParseDKIMKey(record string) (*DKIMKey, error) {
+	tags, err := parseTagList(record)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &DKIMKey{Version: "DKIM1", KeyType: "rsa"}
+	if v, ok := tags["v"]; ok {
+		if firstTagName(record) != "v" || v != "DKIM1" {
+			return nil, errors.New("Invalid version")
+		}
+	}
+
+	if k, ok := tags["k"]; ok {
+		key.KeyType = k
+	}
+
+	if h, ok := tags["h"]; ok {
+		key.HashAlgorithms = splitColonList(h)
+	}
+
+	key.ServiceTypes = []string{"*"}
+	if s, ok := tags["s"]; ok {
+		key.ServiceTypes = splitColonList(s)
+	}
+
+	if t, ok := tags["t"]; ok {
+		key.Flags = splitColonList(t)
+	}
+
+	key.Notes = tags["n"]
+
+	p, ok := tags["p"]
+	if !ok {
+		return nil, errors.New("Missing public key")
+	}
+
+	// keys are often published as several quoted strings with
+	// whitespace in between, which must not end up in the key data
+	p = removeWhitespace(p)
+	if p == "" {
+		return key, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errors.New("Invalid public key encoding")
+	}
+
+	switch key.KeyType {
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			// some signers publish the bare RSAPublicKey structure
+			pub, err = x509.ParsePKCS1PublicKey(data)
+			if err != nil {
+				return nil, errors.New("Invalid RSA public key")
+			}
+		}
+
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("Public key is not an RSA key")
+		}
+		key.PublicKey = rsaKey
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid Ed25519 public key")
+		}
+		key.PublicKey = ed25519.PublicKey(data)
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %s", key.KeyType)
+	}
+
+	return key, nil
+}
+
+func (k *DKIMKey) IsRevoked() bool {
+	return k.PublicKey == nil
+}
+
+/*
+ * Returns true if the domain is testing DKIM (t=y).
+ */
+func (k *DKIMKey) IsTesting() bool {
+	return containsFold(k.Flags, "y")
+}
+
+/*
+ * Returns true if the "i=" domain of a signature must exactly match
+ * its "d=" domain (t=s).
+ */
+func (k *DKIMKey) IsStrict() bool {
+	return containsFold(k.Flags, "s")
+}
+
+func (k *DKIMKey) AllowsHash(hash string) bool {
+	if len(k.HashAlgorithms) == 0 {
+		return true
+	}
+	return containsFold(k.HashAlgorithms, hash)
+}
+
+func (k *DKIMKey) AllowsService(service string) bool {
+	return containsFold(k.ServiceTypes, "*") || containsFold(k.ServiceTypes, service)
+}
+
+/*
+ * Returns the key size in bits or 0 for revoked keys.
+ */
+func (k *DKIMKey) Bits() int {
+	switch pub := k.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return pub.N.BitLen()
+	case ed25519.PublicKey:
+		return 8 * len(pub)
+	}
+	return 0
+}
+
+func (p *DKIMKeyPolicy) check(key *DKIMKey, sig *dkimSignature) *DKIMResult {
+	if sig.HashName == "sha1" && !p.AllowSHA1 {
+		return sig.result(Policy, fmt.Sprintf("%s not allowed", sig.Algorithm))
+	}
+
+	if _, ok := key.PublicKey.(*rsa.PublicKey); ok && key.Bits() < p.MinRSABits {
+		return sig.result(Policy, fmt.Sprintf("%d-bit key; key too small", key.Bits()))
+	}
+
+	return nil
+}
+
+func (p *DKIMKeyPolicy) isWeak(key *DKIMKey) bool {
+	_, ok := key.PublicKey.(*rsa.PublicKey)
+	return ok && key.Bits() <= p.WeakRSABits
+}
+
+func findDKIMKey(resolver Resolver, selector string, domain string) (*DKIMKey, *DKIMResult) {
+	name := selector + "._domainkey." + domain
+	records, err := resolverOrDefault(resolver).LookupTXT(context.Background(), name)
+	if err != nil {
+		if isTemporaryDNSError(err) {
+			return nil, newDKIMResult(Temperror, err.Error())
+		}
+		return nil, newDKIMResult(Permerror, fmt.Sprintf("No key for signature: %s", sanitizeDomainForPrinting(name)))
+	}
+
+	// RFC 6376, section 3.6.2.2: verifiers may choose any of multiple
+	// key records, so the first one that parses is used
+	var lastErr error
+	for _, record := range records {
+		key, err := ParseDKIMKey(record)
+		if err == nil {
+			return key, nil
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return nil, newDKIMResult(Permerror, fmt.Sprintf("No key for signature: %s", sanitizeDomainForPrinting(name)))
+	}
+
+	return nil, newDKIMResult(Permerror, fmt.Sprintf("Invalid key record: %s", lastErr.Error()))
+}
+
+func splitColonList(list string) []string {
+	parts := strings.Split(list, ":")
+	values := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			values = append(values, p)
+		}
+	}
+	return values
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
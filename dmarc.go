@@ -1,27 +1,490 @@
 package emailauth
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
 /*
  * Authentication-Results:
  *  mx.example.com;
  *  dmarc=pass (p=REJECT sp=REJECT dis=NONE) header.from=example.com
+ *
+ * _dmarc.example.com. IN TXT
+ *  "v=DMARC1; p=reject; sp=reject; adkim=s; aspf=r; pct=100; rua=mailto:dmarc@example.com"
  */
 
 type DMARCResult struct {
-	Result    Result
-	Domain    string
-	Alignment []string
-	Tags      map[string]string // DMARC Tag Registry: adkim, aspf, ...
+	Result       Result
+	Reason       string
+	Domain       string
+	PolicyDomain string
+	Alignment    []string          // aligned SPF and DKIM identifiers
+	Tags         map[string]string // DMARC Tag Registry: adkim, aspf, ...
+	Policy       Disposition       // requested by p=, sp= or np=
+	Disposition  Disposition       // applied after sampling and local overrides
+	Overrides    []PolicyOverrideReason
+	SPF          *SPFResult
+	DKIM         []*DKIMResult
 }
 
+/*
+ * The Random function is used for "pct=" sampling and must return a
+ * number in [0, n). It defaults to math/rand.Intn.
+ *
+ * Override is called for every result of a domain publishing a DMARC
+ * record, passing or failing, after sampling and the ARC override. It
+ * is not called if no record was found or the lookup failed. It may
+ * return a different disposition together with the reason for the
+ * local override (RFC 7489, section 7.2.1), or nil to keep the
+ * disposition.
+ *
+ * TrustedARCSealers lists the domains whose ARC sets are trusted to
+ * report a DMARC pass before forwarding (see ValidateWithARC).
+ */
 type DMARCValidator struct {
+	Resolver          Resolver
+	PublicSuffixList  *PublicSuffixList
+	Discovery         DMARCDiscovery
+	Random            func(n int) int
+	Override          func(message *Message, result *DMARCResult) (Disposition, *PolicyOverrideReason)
+	TrustedARCSealers []string
+	Logger            *slog.Logger
+	Metrics           Metrics
+}
+
+type Disposition string
+
+func (d Disposition) String() string {
+	return string(d)
+}
+
+const (
+	DispositionNone       = Disposition("none")
+	DispositionQuarantine = Disposition("quarantine")
+	DispositionReject     = Disposition("reject")
+)
+
+type PolicyOverride string
+
+// RFC 7489, appendix C
+const (
+	OverrideForwarded        = PolicyOverride("forwarded")
+	OverrideSampledOut       = PolicyOverride("sampled_out")
+	OverrideTrustedForwarder = PolicyOverride("trusted_forwarder")
+	OverrideMailingList      = PolicyOverride("mailing_list")
+	OverrideLocalPolicy      = PolicyOverride("local_policy")
+	OverrideOther            = PolicyOverride("other")
+)
+
+var dmarcDefaults = map[string]string{
+	"adkim": "r",
+	"aspf":  "r",
+	"fo":    "0",
+	"pct":   "100",
+	"rf":    "afrf",
+	"ri":    "86400",
+}
+
+const (
+	spfAlignment  = 0
+	dkimAlignment = 1
+)
+
+func (v DMARCValidator) Validate(message *Message, spfResult *SPFResult, dkimResults []*DKIMResult) *DMARCResult {
+	return v.ValidateContext(context.Background(), message, spfResult, dkimResults)
+}
+
+/*
+ * Like Validate, querying the policy with ctx. The result and queries
+ * are logged with the trace ID of ctx.
+ */
+func (v DMARCValidator) ValidateContext(ctx context.Context, message *Message, spfResult *SPFResult, dkimResults []*DKIMResult) *DMARCResult {
+	return v.ValidateWithARCContext(ctx, message, spfResult, dkimResults, nil)
+}
+
+/*
+ * Like Validate, but a message failing DMARC is delivered without
+ * applying the policy if a validated ARC chain shows that DMARC passed
+ * at a trusted intermediary (RFC 8617, section 7.2). The override is
+ * recorded as "local_policy".
+ */
+func (v DMARCValidator) ValidateWithARC(message *Message, spfResult *SPFResult, dkimResults []*DKIMResult, arcResult *ARCResult) *DMARCResult {
+	return v.ValidateWithARCContext(context.Background(), message, spfResult, dkimResults, arcResult)
+}
+
+/*
+ * Like ValidateWithARC, with ctx as for ValidateContext.
+ */
+func (v DMARCValidator) ValidateWithARCContext(ctx context.Context, message *Message, spfResult *SPFResult, dkimResults []*DKIMResult, arcResult *ARCResult) *DMARCResult {
+	resolver := traceResolver(ctx, v.Resolver, v.Logger, v.Metrics)
+	v.Resolver = resolver
+	result := v.logResult(ctx, v.validate(message, spfResult, dkimResults, arcResult))
+	observeEvaluation(v.Metrics, "dmarc", resolver, result.Result)
+	return result
+}
+
+func (v DMARCValidator) logResult(ctx context.Context, result *DMARCResult) *DMARCResult {
+	attrs := []slog.Attr{
+		slog.String("from", result.Domain),
+		slog.String("policy-domain", result.PolicyDomain),
+		slog.String("result", result.Result.String()),
+		slog.String("policy", string(result.Policy)),
+		slog.String("disposition", string(result.Disposition)),
+		slog.String("spf-aligned", result.Alignment[spfAlignment]),
+		slog.String("dkim-aligned", result.Alignment[dkimAlignment]),
+	}
+	for _, o := range result.Overrides {
+		attrs = append(attrs, slog.String("override", string(o.Type)+" "+o.Comment))
+	}
+	attrs = append(attrs, slog.String("reason", result.Reason))
+	logVerdict(ctx, v.Logger, "dmarc", result.Result, attrs...)
+	return result
+}
+
+func (v DMARCValidator) validate(message *Message, spfResult *SPFResult, dkimResults []*DKIMResult, arcResult *ARCResult) *DMARCResult {
+	domain, err := fromDomain(message)
+	if err != nil {
+		return newDMARCResult(Permerror, err.Error())
+	}
+
+	discovery := v.newDiscovery()
+	tags, policyDomain, errResult := discovery.findPolicy(domain)
+	if errResult != nil {
+		errResult.Domain = domain
+		return errResult
+	}
+
+	result := newDMARCResult(Fail, "No aligned identifier")
+	result.Domain = domain
+	result.PolicyDomain = policyDomain
+	result.Tags = tags
+	result.SPF = spfResult
+	result.DKIM = dkimResults
+
+	if spfResult != nil && spfResult.Result == Pass && discovery.isAligned(spfResult.Domain, domain, tags["aspf"]) {
+		result.Alignment[spfAlignment] = spfResult.Domain
+	}
+
+	for _, r := range dkimResults {
+		d := strings.ToLower(r.Tags["d"])
+		if r.Result != Pass || !discovery.isAligned(d, domain, tags["adkim"]) {
+			continue
+		}
+
+		// prefer a signature of the author domain itself
+		if result.Alignment[dkimAlignment] == "" || d == domain {
+			result.Alignment[dkimAlignment] = d
+		}
+	}
+
+	if result.Alignment[spfAlignment] != "" || result.Alignment[dkimAlignment] != "" {
+		result.Result = Pass
+		result.Reason = ""
+	}
+
+	result.Policy = v.requestedPolicy(discovery, domain, policyDomain, tags)
+	if result.Result == Fail {
+		result.Disposition = v.applySampling(result, tags)
+		if set := v.trustedARCPass(arcResult, domain); set != nil && result.Disposition != DispositionNone {
+			result.Disposition = DispositionNone
+			result.Overrides = append(result.Overrides, PolicyOverrideReason{
+				Type:    OverrideLocalPolicy,
+				Comment: fmt.Sprintf("arc=pass as[%d].d=%s", set.Instance, strings.ToLower(strings.TrimSuffix(set.Seal["d"], "."))),
+			})
+		}
+	}
+
+	if v.Override != nil {
+		if disposition, reason := v.Override(message, result); reason != nil {
+			result.Disposition = disposition
+			result.Overrides = append(result.Overrides, *reason)
+		}
+	}
+
+	return result
+}
+
+/*
+ * Returns the policy requested for the author domain: "p=" if the
+ * record was published by the author domain itself, otherwise "sp=",
+ * or "np=" if the author domain does not exist. Unlike for ADSP, this
+ * includes domains without address and MX records (RFC 9091, section
+ * 2.1).
+ */
+func (v DMARCValidator) requestedPolicy(discovery *dmarcDiscovery, domain string, policyDomain string, tags map[string]string) Disposition {
+	if domain == policyDomain {
+		return Disposition(tags["p"])
+	}
+
+	if tags["np"] != tags["sp"] {
+		if exists, err := hasAddressOrMX(discovery.resolver, domain); err == nil && !exists {
+			return Disposition(tags["np"])
+		}
+	}
+	return Disposition(tags["sp"])
+}
+
+/*
+ * Applies "pct=" sampling and the DMARCbis test mode ("t=y"). Messages
+ * not subject to the policy get the next lower policy applied
+ * (RFC 7489, section 6.6.4), which is recorded as "sampled_out".
+ */
+func (v DMARCValidator) applySampling(result *DMARCResult, tags map[string]string) Disposition {
+	policy := result.Policy
+	pct, _ := strconv.Atoi(tags["pct"])
+	comment := ""
+	if tags["t"] == "y" {
+		pct = 0
+		comment = "test mode"
+	}
+
+	if pct >= 100 || (pct > 0 && v.random(100) < pct) {
+		return policy
+	}
+
+	disposition := policy
+	switch policy {
+	case DispositionReject:
+		disposition = DispositionQuarantine
+	case DispositionQuarantine:
+		disposition = DispositionNone
+	}
+
+	if disposition != policy {
+		result.Overrides = append(result.Overrides, PolicyOverrideReason{Type: OverrideSampledOut, Comment: comment})
+	}
+	return disposition
+}
+
+/*
+ * Returns the most recent ARC set of a trusted sealer reporting a DMARC
+ * pass for the author domain, or nil. The message must not have been
+ * modified since that set was added.
+ */
+func (v DMARCValidator) trustedARCPass(arcResult *ARCResult, domain string) *ARCSet {
+	if arcResult == nil || arcResult.Result != Pass {
+		return nil
+	}
+
+	for i := len(arcResult.Sets) - 1; i >= 0; i-- {
+		set := arcResult.Sets[i]
+		if arcResult.OldestPass > set.Instance {
+			break
+		}
+
+		if !containsFold(v.TrustedARCSealers, strings.TrimSuffix(set.Seal["d"], ".")) {
+			continue
+		}
+
+		for _, r := range parseAuthResults(set.AuthenticationResults) {
+			if r.Method == "dmarc" && r.Result == Pass && strings.EqualFold(r.Props["header.from"], domain) {
+				return set
+			}
+		}
+	}
+	return nil
+}
+
+func (v DMARCValidator) random(n int) int {
+	if v.Random == nil {
+		return rand.Intn(n)
+	}
+	return v.Random(n)
+}
+
+/*
+ * Returns the comment describing the published and applied policies,
+ * e.g. "(p=REJECT sp=REJECT dis=NONE)", or an empty string if there is
+ * no policy.
+ */
+func (r *DMARCResult) Comment() string {
+	if r.Tags["p"] == "" || r.Disposition == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("(p=%s sp=%s dis=%s)", strings.ToUpper(r.Tags["p"]), strings.ToUpper(r.Tags["sp"]),
+		strings.ToUpper(r.Disposition.String()))
+}
+
+func isDMARCRecord(record string) bool {
+	tags := strings.SplitN(record, ";", 2)
+	v := strings.SplitN(tags[0], "=", 2)
+	return len(v) == 2 && strings.TrimSpace(v[0]) == "v" && strings.TrimSpace(v[1]) == "DMARC1"
 }
 
-func (v DMARCValidator) Validate(message *Message, spfResult *SPFResult, dkimResult *DKIMResult) *DMARCResult {
-	return newDMARCResult(None)
+/*
+ * Parses a DMARC record (RFC 7489, section 6.3) and returns its tags
+ * with default values applied. "v" must be the first tag and "p" is
+ * required unless a valid "rua" tag is present, in which case "p=none"
+ * is assumed. Invalid values of other tags are replaced by their
+ * defaults, unknown tags are ignored. The DMARCbis tags "psd" and "t"
+ * have no default here, they are only present if valid.
+ */
+func ParseDMARCRecord(record string) (map[string]string, error) {
+	if !isDMARCRecord(record) {
+		return nil, errors.New("Not a DMARC record")
+	}
+
+	raw, err := parseTagList(record)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	tags["v"] = raw["v"]
+	for name, value := range dmarcDefaults {
+		tags[name] = value
+	}
+
+	// invalid URIs are ignored, as by AuthorizedReportURIs
+	if rua := validDMARCURIs(raw["rua"]); rua != "" {
+		tags["rua"] = rua
+	}
+
+	if ruf := validDMARCURIs(raw["ruf"]); ruf != "" {
+		tags["ruf"] = ruf
+	}
+
+	p := strings.ToLower(raw["p"])
+	if !isValidDMARCPolicy(p) {
+		if _, ok := tags["rua"]; !ok {
+			return nil, fmt.Errorf("Invalid policy: %s", raw["p"])
+		}
+		p = "none"
+	}
+	tags["p"] = p
+	tags["sp"] = p
+
+	if sp := strings.ToLower(raw["sp"]); isValidDMARCPolicy(sp) {
+		tags["sp"] = sp
+	}
+
+	tags["np"] = tags["sp"]
+	if np := strings.ToLower(raw["np"]); isValidDMARCPolicy(np) {
+		tags["np"] = np
+	}
+
+	for _, name := range []string{"adkim", "aspf"} {
+		if mode := strings.ToLower(raw[name]); mode == "r" || mode == "s" {
+			tags[name] = mode
+		}
+	}
+
+	if pct, err := strconv.Atoi(raw["pct"]); err == nil && pct >= 0 && pct <= 100 {
+		tags["pct"] = strconv.Itoa(pct)
+	}
+
+	if ri, err := strconv.ParseUint(raw["ri"], 10, 32); err == nil {
+		tags["ri"] = strconv.FormatUint(ri, 10)
+	}
+
+	if fo, ok := raw["fo"]; ok && isValidDMARCOptionList(fo, "0", "1", "d", "s") {
+		tags["fo"] = strings.ToLower(removeWhitespace(fo))
+	}
+
+	// DMARCbis
+	if psd := strings.ToLower(raw["psd"]); psd == "y" || psd == "n" || psd == "u" {
+		tags["psd"] = psd
+	}
+
+	if testing := strings.ToLower(raw["t"]); testing == "y" || testing == "n" {
+		tags["t"] = testing
+	}
+
+	if rf, ok := raw["rf"]; ok && isValidDMARCOptionList(rf, "afrf") {
+		tags["rf"] = strings.ToLower(removeWhitespace(rf))
+	}
+
+	return tags, nil
+}
+
+func isValidDMARCPolicy(p string) bool {
+	return p == "none" || p == "quarantine" || p == "reject"
+}
+
+func isValidDMARCOptionList(list string, options ...string) bool {
+	values := splitColonList(list)
+	if len(values) == 0 {
+		return false
+	}
+
+	for _, v := range values {
+		if !containsFold(options, v) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Returns the valid URIs of a comma-separated list, empty if there are
+ * none.
+ */
+func validDMARCURIs(list string) string {
+	var valid []string
+	for _, s := range strings.Split(list, ",") {
+		if _, err := ParseReportURI(s); err == nil {
+			valid = append(valid, strings.TrimSpace(s))
+		}
+	}
+	return strings.Join(valid, ",")
+}
+
+/*
+ * Returns the domain of the RFC5322.From header field. Messages
+ * without a From field or with addresses from more than one domain
+ * are rejected (RFC 7489, section 6.6.1).
+ */
+func fromDomain(message *Message) (string, error) {
+	var from []string
+	if message.Headers != nil {
+		from = message.Headers.Values("From")
+	}
+
+	if len(from) == 0 {
+		return "", errors.New("Missing From header")
+	}
+
+	domain := ""
+	for _, field := range from {
+		addresses, err := mail.ParseAddressList(field)
+		if err != nil || len(addresses) == 0 {
+			return "", errors.New("Invalid From header")
+		}
+
+		for _, address := range addresses {
+			d := strings.TrimSuffix(strings.ToLower(domainOfIdentity(address.Address)), ".")
+			if d == "" || !strings.Contains(address.Address, "@") {
+				return "", errors.New("Invalid From header")
+			}
+
+			if domain != "" && d != domain {
+				return "", errors.New("Multiple From domains")
+			}
+			domain = d
+		}
+	}
+
+	return domain, nil
+}
+
+/*
+ * Returns the organizational domain (RFC 7489, section 3.2) of the
+ * given domain according to the embedded Public Suffix List.
+ */
+func OrganizationalDomain(domain string) string {
+	return DefaultPublicSuffixList().OrganizationalDomain(domain)
 }
 
-func newDMARCResult(result Result) *DMARCResult {
-	r := &DMARCResult{Result: result}
+func newDMARCResult(result Result, reason string) *DMARCResult {
+	r := &DMARCResult{Result: result, Reason: reason, Disposition: DispositionNone}
 	r.Alignment = make([]string, 2)
 	r.Tags = make(map[string]string)
 	return r
@@ -0,0 +1,390 @@
+package emailauth
+
+import (
+	"net/textproto"
+	"testing"
+)
+
+func newTestDMARCMessage(from string) *Message {
+	headers := textproto.MIMEHeader{}
+	headers.Add("From", from)
+	return &Message{Headers: &headers}
+}
+
+func TestParseDMARCRecord(t *testing.T) {
+	tags, err := ParseDMARCRecord("v=DMARC1; p=Reject; sp=quarantine; adkim=s; pct=50; rua=mailto:dmarc@example.com!10m; fo=1:d; ri=3600; x=y")
+	if err != nil {
+		t.Fatalf("Parsing error: %s", err.Error())
+	}
+
+	expected := map[string]string{
+		"v":     "DMARC1",
+		"p":     "reject",
+		"sp":    "quarantine",
+		"np":    "quarantine",
+		"adkim": "s",
+		"aspf":  "r",
+		"pct":   "50",
+		"rua":   "mailto:dmarc@example.com!10m",
+		"fo":    "1:d",
+		"rf":    "afrf",
+		"ri":    "3600",
+	}
+	for name, value := range expected {
+		assertStringEquals(value, tags[name], t)
+	}
+
+	for _, name := range []string{"x", "psd", "t"} {
+		if _, ok := tags[name]; ok {
+			t.Errorf("Tag %s was added", name)
+		}
+	}
+
+	// invalid values fall back to defaults
+	tags, err = ParseDMARCRecord("v=DMARC1; p=none; adkim=x; pct=101; fo=2; ri=-1")
+	if err != nil {
+		t.Fatalf("Parsing error: %s", err.Error())
+	}
+	assertStringEquals("r", tags["adkim"], t)
+	assertStringEquals("100", tags["pct"], t)
+	assertStringEquals("0", tags["fo"], t)
+	assertStringEquals("86400", tags["ri"], t)
+	assertStringEquals("none", tags["sp"], t)
+
+	// missing policy with valid rua means p=none
+	tags, err = ParseDMARCRecord("v=DMARC1; rua=mailto:dmarc@example.com")
+	if err != nil {
+		t.Fatalf("Parsing error: %s", err.Error())
+	}
+	assertStringEquals("none", tags["p"], t)
+
+	// invalid report URIs are ignored
+	tags, err = ParseDMARCRecord("v=DMARC1; p=none; rua=mailto:a@example.com, dmarc@example.com, mailto:b@example.com!5x; ruf=example")
+	if err != nil {
+		t.Fatalf("Parsing error: %s", err.Error())
+	}
+	assertStringEquals("mailto:a@example.com", tags["rua"], t)
+	if _, ok := tags["ruf"]; ok {
+		t.Errorf("Unexpected ruf: %s", tags["ruf"])
+	}
+
+	invalid := []string{"p=none; v=DMARC1", "v=DMARC2; p=none", "v=DMARC1; p=discard", "v=DMARC1; p=none; p=reject", "v=DMARC1"}
+	for _, record := range invalid {
+		if _, err := ParseDMARCRecord(record); err == nil {
+			t.Errorf("Invalid record was parsed: '%s'", record)
+		}
+	}
+}
+
+func TestDMARCPolicyDiscovery(t *testing.T) {
+	v := DMARCValidator{Resolver: fakeResolver{
+		"_dmarc.example.com":      {"v=spf1 -all", "v=DMARC1; p=reject"},
+		"_dmarc.sub.example.com":  {"v=DMARC1; p=quarantine"},
+		"_dmarc.multi.example":    {"v=DMARC1; p=none", "v=DMARC1; p=reject"},
+		"_dmarc.invalid.example":  {"v=DMARC1; p=discard"},
+		"_dmarc.example.net":      {"v=DMARC1; sp=none"},
+		"_dmarc.deep.example.org": {"v=DMARC1; p=none"},
+	}}
+
+	cases := []struct {
+		from         string
+		result       Result
+		policyDomain string
+		p            string
+	}{
+		{"user@example.com", Fail, "example.com", "reject"},
+		{"\"User\" <user@Sub.Example.com>", Fail, "sub.example.com", "quarantine"},
+		{"user@other.example.com", Fail, "example.com", "reject"},
+		{"user@multi.example", None, "", ""},
+		{"user@invalid.example", Permerror, "", ""},
+		{"user@example.net", Permerror, "", ""},
+		{"user@a.b.deep.example.org", None, "", ""},
+		{"invalid", Permerror, "", ""},
+	}
+
+	for _, c := range cases {
+		result := v.Validate(newTestDMARCMessage(c.from), nil, nil)
+		if result.Result != c.result {
+			t.Errorf("Expected '%s' for '%s' but got '%s' (%s)", c.result, c.from, result.Result, result.Reason)
+		}
+		assertStringEquals(c.policyDomain, result.PolicyDomain, t)
+		assertStringEquals(c.p, result.Tags["p"], t)
+	}
+}
+
+func TestFromDomain(t *testing.T) {
+	valid := map[string][]string{
+		"example.com": {"User <User@Example.COM>"},
+		"example.net": {"a@example.net, b@example.net"},
+		"example.org": {"a@example.org", "Someone <b@example.org>"},
+	}
+	for expected, from := range valid {
+		message := newTestDMARCMessage(from[0])
+		for _, f := range from[1:] {
+			message.Headers.Add("From", f)
+		}
+
+		domain, err := fromDomain(message)
+		if err != nil {
+			t.Errorf("Error for '%v': %s", from, err.Error())
+		}
+		assertStringEquals(expected, domain, t)
+	}
+
+	invalid := [][]string{{"a@example.com, b@example.net"}, {"a@example.com", "b@example.net"}, {"undisclosed-recipients:;"}, {"no address"}}
+	for _, from := range invalid {
+		message := newTestDMARCMessage(from[0])
+		for _, f := range from[1:] {
+			message.Headers.Add("From", f)
+		}
+
+		if _, err := fromDomain(message); err == nil {
+			t.Errorf("Invalid From was accepted: '%v'", from)
+		}
+	}
+
+	if _, err := fromDomain(&Message{}); err == nil {
+		t.Error("Missing From was accepted")
+	}
+}
+
+func TestDMARCAlignment(t *testing.T) {
+	v := DMARCValidator{Resolver: fakeResolver{
+		"_dmarc.example.com": {"v=DMARC1; p=reject"},
+		"_dmarc.example.net": {"v=DMARC1; p=reject; adkim=s; aspf=s"},
+	}}
+
+	dkimResult := func(result Result, d string) *DKIMResult {
+		r := newDKIMResult(result, "")
+		r.Tags["d"] = d
+		return r
+	}
+
+	cases := []struct {
+		from   string
+		spf    *SPFResult
+		dkim   []*DKIMResult
+		result Result
+		spfID  string
+		dkimID string
+	}{
+		{"a@example.com", &SPFResult{Result: Pass, Domain: "bounces.example.com"}, nil, Pass, "bounces.example.com", ""},
+		{"a@example.com", &SPFResult{Result: Fail, Domain: "example.com"}, nil, Fail, "", ""},
+		{"a@example.com", &SPFResult{Result: Pass, Domain: "esp.example"}, []*DKIMResult{dkimResult(Pass, "esp.example"), dkimResult(Pass, "mail.example.com"), dkimResult(Pass, "example.com")}, Pass, "", "example.com"},
+		{"a@example.com", nil, []*DKIMResult{dkimResult(Fail, "example.com")}, Fail, "", ""},
+		{"a@sub.example.net", &SPFResult{Result: Pass, Domain: "example.net"}, []*DKIMResult{dkimResult(Pass, "example.net")}, Fail, "", ""},
+		{"a@example.net", &SPFResult{Result: Pass, Domain: "example.net"}, []*DKIMResult{dkimResult(Pass, "Example.net")}, Pass, "example.net", "example.net"},
+	}
+
+	for i, c := range cases {
+		result := v.Validate(newTestDMARCMessage(c.from), c.spf, c.dkim)
+		if result.Result != c.result {
+			t.Errorf("Expected '%s' for case %d but got '%s' (%s)", c.result, i, result.Result, result.Reason)
+		}
+		assertStringEquals(c.spfID, result.Alignment[spfAlignment], t)
+		assertStringEquals(c.dkimID, result.Alignment[dkimAlignment], t)
+	}
+}
+
+func TestTreeWalkNames(t *testing.T) {
+	names := treeWalkNames("a.b.c.d.e.f.g.h.i.j.example")
+	expected := []string{"a.b.c.d.e.f.g.h.i.j.example", "e.f.g.h.i.j.example", "f.g.h.i.j.example", "g.h.i.j.example", "h.i.j.example", "i.j.example", "j.example", "example"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected %v but got %v", expected, names)
+	}
+
+	for i := range expected {
+		assertStringEquals(expected[i], names[i], t)
+	}
+
+	names = treeWalkNames("example")
+	if len(names) != 1 || names[0] != "example" {
+		t.Errorf("Unexpected names %v", names)
+	}
+}
+
+func TestDMARCTreeWalk(t *testing.T) {
+	v := DMARCValidator{Discovery: TreeWalkDiscovery, Resolver: fakeResolver{
+		"_dmarc.example":               {"v=DMARC1; p=reject; psd=y"},
+		"_dmarc.example.com":           {"v=DMARC1; p=quarantine"},
+		"_dmarc.dept.corp.example.net": {"v=DMARC1; p=none; psd=n"},
+		"_dmarc.corp.example.net":      {"v=DMARC1; p=reject"},
+		"_dmarc.net":                   {"v=DMARC1; p=reject; psd=y"},
+	}}
+
+	d := v.newDiscovery()
+	cases := map[string]string{
+		"a.b.example.com":               "example.com",
+		"mail.other.example":            "other.example",
+		"x.dept.corp.example.net":       "dept.corp.example.net",
+		"corp.example.net":              "example.net",
+		"example.org":                   "example.org",
+		"a.b.c.d.e.f.g.h.i.example.com": "example.com",
+	}
+	for domain, expected := range cases {
+		assertStringEquals(expected, d.organizationalDomain(domain), t)
+	}
+
+	tags, policyDomain, errResult := d.findPolicy("a.b.c.d.e.f.g.h.i.example.com")
+	if errResult != nil {
+		t.Fatalf("Unexpected error: %s", errResult.Reason)
+	}
+	assertStringEquals("example.com", policyDomain, t)
+	assertStringEquals("quarantine", tags["p"], t)
+	assertStringEquals("u", tags["psd"], t)
+	assertStringEquals("n", tags["t"], t)
+
+	tags, policyDomain, _ = d.findPolicy("mail.other.example")
+	assertStringEquals("example", policyDomain, t)
+	assertStringEquals("y", tags["psd"], t)
+
+	// relaxed alignment across the psd=n boundary
+	message := newTestDMARCMessage("user@x.dept.corp.example.net")
+	result := v.Validate(message, &SPFResult{Result: Pass, Domain: "corp.example.net"}, nil)
+	if result.Result != Fail {
+		t.Errorf("Expected 'fail' but got '%s'", result.Result)
+	}
+
+	result = v.Validate(message, &SPFResult{Result: Pass, Domain: "y.dept.corp.example.net"}, nil)
+	if result.Result != Pass {
+		t.Errorf("Expected 'pass' but got '%s'", result.Result)
+	}
+	assertStringEquals("dept.corp.example.net", result.PolicyDomain, t)
+}
+
+func TestDMARCDisposition(t *testing.T) {
+	resolver := fakeResolver{
+		"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine; np=reject; pct=50"},
+		"_dmarc.example.net": {"v=DMARC1; p=reject; t=y"},
+		"_dmarc.example.org": {"v=DMARC1; p=quarantine"},
+		"exists.example.com": {"v=spf1 -all"},
+	}
+
+	random := 0
+	v := DMARCValidator{Resolver: resolver, Random: func(n int) int { return random }}
+	cases := []struct {
+		from        string
+		random      int
+		policy      Disposition
+		disposition Disposition
+		comment     string
+	}{
+		{"a@example.com", 10, DispositionReject, DispositionReject, "(p=REJECT sp=QUARANTINE dis=REJECT)"},
+		{"a@example.com", 50, DispositionReject, DispositionQuarantine, "(p=REJECT sp=QUARANTINE dis=QUARANTINE)"},
+		{"a@exists.example.com", 10, DispositionQuarantine, DispositionQuarantine, "(p=REJECT sp=QUARANTINE dis=QUARANTINE)"},
+		{"a@exists.example.com", 99, DispositionQuarantine, DispositionNone, "(p=REJECT sp=QUARANTINE dis=NONE)"},
+		{"a@nx.example.com", 10, DispositionReject, DispositionReject, "(p=REJECT sp=QUARANTINE dis=REJECT)"},
+		{"a@example.net", 0, DispositionReject, DispositionQuarantine, "(p=REJECT sp=REJECT dis=QUARANTINE)"},
+		{"a@example.org", 99, DispositionQuarantine, DispositionQuarantine, "(p=QUARANTINE sp=QUARANTINE dis=QUARANTINE)"},
+	}
+
+	for _, c := range cases {
+		random = c.random
+		result := v.Validate(newTestDMARCMessage(c.from), nil, nil)
+		if result.Policy != c.policy || result.Disposition != c.disposition {
+			t.Errorf("Expected %s/%s for '%s' but got %s/%s", c.policy, c.disposition, c.from, result.Policy, result.Disposition)
+		}
+		assertStringEquals(c.comment, result.Comment(), t)
+	}
+
+	result := v.Validate(newTestDMARCMessage("a@example.org"), &SPFResult{Result: Pass, Domain: "example.org"}, nil)
+	assertStringEquals("(p=QUARANTINE sp=QUARANTINE dis=NONE)", result.Comment(), t)
+
+	// np= also applies to domains without address and MX records (RFC 9091)
+	nodata := DMARCValidator{Resolver: noRecordsResolver{resolver}, Random: func(n int) int { return 0 }}
+	if result := nodata.Validate(newTestDMARCMessage("a@exists.example.com"), nil, nil); result.Policy != DispositionReject {
+		t.Errorf("Expected np policy but got %s", result.Policy)
+	}
+
+	result = v.Validate(newTestDMARCMessage("a@example.edu"), nil, nil)
+	assertStringEquals("", result.Comment(), t)
+}
+
+func TestDMARCPolicyOverride(t *testing.T) {
+	resolver := fakeResolver{
+		"_dmarc.example.com": {"v=DMARC1; p=reject; pct=50"},
+		"_dmarc.example.org": {"v=DMARC1; p=reject"},
+	}
+
+	v := DMARCValidator{Resolver: resolver, Random: func(n int) int { return 99 }}
+	result := v.Validate(newTestDMARCMessage("a@example.com"), nil, nil)
+	if len(result.Overrides) != 1 || result.Overrides[0].Type != OverrideSampledOut {
+		t.Errorf("Expected sampled_out override but got %v", result.Overrides)
+	}
+
+	v.Override = func(message *Message, result *DMARCResult) (Disposition, *PolicyOverrideReason) {
+		if message.Headers.Get("List-Id") == "" || result.Disposition != DispositionReject {
+			return "", nil
+		}
+		return DispositionQuarantine, &PolicyOverrideReason{Type: OverrideMailingList, Comment: message.Headers.Get("List-Id")}
+	}
+
+	result = v.Validate(newTestDMARCMessage("a@example.org"), nil, nil)
+	if result.Disposition != DispositionReject || len(result.Overrides) != 0 {
+		t.Errorf("Expected no override but got %s %v", result.Disposition, result.Overrides)
+	}
+
+	message := newTestDMARCMessage("a@example.org")
+	message.Headers.Set("List-Id", "<list.example.org>")
+	result = v.Validate(message, nil, nil)
+	if result.Disposition != DispositionQuarantine || len(result.Overrides) != 1 || result.Overrides[0].Type != OverrideMailingList {
+		t.Errorf("Expected mailing_list override but got %s %v", result.Disposition, result.Overrides)
+	}
+	assertStringEquals("(p=REJECT sp=REJECT dis=QUARANTINE)", result.Comment(), t)
+
+	// called for passing results, but not without a record
+	var called []Result
+	v.Override = func(message *Message, result *DMARCResult) (Disposition, *PolicyOverrideReason) {
+		called = append(called, result.Result)
+		return "", nil
+	}
+	v.Validate(newTestDMARCMessage("a@example.org"), &SPFResult{Result: Pass, Domain: "example.org"}, nil)
+	v.Validate(newTestDMARCMessage("a@example.net"), nil, nil)
+	if len(called) != 1 || called[0] != Pass {
+		t.Errorf("Expected a single call for the passing result but got %v", called)
+	}
+}
+
+func TestDMARCValidateWithARC(t *testing.T) {
+	v := DMARCValidator{
+		Resolver:          fakeResolver{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+		TrustedARCSealers: []string{"lists.example.org"},
+	}
+
+	newARC := func(result Result, oldestPass int, sealer string, aar string) *ARCResult {
+		return &ARCResult{Result: result, OldestPass: oldestPass, Sets: []*ARCSet{
+			{Instance: 1, Seal: map[string]string{"d": sealer}, AuthenticationResults: aar},
+			{Instance: 2, Seal: map[string]string{"d": "relay.example.net"}, AuthenticationResults: "relay.example.net; dmarc=fail header.from=example.com"},
+		}}
+	}
+
+	upstreamPass := "lists.example.org; spf=pass smtp.mailfrom=example.com; dmarc=pass (p=REJECT sp=REJECT dis=NONE) header.from=example.com"
+	cases := []struct {
+		arc         *ARCResult
+		disposition Disposition
+	}{
+		{nil, DispositionReject},
+		{newARC(Pass, 0, "lists.example.org", upstreamPass), DispositionNone},
+		{newARC(Pass, 0, "LISTS.example.org.", upstreamPass), DispositionNone},
+		{newARC(Fail, 0, "lists.example.org", upstreamPass), DispositionReject},
+		{newARC(Pass, 2, "lists.example.org", upstreamPass), DispositionReject},
+		{newARC(Pass, 0, "other.example.org", upstreamPass), DispositionReject},
+		{newARC(Pass, 0, "lists.example.org", "lists.example.org; dmarc=pass header.from=example.net"), DispositionReject},
+		{newARC(Pass, 0, "lists.example.org", "lists.example.org; dmarc=fail header.from=example.com"), DispositionReject},
+	}
+
+	for i, c := range cases {
+		result := v.ValidateWithARC(newTestDMARCMessage("a@example.com"), nil, nil, c.arc)
+		if result.Result != Fail || result.Disposition != c.disposition {
+			t.Errorf("Case %d: expected fail/%s but got %s/%s", i, c.disposition, result.Result, result.Disposition)
+		}
+
+		if c.disposition == DispositionNone {
+			if len(result.Overrides) != 1 || result.Overrides[0].Type != OverrideLocalPolicy {
+				t.Errorf("Case %d: expected local_policy override but got %v", i, result.Overrides)
+			} else {
+				assertStringEquals("arc=pass as[1].d=lists.example.org", result.Overrides[0].Comment, t)
+			}
+		}
+	}
+}
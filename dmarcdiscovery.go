@@ -0,0 +1,228 @@
+package emailauth
+
+import (
+	"context"
+	"strings"
+)
+
+/*
+ * DMARCDiscovery selects how policy records and organizational
+ * domains are discovered. RFC7489Discovery queries the author domain
+ * and then its organizational domain as determined by the Public
+ * Suffix List. TreeWalkDiscovery implements the DNS tree walk of
+ * DMARCbis (draft-ietf-dmarc-dmarcbis, section 4.10), which also
+ * determines organizational domains from the "psd=" tags found on the
+ * way up.
+ */
+type DMARCDiscovery int
+
+const (
+	RFC7489Discovery DMARCDiscovery = iota
+	TreeWalkDiscovery
+)
+
+const treeWalkMaxLabels = 8
+
+// the defaults of the tags added by DMARCbis, applied in tree walk mode
+var treeWalkDefaults = map[string]string{
+	"psd": "u",
+	"t":   "n",
+}
+
+/*
+ * dmarcDiscovery caches the records queried while evaluating a single
+ * message, so that policy discovery and the organizational domain
+ * walks for alignment share their DNS queries.
+ */
+type dmarcDiscovery struct {
+	mode     DMARCDiscovery
+	resolver Resolver
+	psl      *PublicSuffixList
+	records  map[string]*dmarcRecordLookup
+}
+
+type dmarcRecordLookup struct {
+	tags      map[string]string
+	errResult *DMARCResult
+}
+
+func (v DMARCValidator) newDiscovery() *dmarcDiscovery {
+	psl := v.PublicSuffixList
+	if psl == nil {
+		psl = DefaultPublicSuffixList()
+	}
+
+	return &dmarcDiscovery{
+		mode:     v.Discovery,
+		resolver: resolverOrDefault(v.Resolver),
+		psl:      psl,
+		records:  make(map[string]*dmarcRecordLookup),
+	}
+}
+
+/*
+ * Discovers the DMARC policy for the given author domain
+ * (RFC 7489, section 6.6.3). If the domain does not publish a policy,
+ * the policy of its organizational domain, or in tree walk mode the
+ * first policy found further up the tree, is used.
+ */
+func (d *dmarcDiscovery) findPolicy(domain string) (map[string]string, string, *DMARCResult) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	var names []string
+	if d.mode == TreeWalkDiscovery {
+		names = treeWalkNames(domain)
+	} else {
+		names = []string{domain}
+		if orgDomain := d.psl.OrganizationalDomain(domain); orgDomain != domain {
+			names = append(names, orgDomain)
+		}
+	}
+
+	for _, name := range names {
+		tags, errResult := d.lookup(name)
+		if errResult != nil {
+			return nil, "", errResult
+		}
+
+		if tags != nil {
+			return tags, name, nil
+		}
+	}
+
+	return nil, "", newDMARCResult(None, "No DMARC record")
+}
+
+/*
+ * Returns the organizational domain of the given domain. In tree walk
+ * mode this is the first domain with "psd=n" on the way up, the domain
+ * one label below the first one with "psd=y", or otherwise the domain
+ * with the fewest labels that publishes a record.
+ */
+func (d *dmarcDiscovery) organizationalDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if d.mode != TreeWalkDiscovery {
+		return d.psl.OrganizationalDomain(domain)
+	}
+
+	labels := strings.Split(domain, ".")
+	orgDomain := domain
+	for _, name := range treeWalkNames(domain) {
+		tags, errResult := d.lookup(name)
+		if errResult != nil || tags == nil {
+			continue
+		}
+
+		switch tags["psd"] {
+		case "n":
+			return name
+		case "y":
+			n := strings.Count(name, ".") + 2
+			if n > len(labels) {
+				return domain
+			}
+			return strings.Join(labels[len(labels)-n:], ".")
+		}
+		orgDomain = name
+	}
+
+	return orgDomain
+}
+
+/*
+ * Checks identifier alignment (RFC 7489, section 3.1). In strict mode
+ * the domains must be identical, in relaxed mode they must share the
+ * same organizational domain.
+ */
+func (d *dmarcDiscovery) isAligned(domain string, fromDomain string, mode string) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" {
+		return false
+	}
+
+	if mode == "s" || domain == fromDomain {
+		return domain == fromDomain
+	}
+	return d.organizationalDomain(domain) == d.organizationalDomain(fromDomain)
+}
+
+/*
+ * Returns the parsed record of the domain, nil if it has none or an
+ * error result.
+ */
+func (d *dmarcDiscovery) lookup(domain string) (map[string]string, *DMARCResult) {
+	if l, ok := d.records[domain]; ok {
+		return l.tags, l.errResult
+	}
+
+	l := &dmarcRecordLookup{}
+	record, errResult := findDMARCRecord(d.resolver, domain)
+	if errResult != nil {
+		l.errResult = errResult
+	} else if record != "" {
+		tags, err := ParseDMARCRecord(record)
+		if err != nil {
+			l.errResult = newDMARCResult(Permerror, err.Error())
+		} else {
+			if d.mode == TreeWalkDiscovery {
+				for name, value := range treeWalkDefaults {
+					if _, ok := tags[name]; !ok {
+						tags[name] = value
+					}
+				}
+			}
+			l.tags = tags
+		}
+	}
+
+	d.records[domain] = l
+	return l.tags, l.errResult
+}
+
+/*
+ * Returns the names queried by the DNS tree walk, starting with the
+ * domain itself. Domains with more than eight labels are shortened to
+ * their seven right-most labels after the first query, then labels are
+ * removed one at a time down to the top-level domain.
+ */
+func treeWalkNames(domain string) []string {
+	labels := strings.Split(domain, ".")
+	names := []string{domain}
+	for len(labels) > 1 {
+		if len(labels) > treeWalkMaxLabels {
+			labels = labels[len(labels)-treeWalkMaxLabels+1:]
+		} else {
+			labels = labels[1:]
+		}
+		names = append(names, strings.Join(labels, "."))
+	}
+	return names
+}
+
+/*
+ * Returns the DMARC record published for the domain, an empty string
+ * if there is none or an error result.
+ */
+func findDMARCRecord(resolver Resolver, domain string) (string, *DMARCResult) {
+	records, err := resolver.LookupTXT(context.Background(), "_dmarc."+domain)
+	if err != nil {
+		if isTemporaryDNSError(err) {
+			return "", newDMARCResult(Temperror, err.Error())
+		}
+		return "", nil
+	}
+
+	var record string
+	for _, r := range records {
+		if !isDMARCRecord(r) {
+			continue
+		}
+
+		// RFC 7489, section 6.6.3: multiple records mean no policy
+		if record != "" {
+			return "", newDMARCResult(None, "Multiple DMARC records")
+		}
+		record = r
+	}
+
+	return record, nil
+}
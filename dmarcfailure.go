@@ -0,0 +1,329 @@
+package emailauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+ * DMARC failure reports (RFC 7489, section 7.3) in the Authentication
+ * Failure Reporting Format (RFC 6591).
+ *
+ * Content-Type: multipart/report; report-type=feedback-report; boundary=...
+ *
+ *  text/plain                human readable description
+ *  message/feedback-report   Feedback-Type: auth-failure, Auth-Failure: dmarc, ...
+ *  message/rfc822            the original message (text/rfc822-headers in header-only mode)
+ */
+
+/*
+ * FailureReporter generates failure reports for messages whose DMARC
+ * policy requests them. RedactLocalPart, if set, replaces the local
+ * parts of the envelope addresses and of the address header fields of
+ * the original message (RFC 6590). In header-only mode the body of the
+ * original message is not included. Reports are only generated for
+ * authorized destinations, which are verified using the DNS settings
+ * of Validator, and whose size limit ("!" suffix of the URI) the report
+ * does not exceed.
+ */
+type FailureReporter struct {
+	Validator       DMARCValidator
+	ReportingMTA    string
+	From            string
+	RedactLocalPart func(localPart string) string
+	HeadersOnly     bool
+	Now             func() time.Time
+}
+
+type FailureReport struct {
+	Destinations []*ReportURI // authorized ruf URIs of the policy record accepting the report
+	Data         []byte
+}
+
+// header fields of the original message containing addresses
+var redactedHeaders = []string{"From", "Sender", "Reply-To", "To", "Cc", "Bcc", "Return-Path", "Delivered-To"}
+
+var addressPattern = regexp.MustCompile(`[^\s<>()\[\]",;:@]+@[A-Za-z0-9.-]+`)
+
+/*
+ * Returns a redaction function replacing local parts by a keyed hash,
+ * so that reports concerning the same address can still be correlated.
+ */
+func NewLocalPartRedactor(secret []byte) func(localPart string) string {
+	return func(localPart string) string {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(localPart))
+		return "redacted-" + hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+}
+
+/*
+ * Generates a failure report for a message, or returns nil if the
+ * policy does not request one for the given results or no destination
+ * accepts its size. The body of the message is read unless in
+ * header-only mode.
+ */
+func (r *FailureReporter) Generate(message *Message, envelope *Envelope, result *DMARCResult) (*FailureReport, error) {
+	return r.GenerateContext(context.Background(), message, envelope, result)
+}
+
+/*
+ * Like Generate, verifying the report destinations with ctx.
+ */
+func (r *FailureReporter) GenerateContext(ctx context.Context, message *Message, envelope *Envelope, result *DMARCResult) (*FailureReport, error) {
+	if result.Tags["ruf"] == "" || !failureReportRequested(result) {
+		return nil, nil
+	}
+
+	destinations := r.Validator.AuthorizedReportURIsContext(ctx, result.PolicyDomain, "ruf", result.Tags["ruf"])
+	var addresses []string
+	for _, uri := range destinations {
+		if uri.Scheme == "mailto" {
+			addresses = append(addresses, uri.Address)
+		}
+	}
+
+	if len(addresses) == 0 {
+		return nil, nil
+	}
+
+	if envelope == nil {
+		envelope = &Envelope{}
+	}
+
+	now := r.now()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	text := textproto.MIMEHeader{}
+	text.Set("Content-Type", "text/plain; charset=us-ascii")
+	w, err := mw.CreatePart(text)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(w, "This is an authentication failure report for an email message received from IP\r\n"+
+		"%s on %s.\r\n", envelope.ClientIP, now.Format(time.RFC1123Z))
+
+	feedback := textproto.MIMEHeader{}
+	feedback.Set("Content-Type", "message/feedback-report")
+	w, err = mw.CreatePart(feedback)
+	if err != nil {
+		return nil, err
+	}
+	r.writeFeedbackReport(w, envelope, result, now)
+
+	original := textproto.MIMEHeader{}
+	if r.HeadersOnly {
+		original.Set("Content-Type", "text/rfc822-headers")
+	} else {
+		original.Set("Content-Type", "message/rfc822")
+	}
+	w, err = mw.CreatePart(original)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.writeOriginal(w, message); err != nil {
+		return nil, err
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	messageID := randomID()
+	writeHeader := func(w io.Writer, addresses []string) {
+		fmt.Fprintf(w, "From: %s\r\n", r.From)
+		fmt.Fprintf(w, "To: %s\r\n", strings.Join(addresses, ", "))
+		fmt.Fprintf(w, "Subject: DMARC Failure Report for %s\r\n", result.Domain)
+		fmt.Fprintf(w, "Date: %s\r\n", now.Format(time.RFC1123Z))
+		fmt.Fprintf(w, "Message-ID: <%s@%s>\r\n", messageID, r.ReportingMTA)
+		fmt.Fprintf(w, "MIME-Version: 1.0\r\n")
+		fmt.Fprintf(w, "Content-Type: multipart/report; report-type=feedback-report; boundary=\"%s\"\r\n\r\n", mw.Boundary())
+	}
+
+	// the size limits apply to the whole report, measured with all addresses
+	var header bytes.Buffer
+	writeHeader(&header, addresses)
+	destinations = acceptingReportURIs(destinations, int64(header.Len()+body.Len()))
+	addresses = addresses[:0]
+	for _, uri := range destinations {
+		if uri.Scheme == "mailto" {
+			addresses = append(addresses, uri.Address)
+		}
+	}
+
+	if len(addresses) == 0 {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	writeHeader(&buf, addresses)
+	buf.Write(body.Bytes())
+	return &FailureReport{Destinations: destinations, Data: buf.Bytes()}, nil
+}
+
+func (r *FailureReporter) writeFeedbackReport(w io.Writer, envelope *Envelope, result *DMARCResult, now time.Time) {
+	fmt.Fprintf(w, "Feedback-Type: auth-failure\r\n")
+	fmt.Fprintf(w, "User-Agent: emailauth/1.0\r\n")
+	fmt.Fprintf(w, "Version: 1\r\n")
+	if envelope.MailFrom != "" {
+		fmt.Fprintf(w, "Original-Mail-From: <%s>\r\n", r.redactAddress(envelope.MailFrom))
+	}
+	for _, rcpt := range envelope.RcptTo {
+		fmt.Fprintf(w, "Original-Rcpt-To: <%s>\r\n", r.redactAddress(rcpt))
+	}
+	fmt.Fprintf(w, "Arrival-Date: %s\r\n", now.Format(time.RFC1123Z))
+	if r.ReportingMTA != "" {
+		fmt.Fprintf(w, "Reporting-MTA: dns; %s\r\n", r.ReportingMTA)
+	}
+	if envelope.ClientIP != nil {
+		fmt.Fprintf(w, "Source-IP: %s\r\n", envelope.ClientIP)
+	}
+	fmt.Fprintf(w, "Authentication-Results: %s\r\n", (&AuthenticationResults{AuthServID: r.ReportingMTA, SPF: result.SPF, DKIM: result.DKIM, DMARC: result}).String())
+	fmt.Fprintf(w, "Reported-Domain: %s\r\n", result.Domain)
+	fmt.Fprintf(w, "Delivery-Result: %s\r\n", deliveryResult(result.Disposition))
+	fmt.Fprintf(w, "Auth-Failure: dmarc\r\n")
+
+	for _, dkim := range result.DKIM {
+		if dkim.Result == Pass || dkim.Tags["d"] == "" {
+			continue
+		}
+
+		fmt.Fprintf(w, "DKIM-Domain: %s\r\n", dkim.Tags["d"])
+		if identity := dkim.Tags["i"]; identity != "" {
+			fmt.Fprintf(w, "DKIM-Identity: %s\r\n", r.redactAddress(identity))
+		}
+		fmt.Fprintf(w, "DKIM-Selector: %s\r\n", dkim.Tags["s"])
+	}
+
+	var aligned []string
+	if result.Alignment[dkimAlignment] != "" {
+		aligned = append(aligned, "dkim")
+	}
+	if result.Alignment[spfAlignment] != "" {
+		aligned = append(aligned, "spf")
+	}
+	if len(aligned) == 0 {
+		aligned = append(aligned, "none")
+	}
+	fmt.Fprintf(w, "Identity-Alignment: %s\r\n", strings.Join(aligned, ", "))
+}
+
+/*
+ * Writes the header fields of the original message and, unless in
+ * header-only mode, its body.
+ */
+func (r *FailureReporter) writeOriginal(w io.Writer, message *Message) error {
+	for _, field := range message.Fields() {
+		raw := field.Raw
+		if containsFold(redactedHeaders, field.Name) {
+			raw = r.redactAddresses(raw)
+		}
+		fmt.Fprintf(w, "%s\r\n", raw)
+	}
+
+	if r.HeadersOnly || message.Body == nil {
+		return nil
+	}
+
+	io.WriteString(w, "\r\n")
+	_, err := io.Copy(w, message.Body)
+	return err
+}
+
+func (r *FailureReporter) redactAddresses(value string) string {
+	if r.RedactLocalPart == nil {
+		return value
+	}
+	return addressPattern.ReplaceAllStringFunc(value, r.redactAddress)
+}
+
+func (r *FailureReporter) redactAddress(address string) string {
+	idx := strings.LastIndexByte(address, '@')
+	if r.RedactLocalPart == nil || idx < 0 {
+		return address
+	}
+	return r.RedactLocalPart(address[:idx]) + address[idx:]
+}
+
+func (r *FailureReporter) now() time.Time {
+	if r.Now == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
+
+/*
+ * Checks the failure reporting options ("fo=") of the policy against
+ * the results (RFC 7489, section 6.3):
+ *
+ *  0  all underlying mechanisms failed to produce an aligned pass
+ *  1  any underlying mechanism failed to produce an aligned pass
+ *  d  a DKIM signature failed to verify, regardless of alignment
+ *  s  SPF evaluation failed, regardless of alignment
+ */
+func failureReportRequested(result *DMARCResult) bool {
+	spfAligned := result.Alignment[spfAlignment] != ""
+	dkimAligned := result.Alignment[dkimAlignment] != ""
+
+	for _, option := range splitColonList(result.Tags["fo"]) {
+		switch strings.ToLower(option) {
+		case "0":
+			if !spfAligned && !dkimAligned {
+				return true
+			}
+		case "1":
+			if !spfAligned || !dkimAligned {
+				return true
+			}
+		case "d":
+			for _, r := range result.DKIM {
+				if isAuthFailure(r.Result) {
+					return true
+				}
+			}
+		case "s":
+			if result.SPF != nil && isAuthFailure(result.SPF.Result) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isAuthFailure(result Result) bool {
+	return result == Fail || result == Softfail || result == Permerror
+}
+
+/*
+ * Maps the applied disposition to the Delivery-Result of RFC 6591.
+ */
+func deliveryResult(disposition Disposition) string {
+	switch disposition {
+	case DispositionNone:
+		return "delivered"
+	case DispositionQuarantine:
+		return "spam"
+	case DispositionReject:
+		return "reject"
+	}
+	return "other"
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
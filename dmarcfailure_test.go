@@ -0,0 +1,147 @@
+package emailauth
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func newTestFailureResult(fo string, spf Result, dkim Result) *DMARCResult {
+	tags, _ := ParseDMARCRecord("v=DMARC1; p=reject; ruf=mailto:ruf@example.com!10m; fo=" + fo)
+	result := newTestReportResult("mailto:rua@example.com", spf, dkim)
+	result.Tags = tags
+	return result
+}
+
+func TestFailureReportOptions(t *testing.T) {
+	tests := []struct {
+		fo       string
+		spf      Result
+		dkim     Result
+		expected bool
+	}{
+		{"0", Fail, Fail, true},
+		{"0", Fail, Pass, false},
+		{"1", Fail, Pass, true},
+		{"1", Pass, Fail, true},
+		{"d", Pass, Fail, true},
+		{"d", Fail, Pass, false},
+		{"s", Fail, Pass, true},
+		{"s", Pass, Fail, false},
+		{"0:s", Softfail, Pass, true},
+	}
+
+	for _, test := range tests {
+		result := newTestFailureResult(test.fo, test.spf, test.dkim)
+		if requested := failureReportRequested(result); requested != test.expected {
+			t.Errorf("fo=%s spf=%s dkim=%s: expected %v, got %v", test.fo, test.spf, test.dkim, test.expected, requested)
+		}
+	}
+}
+
+func TestFailureReport(t *testing.T) {
+	message := newTestDMARCMessage("Alice <alice@example.com>")
+	message.Headers.Set("To", "bob@example.net, Carol <carol@example.net>")
+	message.Headers.Set("Subject", "Hello")
+	message.Body = strings.NewReader("Hello Bob\r\n")
+
+	reporter := &FailureReporter{
+		ReportingMTA:    "mx.example.net",
+		From:            "dmarc@mx.example.net",
+		RedactLocalPart: func(string) string { return "xxx" },
+	}
+	envelope := &Envelope{ClientIP: net.ParseIP("192.0.2.1"), MailFrom: "alice@example.com", RcptTo: []string{"bob@example.net"}}
+
+	report, err := reporter.Generate(message, envelope, newTestFailureResult("0", Fail, Fail))
+	if err != nil || report == nil {
+		t.Fatalf("Expected report, got %v (%v)", report, err)
+	}
+	if len(report.Destinations) != 1 || report.Destinations[0].Address != "ruf@example.com" || report.Destinations[0].MaxSize != 10<<20 {
+		t.Errorf("Unexpected destinations: %v", report.Destinations)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(report.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStringEquals("ruf@example.com", msg.Header.Get("To"), t)
+
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assertStringEquals("multipart/report", mediaType, t)
+	assertStringEquals("feedback-report", params["report-type"], t)
+
+	var parts []string
+	var types []string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(part)
+		parts = append(parts, string(data))
+		types = append(types, part.Header.Get("Content-Type"))
+	}
+
+	if len(parts) != 3 {
+		t.Fatalf("Expected 3 parts, got %d", len(parts))
+	}
+	assertStringEquals("message/feedback-report", types[1], t)
+	assertStringEquals("message/rfc822", types[2], t)
+
+	for _, s := range []string{"Feedback-Type: auth-failure", "Auth-Failure: dmarc", "Source-IP: 192.0.2.1",
+		"Original-Mail-From: <xxx@example.com>", "Original-Rcpt-To: <xxx@example.net>", "Reported-Domain: example.com",
+		"Delivery-Result: reject", "DKIM-Domain: example.com", "Identity-Alignment: none"} {
+		if !strings.Contains(parts[1], s) {
+			t.Errorf("Feedback report does not contain %q", s)
+		}
+	}
+
+	for _, s := range []string{"From: Alice <xxx@example.com>", "To: xxx@example.net, Carol <xxx@example.net>", "Subject: Hello", "Hello Bob"} {
+		if !strings.Contains(parts[2], s) {
+			t.Errorf("Original message does not contain %q", s)
+		}
+	}
+
+	reporter.HeadersOnly = true
+	message.Body = strings.NewReader("Hello Bob\r\n")
+	report, _ = reporter.Generate(message, envelope, newTestFailureResult("0", Fail, Fail))
+	if !bytes.Contains(report.Data, []byte("text/rfc822-headers")) || bytes.Contains(report.Data, []byte("Hello Bob")) {
+		t.Error("Expected header-only report")
+	}
+
+	// destinations with a smaller size limit are left out
+	limited := newTestFailureResult("0", Fail, Fail)
+	limited.Tags["ruf"] = "mailto:ruf@example.com!10m,mailto:small@example.com!100"
+	message.Body = strings.NewReader("Hello Bob\r\n")
+	report, err = reporter.Generate(message, envelope, limited)
+	if err != nil || report == nil || len(report.Destinations) != 1 || report.Destinations[0].Address != "ruf@example.com" || bytes.Contains(report.Data, []byte("small@")) {
+		t.Errorf("Expected report to ruf@example.com only, got %+v (%v)", report, err)
+	}
+
+	limited.Tags["ruf"] = "mailto:small@example.com!100"
+	message.Body = strings.NewReader("Hello Bob\r\n")
+	if report, err = reporter.Generate(message, envelope, limited); report != nil || err != nil {
+		t.Error("Expected no report exceeding the size limit")
+	}
+
+	report, err = reporter.Generate(message, envelope, newTestFailureResult("0", Pass, Pass))
+	if report != nil || err != nil {
+		t.Error("Expected no report for passing message")
+	}
+}
+
+func TestLocalPartRedactor(t *testing.T) {
+	redact := NewLocalPartRedactor([]byte("secret"))
+	if redact("alice") != redact("alice") || redact("alice") == redact("bob") || strings.Contains(redact("alice"), "alice") {
+		t.Error("Unexpected redaction")
+	}
+}
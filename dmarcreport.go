@@ -0,0 +1,521 @@
+package emailauth
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * DMARC aggregate reports (RFC 7489, section 7.2 and appendix C).
+ *
+ * <feedback>
+ *   <report_metadata>
+ *     <org_name>mx.example.com</org_name>
+ *     <email>dmarc-reports@mx.example.com</email>
+ *     <report_id>example.com.1467244800</report_id>
+ *     <date_range><begin>1467244800</begin><end>1467331200</end></date_range>
+ *   </report_metadata>
+ *   <policy_published>
+ *     <domain>example.com</domain><adkim>r</adkim><aspf>r</aspf>
+ *     <p>reject</p><sp>reject</sp><pct>100</pct>
+ *   </policy_published>
+ *   <record>
+ *     <row>
+ *       <source_ip>192.0.2.1</source_ip><count>2</count>
+ *       <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>fail</spf></policy_evaluated>
+ *     </row>
+ *     <identifiers><header_from>example.com</header_from></identifiers>
+ *     <auth_results>
+ *       <dkim><domain>example.com</domain><selector>sel</selector><result>pass</result></dkim>
+ *       <spf><domain>bounces.example.net</domain><scope>mfrom</scope><result>pass</result></spf>
+ *     </auth_results>
+ *   </record>
+ * </feedback>
+ */
+
+type AggregateReport struct {
+	XMLName  xml.Name        `xml:"feedback"`
+	Version  string          `xml:"version,omitempty"`
+	Metadata ReportMetadata  `xml:"report_metadata"`
+	Policy   PolicyPublished `xml:"policy_published"`
+	Records  []ReportRecord  `xml:"record"`
+
+	// authorized rua URIs of the policy record accepting the size of the
+	// compressed report, not part of the report
+	Destinations []*ReportURI `xml:"-"`
+}
+
+type ReportMetadata struct {
+	OrgName          string    `xml:"org_name"`
+	Email            string    `xml:"email"`
+	ExtraContactInfo string    `xml:"extra_contact_info,omitempty"`
+	ReportID         string    `xml:"report_id"`
+	DateRange        DateRange `xml:"date_range"`
+	Errors           []string  `xml:"error,omitempty"`
+}
+
+type DateRange struct {
+	Begin int64 `xml:"begin"`
+	End   int64 `xml:"end"`
+}
+
+type PolicyPublished struct {
+	Domain string `xml:"domain"`
+	ADKIM  string `xml:"adkim,omitempty"`
+	ASPF   string `xml:"aspf,omitempty"`
+	P      string `xml:"p"`
+	SP     string `xml:"sp,omitempty"`
+	Pct    string `xml:"pct,omitempty"`
+	FO     string `xml:"fo,omitempty"`
+}
+
+type ReportRecord struct {
+	Row         ReportRow         `xml:"row"`
+	Identifiers ReportIdentifiers `xml:"identifiers"`
+	AuthResults ReportAuthResults `xml:"auth_results"`
+}
+
+type ReportRow struct {
+	SourceIP        string          `xml:"source_ip"`
+	Count           int             `xml:"count"`
+	PolicyEvaluated PolicyEvaluated `xml:"policy_evaluated"`
+}
+
+type PolicyEvaluated struct {
+	Disposition string                 `xml:"disposition"`
+	DKIM        string                 `xml:"dkim"`
+	SPF         string                 `xml:"spf"`
+	Reasons     []PolicyOverrideReason `xml:"reason,omitempty"`
+}
+
+type PolicyOverrideReason struct {
+	Type    PolicyOverride `xml:"type"`
+	Comment string         `xml:"comment,omitempty"`
+}
+
+type ReportIdentifiers struct {
+	EnvelopeTo   string `xml:"envelope_to,omitempty"`
+	EnvelopeFrom string `xml:"envelope_from,omitempty"`
+	HeaderFrom   string `xml:"header_from"`
+}
+
+type ReportAuthResults struct {
+	DKIM []DKIMAuthResult `xml:"dkim"`
+	SPF  []SPFAuthResult  `xml:"spf"`
+}
+
+type DKIMAuthResult struct {
+	Domain      string `xml:"domain"`
+	Selector    string `xml:"selector,omitempty"`
+	Result      string `xml:"result"`
+	HumanResult string `xml:"human_result,omitempty"`
+}
+
+type SPFAuthResult struct {
+	Domain string `xml:"domain"`
+	Scope  string `xml:"scope,omitempty"`
+	Result string `xml:"result"`
+}
+
+/*
+ * Returns the XML document of the report.
+ */
+func (r *AggregateReport) XML() ([]byte, error) {
+	data, err := xml.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+/*
+ * Returns the gzip-compressed XML document of the report.
+ */
+func (r *AggregateReport) Gzip() ([]byte, error) {
+	data, err := r.XML()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+ * Returns the file name of the gzip-compressed report
+ * (RFC 7489, section 7.2.1.1).
+ */
+func (r *AggregateReport) Filename(receiver string) string {
+	return fmt.Sprintf("%s!%s!%d!%d.xml.gz", receiver, r.Policy.Domain, r.Metadata.DateRange.Begin, r.Metadata.DateRange.End)
+}
+
+/*
+ * ReportEntry is a single evaluated message as recorded for aggregate
+ * reporting.
+ */
+type ReportEntry struct {
+	Received     time.Time
+	SourceIP     net.IP
+	EnvelopeTo   string
+	EnvelopeFrom string
+	Result       *DMARCResult
+}
+
+/*
+ * ReportStore keeps report entries until they are reported. Entries
+ * are grouped by the domain that published the DMARC policy.
+ */
+type ReportStore interface {
+	Add(entry *ReportEntry) error
+	Domains() ([]string, error)
+	// Removes and returns the entries of a domain for which due returns true.
+	Take(domain string, due func(*ReportEntry) bool) ([]*ReportEntry, error)
+}
+
+type MemoryReportStore struct {
+	mu      sync.Mutex
+	entries map[string][]*ReportEntry
+}
+
+func NewMemoryReportStore() *MemoryReportStore {
+	return &MemoryReportStore{entries: make(map[string][]*ReportEntry)}
+}
+
+func (s *MemoryReportStore) Add(entry *ReportEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	domain := entry.Result.PolicyDomain
+	s.entries[domain] = append(s.entries[domain], entry)
+	return nil
+}
+
+func (s *MemoryReportStore) Domains() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	domains := make([]string, 0, len(s.entries))
+	for domain := range s.entries {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains, nil
+}
+
+func (s *MemoryReportStore) Take(domain string, due func(*ReportEntry) bool) ([]*ReportEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var taken, kept []*ReportEntry
+	for _, e := range s.entries[domain] {
+		if due(e) {
+			taken = append(taken, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(s.entries, domain)
+	} else {
+		s.entries[domain] = kept
+	}
+	return taken, nil
+}
+
+/*
+ * AggregateReporter records DMARC results and produces aggregate
+ * reports per policy domain. Reporting intervals follow the "ri=" tag
+ * of the policy, limited to between one hour and one day, and are
+ * aligned to multiples of the interval since the epoch (UTC). Reports
+ * are only produced for authorized destinations, which are verified
+ * using the DNS settings of Validator, and whose size limit ("!" suffix
+ * of the URI) the compressed report does not exceed.
+ */
+type AggregateReporter struct {
+	Store            ReportStore
+	Validator        DMARCValidator
+	OrgName          string
+	Email            string
+	ExtraContactInfo string
+	CheckInterval    time.Duration
+	Now              func() time.Time
+}
+
+const (
+	minReportInterval     = time.Hour
+	maxReportInterval     = 24 * time.Hour
+	defaultCheckInterval  = 5 * time.Minute
+	aggregateReportFormat = "1.0"
+)
+
+/*
+ * Records the result of a message for reporting. Results without a
+ * policy requesting aggregate reports are ignored.
+ */
+func (r *AggregateReporter) Record(sourceIP net.IP, envelopeTo string, result *DMARCResult) error {
+	if result.PolicyDomain == "" || result.Tags["rua"] == "" {
+		return nil
+	}
+
+	entry := &ReportEntry{Received: r.now(), SourceIP: sourceIP, EnvelopeTo: envelopeTo, Result: result}
+	if result.SPF != nil {
+		entry.EnvelopeFrom = result.SPF.Domain
+	}
+	return r.Store.Add(entry)
+}
+
+/*
+ * Returns the reports of all intervals that ended before the given
+ * time. The entries contained in them are removed from the store.
+ */
+func (r *AggregateReporter) DueReports(now time.Time) ([]*AggregateReport, error) {
+	return r.DueReportsContext(context.Background(), now)
+}
+
+/*
+ * Like DueReports, verifying the report destinations with ctx.
+ */
+func (r *AggregateReporter) DueReportsContext(ctx context.Context, now time.Time) ([]*AggregateReport, error) {
+	domains, err := r.Store.Domains()
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []*AggregateReport
+	for _, domain := range domains {
+		entries, err := r.Store.Take(domain, func(e *ReportEntry) bool {
+			interval := reportInterval(e.Result.Tags["ri"])
+			return !reportIntervalBegin(e.Received, interval).Add(interval).After(now)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		intervals := make(map[int64][]*ReportEntry)
+		for _, e := range entries {
+			begin := reportIntervalBegin(e.Received, reportInterval(e.Result.Tags["ri"])).Unix()
+			intervals[begin] = append(intervals[begin], e)
+		}
+
+		begins := make([]int64, 0, len(intervals))
+		for begin := range intervals {
+			begins = append(begins, begin)
+		}
+		sort.Slice(begins, func(i, j int) bool { return begins[i] < begins[j] })
+
+		for _, begin := range begins {
+			if report := r.buildReport(ctx, domain, intervals[begin]); len(report.Destinations) > 0 {
+				reports = append(reports, report)
+			}
+		}
+	}
+
+	return reports, nil
+}
+
+/*
+ * Periodically delivers due reports until the context is done.
+ * Reports that could not be delivered are dropped.
+ */
+func (r *AggregateReporter) Run(ctx context.Context, deliver func(*AggregateReport) error) error {
+	interval := r.CheckInterval
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			reports, err := r.DueReportsContext(ctx, r.now())
+			if err != nil {
+				return err
+			}
+
+			for _, report := range reports {
+				deliver(report)
+			}
+		}
+	}
+}
+
+func (r *AggregateReporter) buildReport(ctx context.Context, domain string, entries []*ReportEntry) *AggregateReport {
+	latest := entries[len(entries)-1].Result
+	interval := reportInterval(latest.Tags["ri"])
+	begin := reportIntervalBegin(entries[0].Received, interval)
+
+	report := &AggregateReport{Version: aggregateReportFormat}
+	report.Metadata = ReportMetadata{
+		OrgName:          r.OrgName,
+		Email:            r.Email,
+		ExtraContactInfo: r.ExtraContactInfo,
+		ReportID:         fmt.Sprintf("%s.%d", domain, begin.Unix()),
+		DateRange:        DateRange{Begin: begin.Unix(), End: begin.Add(interval).Unix() - 1},
+	}
+
+	report.Policy = PolicyPublished{
+		Domain: domain,
+		ADKIM:  latest.Tags["adkim"],
+		ASPF:   latest.Tags["aspf"],
+		P:      latest.Tags["p"],
+		SP:     latest.Tags["sp"],
+		Pct:    latest.Tags["pct"],
+		FO:     latest.Tags["fo"],
+	}
+
+	report.Destinations = r.Validator.AuthorizedReportURIsContext(ctx, domain, "rua", latest.Tags["rua"])
+
+	index := make(map[reportRecordKey]int)
+	for _, e := range entries {
+		record := newReportRecord(e)
+		key := newReportRecordKey(record)
+		if i, ok := index[key]; ok {
+			report.Records[i].Row.Count++
+			continue
+		}
+
+		record.Row.Count = 1
+		index[key] = len(report.Records)
+		report.Records = append(report.Records, record)
+	}
+
+	if data, err := report.Gzip(); err == nil {
+		report.Destinations = acceptingReportURIs(report.Destinations, int64(len(data)))
+	}
+	return report
+}
+
+func newReportRecord(e *ReportEntry) ReportRecord {
+	result := e.Result
+	record := ReportRecord{}
+	if e.SourceIP != nil {
+		record.Row.SourceIP = e.SourceIP.String()
+	}
+
+	record.Row.PolicyEvaluated = PolicyEvaluated{
+		Disposition: result.Disposition.String(),
+		DKIM:        alignedResult(result.Alignment[dkimAlignment]),
+		SPF:         alignedResult(result.Alignment[spfAlignment]),
+		Reasons:     result.Overrides,
+	}
+
+	record.Identifiers = ReportIdentifiers{EnvelopeTo: e.EnvelopeTo, EnvelopeFrom: e.EnvelopeFrom, HeaderFrom: result.Domain}
+	for _, r := range result.DKIM {
+		if r.Tags["d"] == "" {
+			continue
+		}
+
+		record.AuthResults.DKIM = append(record.AuthResults.DKIM, DKIMAuthResult{
+			Domain:      r.Tags["d"],
+			Selector:    r.Tags["s"],
+			Result:      r.Result.String(),
+			HumanResult: r.Reason,
+		})
+	}
+
+	spf := SPFAuthResult{Domain: e.EnvelopeFrom, Scope: "mfrom", Result: None.String()}
+	if result.SPF != nil {
+		spf.Result = result.SPF.Result.String()
+	}
+	record.AuthResults.SPF = []SPFAuthResult{spf}
+	return record
+}
+
+/*
+ * reportRecordKey identifies the records counted in the same row: all
+ * fields of a record but the count, with the fields of the listed
+ * reasons and authentication results joined.
+ */
+type reportRecordKey struct {
+	sourceIP     string
+	disposition  string
+	dkim         string
+	spf          string
+	reasons      string
+	envelopeTo   string
+	envelopeFrom string
+	headerFrom   string
+	dkimResults  string
+	spfResults   string
+}
+
+func newReportRecordKey(record ReportRecord) reportRecordKey {
+	evaluated := record.Row.PolicyEvaluated
+	key := reportRecordKey{
+		sourceIP:     record.Row.SourceIP,
+		disposition:  evaluated.Disposition,
+		dkim:         evaluated.DKIM,
+		spf:          evaluated.SPF,
+		envelopeTo:   record.Identifiers.EnvelopeTo,
+		envelopeFrom: record.Identifiers.EnvelopeFrom,
+		headerFrom:   record.Identifiers.HeaderFrom,
+	}
+
+	var reasons, dkim, spf []string
+	for _, r := range evaluated.Reasons {
+		reasons = append(reasons, string(r.Type), r.Comment)
+	}
+	for _, r := range record.AuthResults.DKIM {
+		dkim = append(dkim, r.Domain, r.Selector, r.Result, r.HumanResult)
+	}
+	for _, r := range record.AuthResults.SPF {
+		spf = append(spf, r.Domain, r.Scope, r.Result)
+	}
+	key.reasons = strings.Join(reasons, "\x00")
+	key.dkimResults = strings.Join(dkim, "\x00")
+	key.spfResults = strings.Join(spf, "\x00")
+	return key
+}
+
+func alignedResult(identifier string) string {
+	if identifier == "" {
+		return Fail.String()
+	}
+	return Pass.String()
+}
+
+func reportInterval(ri string) time.Duration {
+	var seconds int64
+	fmt.Sscanf(ri, "%d", &seconds)
+	interval := time.Duration(seconds) * time.Second
+	if interval < minReportInterval {
+		return minReportInterval
+	}
+	if interval > maxReportInterval {
+		return maxReportInterval
+	}
+	return interval
+}
+
+/*
+ * Returns the begin of the reporting interval containing t, counted in
+ * whole intervals since the epoch.
+ */
+func reportIntervalBegin(t time.Time, interval time.Duration) time.Time {
+	seconds := int64(interval / time.Second)
+	return time.Unix(t.Unix()-t.Unix()%seconds, 0).UTC()
+}
+
+func (r *AggregateReporter) now() time.Time {
+	if r.Now == nil {
+		return time.Now().UTC()
+	}
+	return r.Now().UTC()
+}
@@ -0,0 +1,184 @@
+package emailauth
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestReportResult(rua string, spf Result, dkim Result) *DMARCResult {
+	tags, _ := ParseDMARCRecord("v=DMARC1; p=reject; ri=3600; rua=" + rua)
+	result := newDMARCResult(Fail, "No aligned identifier")
+	result.Domain = "example.com"
+	result.PolicyDomain = "example.com"
+	result.Tags = tags
+	result.SPF = &SPFResult{Result: spf, Domain: "example.com"}
+	result.DKIM = []*DKIMResult{{Result: dkim, Tags: map[string]string{"d": "example.com", "s": "sel"}}}
+	result.Disposition = DispositionReject
+	if dkim == Pass {
+		result.Result = Pass
+		result.Alignment[dkimAlignment] = "example.com"
+		result.Disposition = DispositionNone
+	}
+	return result
+}
+
+func TestAggregateReport(t *testing.T) {
+	now := time.Unix(1467244800, 0).UTC()
+	r := &AggregateReporter{
+		Store:   NewMemoryReportStore(),
+		OrgName: "mx.example.net",
+		Email:   "dmarc@mx.example.net",
+		Now:     func() time.Time { return now },
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	r.Record(ip, "example.net", newTestReportResult("mailto:dmarc@example.com", Fail, Pass))
+	now = now.Add(10 * time.Minute)
+	r.Record(ip, "example.net", newTestReportResult("mailto:dmarc@example.com", Fail, Pass))
+	forwarded := newTestReportResult("mailto:dmarc@example.com", Pass, Fail)
+	forwarded.Overrides = []PolicyOverrideReason{{Type: OverrideForwarded, Comment: "relay.example.net"}}
+	r.Record(ip, "example.net", forwarded)
+
+	noRUA := newTestReportResult("mailto:dmarc@example.com", Pass, Pass)
+	delete(noRUA.Tags, "rua")
+	r.Record(ip, "example.net", noRUA)
+
+	reports, err := r.DueReports(now.Add(30 * time.Minute))
+	if err != nil || len(reports) != 0 {
+		t.Fatalf("Expected no due reports, got %d (%v)", len(reports), err)
+	}
+
+	reports, err = r.DueReports(now.Add(time.Hour))
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("Expected one due report, got %d (%v)", len(reports), err)
+	}
+
+	report := reports[0]
+	assertStringEquals("example.com.1467244800", report.Metadata.ReportID, t)
+	if len(report.Destinations) != 1 || report.Destinations[0].URI != "mailto:dmarc@example.com" {
+		t.Errorf("Unexpected destinations: %v", report.Destinations)
+	}
+	assertStringEquals("mx.example.net!example.com!1467244800!1467248399.xml.gz", report.Filename("mx.example.net"), t)
+	assertStringEquals("reject", report.Policy.P, t)
+
+	if len(report.Records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(report.Records))
+	}
+
+	row := report.Records[0].Row
+	if row.Count != 2 || row.SourceIP != "192.0.2.1" || row.PolicyEvaluated.DKIM != "pass" || row.PolicyEvaluated.SPF != "fail" {
+		t.Errorf("Unexpected row: %+v", row)
+	}
+
+	row = report.Records[1].Row
+	if row.Count != 1 || row.PolicyEvaluated.Disposition != "reject" || len(row.PolicyEvaluated.Reasons) != 1 {
+		t.Errorf("Unexpected row: %+v", row)
+	}
+
+	data, err := report.Gzip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xml, _ := io.ReadAll(gz)
+	// the elements of the RFC 7489 schema only, in its order
+	if p, sp, pct := bytes.Index(xml, []byte("<p>")), bytes.Index(xml, []byte("<sp>")), bytes.Index(xml, []byte("<pct>")); p < 0 || sp < p || pct < sp || bytes.Contains(xml, []byte("<np>")) {
+		t.Errorf("Unexpected published policy: %s", xml)
+	}
+	for _, s := range []string{"<feedback>", "<org_name>mx.example.net</org_name>", "<selector>sel</selector>", "<scope>mfrom</scope>", "<type>forwarded</type>"} {
+		if !bytes.Contains(xml, []byte(s)) {
+			t.Errorf("Report does not contain %s", s)
+		}
+	}
+
+	reports, _ = r.DueReports(now.Add(48 * time.Hour))
+	if len(reports) != 0 {
+		t.Errorf("Expected entries to be removed after reporting, got %d reports", len(reports))
+	}
+}
+
+func TestAggregateReportSizeLimit(t *testing.T) {
+	now := time.Unix(1467244800, 0).UTC()
+	r := &AggregateReporter{Store: NewMemoryReportStore(), OrgName: "mx.example.net", Email: "dmarc@mx.example.net", Now: func() time.Time { return now }}
+
+	r.Record(net.ParseIP("192.0.2.1"), "example.net", newTestReportResult("mailto:dmarc@example.com!1k,mailto:small@example.com!100", Fail, Pass))
+	reports, err := r.DueReports(now.Add(2 * time.Hour))
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("Expected one due report, got %d (%v)", len(reports), err)
+	}
+	if destinations := reports[0].Destinations; len(destinations) != 1 || destinations[0].Address != "dmarc@example.com" {
+		t.Errorf("Unexpected destinations: %v", destinations)
+	}
+
+	// no report if all destinations are too small
+	now = now.Add(2 * time.Hour)
+	r.Record(net.ParseIP("192.0.2.1"), "example.net", newTestReportResult("mailto:small@example.com!100", Fail, Pass))
+	if reports, err := r.DueReports(now.Add(2 * time.Hour)); err != nil || len(reports) != 0 {
+		t.Errorf("Expected no report, got %d (%v)", len(reports), err)
+	}
+}
+
+func TestAggregateReportIntervalAlignment(t *testing.T) {
+	// 5 hours do not divide a day, the intervals begin at multiples since the epoch
+	now := time.Unix(1467244800, 0).UTC()
+	r := &AggregateReporter{Store: NewMemoryReportStore(), OrgName: "mx.example.net", Email: "dmarc@mx.example.net", Now: func() time.Time { return now }}
+
+	result := newTestReportResult("mailto:dmarc@example.com", Fail, Pass)
+	result.Tags["ri"] = "18000"
+	r.Record(net.ParseIP("192.0.2.1"), "example.net", result)
+
+	// the interval is 1467234000 to 1467251999
+	if reports, err := r.DueReports(time.Unix(1467251999, 0)); err != nil || len(reports) != 0 {
+		t.Fatalf("Expected no due report, got %d (%v)", len(reports), err)
+	}
+
+	reports, err := r.DueReports(time.Unix(1467252000, 0))
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("Expected one due report, got %d (%v)", len(reports), err)
+	}
+	if dateRange := reports[0].Metadata.DateRange; dateRange.Begin != 1467234000 || dateRange.End != 1467251999 {
+		t.Errorf("Unexpected date range: %+v", dateRange)
+	}
+}
+
+func TestReportRecordKey(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	record := newReportRecord(&ReportEntry{SourceIP: ip, Result: newTestReportResult("mailto:dmarc@example.com", Fail, Pass)})
+	if newReportRecordKey(record) != newReportRecordKey(newReportRecord(&ReportEntry{SourceIP: ip, Result: newTestReportResult("mailto:dmarc@example.com", Fail, Pass)})) {
+		t.Error("Expected equal keys for equal records")
+	}
+
+	other := newTestReportResult("mailto:dmarc@example.com", Fail, Pass)
+	other.DKIM[0].Tags["s"] = "other"
+	if newReportRecordKey(record) == newReportRecordKey(newReportRecord(&ReportEntry{SourceIP: ip, Result: other})) {
+		t.Error("Expected different keys for different selectors")
+	}
+
+	overridden := newTestReportResult("mailto:dmarc@example.com", Fail, Pass)
+	overridden.Overrides = []PolicyOverrideReason{{Type: OverrideLocalPolicy}}
+	if newReportRecordKey(record) == newReportRecordKey(newReportRecord(&ReportEntry{SourceIP: ip, Result: overridden})) {
+		t.Error("Expected different keys for different reasons")
+	}
+}
+
+func TestReportInterval(t *testing.T) {
+	for ri, expected := range map[string]time.Duration{
+		"60":     time.Hour,
+		"7200":   2 * time.Hour,
+		"86400":  24 * time.Hour,
+		"604800": 24 * time.Hour,
+	} {
+		if interval := reportInterval(ri); interval != expected {
+			t.Errorf("ri=%s: expected %v, got %v", ri, expected, interval)
+		}
+	}
+}
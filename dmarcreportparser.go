@@ -0,0 +1,307 @@
+package emailauth
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"path"
+	"strings"
+)
+
+/*
+ * Parsing of DMARC aggregate reports received from other providers.
+ * Reports are sent as XML documents, usually gzip or zip compressed,
+ * attached to a message (RFC 7489, section 7.2.1.1).
+ */
+
+const maxReportSize = 32 << 20
+
+var reportMediaTypes = []string{
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/x-zip-compressed",
+	"application/xml",
+	"text/xml",
+}
+
+var reportExtensions = []string{".xml", ".gz", ".zip"}
+
+/*
+ * Parses an aggregate report. The report may be a plain XML document
+ * or a gzip or zip archive containing it.
+ */
+func ParseAggregateReport(r io.Reader) (*AggregateReport, error) {
+	reports, err := parseAggregateReports(r)
+	if err != nil {
+		return nil, err
+	}
+	return reports[0], nil
+}
+
+/*
+ * Returns the aggregate reports attached to a message. Plain XML, gzip
+ * and zip attachments are supported, as well as a report sent as the
+ * message body itself.
+ */
+func ParseAggregateReports(message *Message) ([]*AggregateReport, error) {
+	header := textproto.MIMEHeader{}
+	if message.Headers != nil {
+		header = *message.Headers
+	}
+
+	var reports []*AggregateReport
+	if err := extractReports(header, message.Body, &reports); err != nil {
+		return nil, err
+	}
+
+	if len(reports) == 0 {
+		return nil, errors.New("No aggregate report found")
+	}
+	return reports, nil
+}
+
+func extractReports(header textproto.MIMEHeader, body io.Reader, reports *[]*AggregateReport) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := extractReports(part.Header, part, reports); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !isReportPart(mediaType, header) {
+		return nil
+	}
+
+	if strings.EqualFold(strings.TrimSpace(header.Get("Content-Transfer-Encoding")), "base64") {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	parsed, err := parseAggregateReports(body)
+	if err != nil {
+		return err
+	}
+
+	*reports = append(*reports, parsed...)
+	return nil
+}
+
+func isReportPart(mediaType string, header textproto.MIMEHeader) bool {
+	if containsFold(reportMediaTypes, mediaType) {
+		return true
+	}
+
+	filename := ""
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		filename = params["filename"]
+	}
+
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && filename == "" {
+		filename = params["name"]
+	}
+	return containsFold(reportExtensions, path.Ext(filename))
+}
+
+func parseAggregateReports(r io.Reader) ([]*AggregateReport, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+
+		report, err := decodeAggregateReport(gz)
+		if err != nil {
+			return nil, err
+		}
+		return []*AggregateReport{report}, nil
+
+	case bytes.Equal(magic, []byte("PK\x03\x04")):
+		data, err := readLimited(br)
+		if err != nil {
+			return nil, err
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+
+		var reports []*AggregateReport
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() || !strings.EqualFold(path.Ext(f.Name), ".xml") {
+				continue
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+
+			report, err := decodeAggregateReport(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			reports = append(reports, report)
+		}
+
+		if len(reports) == 0 {
+			return nil, errors.New("No aggregate report in zip archive")
+		}
+		return reports, nil
+	}
+
+	report, err := decodeAggregateReport(br)
+	if err != nil {
+		return nil, err
+	}
+	return []*AggregateReport{report}, nil
+}
+
+func decodeAggregateReport(r io.Reader) (*AggregateReport, error) {
+	data, err := readLimited(r)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AggregateReport{}
+	if err := xml.Unmarshal(data, report); err != nil {
+		return nil, errors.New("Invalid aggregate report: " + err.Error())
+	}
+
+	if report.Policy.Domain == "" {
+		return nil, errors.New("Invalid aggregate report: missing policy domain")
+	}
+	return report, nil
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxReportSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxReportSize {
+		return nil, errors.New("Aggregate report too large")
+	}
+	return data, nil
+}
+
+/*
+ * ReportSummary counts the messages covered by aggregate reports.
+ * DKIM and SPF count aligned passes as evaluated by the reporter.
+ */
+type ReportSummary struct {
+	Messages   int
+	DMARCPass  int
+	DKIMPass   int
+	SPFPass    int
+	Quarantine int
+	Reject     int
+}
+
+func (s *ReportSummary) add(row *ReportRow) {
+	count := row.Count
+	s.Messages += count
+
+	dkim := strings.EqualFold(row.PolicyEvaluated.DKIM, Pass.String())
+	spf := strings.EqualFold(row.PolicyEvaluated.SPF, Pass.String())
+	if dkim {
+		s.DKIMPass += count
+	}
+	if spf {
+		s.SPFPass += count
+	}
+	if dkim || spf {
+		s.DMARCPass += count
+	}
+
+	switch Disposition(strings.ToLower(row.PolicyEvaluated.Disposition)) {
+	case DispositionQuarantine:
+		s.Quarantine += count
+	case DispositionReject:
+		s.Reject += count
+	}
+}
+
+/*
+ * Returns the share of messages passing DMARC, between 0 and 1.
+ */
+func (s *ReportSummary) PassRate() float64 {
+	if s.Messages == 0 {
+		return 0
+	}
+	return float64(s.DMARCPass) / float64(s.Messages)
+}
+
+/*
+ * Returns the share of messages failing DMARC, between 0 and 1.
+ */
+func (s *ReportSummary) FailRate() float64 {
+	if s.Messages == 0 {
+		return 0
+	}
+	return 1 - s.PassRate()
+}
+
+/*
+ * Summarizes the records of the given reports per source IP address.
+ */
+func SummarizeBySourceIP(reports ...*AggregateReport) map[string]*ReportSummary {
+	return summarize(reports, func(record *ReportRecord) string {
+		return strings.TrimSpace(record.Row.SourceIP)
+	})
+}
+
+/*
+ * Summarizes the records of the given reports per sending domain, i.e.
+ * the domain of the RFC5322.From header field.
+ */
+func SummarizeByDomain(reports ...*AggregateReport) map[string]*ReportSummary {
+	return summarize(reports, func(record *ReportRecord) string {
+		return strings.ToLower(strings.TrimSpace(record.Identifiers.HeaderFrom))
+	})
+}
+
+func summarize(reports []*AggregateReport, key func(*ReportRecord) string) map[string]*ReportSummary {
+	summaries := make(map[string]*ReportSummary)
+	for _, report := range reports {
+		for i := range report.Records {
+			record := &report.Records[i]
+			k := key(record)
+			if summaries[k] == nil {
+				summaries[k] = &ReportSummary{}
+			}
+			summaries[k].add(&record.Row)
+		}
+	}
+	return summaries
+}
@@ -0,0 +1,157 @@
+package emailauth
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+const testAggregateReport = `<?xml version="1.0" encoding="UTF-8"?>
+<feedback xmlns="urn:ietf:params:xml:ns:dmarc-2.0">
+  <report_metadata>
+    <org_name>receiver.example</org_name>
+    <email>noreply-dmarc@receiver.example</email>
+    <report_id>9391651994964116463</report_id>
+    <date_range><begin> 1467244800 </begin><end>1467331199</end></date_range>
+  </report_metadata>
+  <policy_published>
+    <domain>example.com</domain><adkim>r</adkim><aspf>r</aspf><p>reject</p><sp>reject</sp><pct>100</pct>
+  </policy_published>
+  <record>
+    <row>
+      <source_ip>192.0.2.1</source_ip><count>8</count>
+      <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><header_from>example.com</header_from></identifiers>
+    <auth_results>
+      <dkim><domain>example.com</domain><selector>sel</selector><result>pass</result></dkim>
+      <spf><domain>example.com</domain><result>fail</result></spf>
+    </auth_results>
+  </record>
+  <record>
+    <row>
+      <source_ip>198.51.100.7</source_ip><count>2</count>
+      <policy_evaluated><disposition>reject</disposition><dkim>fail</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><header_from>mail.example.com</header_from></identifiers>
+    <auth_results><spf><domain>mail.example.com</domain><result>softfail</result></spf></auth_results>
+  </record>
+  <record>
+    <row>
+      <source_ip>192.0.2.1</source_ip><count>2</count>
+      <policy_evaluated><disposition>quarantine</disposition><dkim>fail</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><header_from>example.com</header_from></identifiers>
+    <auth_results><spf><domain>example.com</domain><result>fail</result></spf></auth_results>
+  </record>
+</feedback>`
+
+func gzipTestReport(t *testing.T) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(testAggregateReport))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipTestReport(t *testing.T) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, err := w.Create("receiver.example!example.com!1467244800!1467331199.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(testAggregateReport))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseAggregateReport(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"xml":  []byte(testAggregateReport),
+		"gzip": gzipTestReport(t),
+		"zip":  zipTestReport(t),
+	} {
+		report, err := ParseAggregateReport(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		assertStringEquals("receiver.example", report.Metadata.OrgName, t)
+		assertStringEquals("example.com", report.Policy.Domain, t)
+		if report.Metadata.DateRange.Begin != 1467244800 || len(report.Records) != 3 || report.Records[0].Row.Count != 8 {
+			t.Errorf("%s: unexpected report %+v", name, report)
+		}
+	}
+
+	if _, err := ParseAggregateReport(strings.NewReader("<feedback></feedback>")); err == nil {
+		t.Error("Expected error for report without policy domain")
+	}
+}
+
+func TestParseAggregateReportsFromMessage(t *testing.T) {
+	body := "--b1\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"This is an aggregate report.\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream; name=\"report.xml.gz\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString(gzipTestReport(t)) + "\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/zip\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString(zipTestReport(t)) + "\r\n" +
+		"--b1--\r\n"
+
+	headers := textproto.MIMEHeader{}
+	headers.Set("Content-Type", "multipart/mixed; boundary=b1")
+	reports, err := ParseAggregateReports(&Message{Headers: &headers, Body: strings.NewReader(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reports) != 2 {
+		t.Fatalf("Expected 2 reports, got %d", len(reports))
+	}
+
+	headers.Set("Content-Type", "text/plain")
+	if _, err := ParseAggregateReports(&Message{Headers: &headers, Body: strings.NewReader("hello")}); err == nil {
+		t.Error("Expected error for message without report")
+	}
+}
+
+func TestSummarizeAggregateReports(t *testing.T) {
+	report, err := ParseAggregateReport(strings.NewReader(testAggregateReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byIP := SummarizeBySourceIP(report, report)
+	s := byIP["192.0.2.1"]
+	if s == nil || s.Messages != 20 || s.DMARCPass != 16 || s.DKIMPass != 16 || s.SPFPass != 0 || s.Quarantine != 4 {
+		t.Errorf("Unexpected summary for 192.0.2.1: %+v", s)
+	}
+
+	if rate := s.PassRate(); rate != 0.8 {
+		t.Errorf("Expected pass rate 0.8, got %v", rate)
+	}
+
+	byDomain := SummarizeByDomain(report)
+	s = byDomain["mail.example.com"]
+	if s == nil || s.Messages != 2 || s.Reject != 2 || s.FailRate() != 1 {
+		t.Errorf("Unexpected summary for mail.example.com: %+v", s)
+	}
+
+	if len(byDomain) != 2 || len(byIP) != 2 {
+		t.Errorf("Unexpected number of summaries: %d domains, %d IPs", len(byDomain), len(byIP))
+	}
+}
@@ -0,0 +1,246 @@
+package emailauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*
+ * DMARC report URIs (RFC 7489, section 6.2):
+ *
+ *  rua=mailto:dmarc@example.com!10m,mailto:dmarc@reports.example.net
+ *
+ * A report receiver outside of the organizational domain of the policy
+ * must authorize reports for it (RFC 7489, section 7.1):
+ *
+ * example.com._report._dmarc.reports.example.net. IN TXT "v=DMARC1"
+ */
+
+type ReportURI struct {
+	URI     string // without size limit
+	Scheme  string
+	Address string // mailto: address
+	MaxSize int64  // in bytes, 0 if unlimited
+}
+
+/*
+ * Parses a report URI with an optional size limit, a number followed
+ * by an optional unit of k, m, g or t (powers of 2^10).
+ */
+func ParseReportURI(s string) (*ReportURI, error) {
+	s = strings.TrimSpace(s)
+	uri := &ReportURI{URI: s}
+
+	if idx := strings.LastIndexByte(s, '!'); idx >= 0 {
+		size, err := parseReportSize(s[idx+1:])
+		if err != nil {
+			return nil, err
+		}
+		uri.URI = s[:idx]
+		uri.MaxSize = size
+	}
+
+	u, err := url.Parse(uri.URI)
+	if err != nil || u.Scheme == "" {
+		return nil, fmt.Errorf("Invalid report URI: %s", s)
+	}
+	uri.Scheme = strings.ToLower(u.Scheme)
+
+	if uri.Scheme != "mailto" {
+		if u.Host == "" {
+			return nil, fmt.Errorf("Invalid report URI: %s", s)
+		}
+		return uri, nil
+	}
+
+	address, err := url.PathUnescape(u.Opaque)
+	if err != nil || strings.Count(address, "@") != 1 || strings.ContainsAny(address, ", ") {
+		return nil, fmt.Errorf("Invalid mailto URI: %s", s)
+	}
+
+	parts := strings.SplitN(address, "@", 2)
+	if parts[0] == "" || !isValidDomain(parts[1]) {
+		return nil, fmt.Errorf("Invalid mailto URI: %s", s)
+	}
+	uri.Address = address
+	return uri, nil
+}
+
+/*
+ * Parses a comma-separated list of report URIs as found in "rua=" and
+ * "ruf=" tags.
+ */
+func ParseReportURIs(list string) ([]*ReportURI, error) {
+	var uris []*ReportURI
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		uri, err := ParseReportURI(s)
+		if err != nil {
+			return nil, err
+		}
+		uris = append(uris, uri)
+	}
+
+	if len(uris) == 0 {
+		return nil, errors.New("No report URI")
+	}
+	return uris, nil
+}
+
+func parseReportSize(s string) (int64, error) {
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		switch strings.ToLower(s[n-1:]) {
+		case "k":
+			multiplier = 1 << 10
+		case "m":
+			multiplier = 1 << 20
+		case "g":
+			multiplier = 1 << 30
+		case "t":
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 || size > (1<<62)/multiplier {
+		return 0, fmt.Errorf("Invalid size limit: %s", s)
+	}
+	return size * multiplier, nil
+}
+
+/*
+ * Checks whether a report of the given size may be sent to the URI.
+ */
+func (u *ReportURI) Accepts(size int64) bool {
+	return u.MaxSize == 0 || size <= u.MaxSize
+}
+
+/*
+ * Returns the URIs accepting a report of the given size.
+ */
+func acceptingReportURIs(uris []*ReportURI, size int64) []*ReportURI {
+	var accepting []*ReportURI
+	for _, uri := range uris {
+		if uri.Accepts(size) {
+			accepting = append(accepting, uri)
+		}
+	}
+	return accepting
+}
+
+/*
+ * Returns the domain of the report receiver.
+ */
+func (u *ReportURI) Domain() string {
+	if u.Address != "" {
+		return strings.ToLower(domainOfIdentity(u.Address))
+	}
+
+	if parsed, err := url.Parse(u.URI); err == nil {
+		return strings.ToLower(parsed.Hostname())
+	}
+	return ""
+}
+
+/*
+ * Returns the URIs of a "rua" or "ruf" tag value that are authorized to
+ * receive reports for the policy domain. URIs within the organizational
+ * domain of the policy domain are always authorized; others require a
+ * DMARC record at <policy domain>._report._dmarc.<receiver domain>. If
+ * that record has a tag of the same name, its URIs replace the original
+ * one. Invalid URIs are ignored.
+ */
+func (v DMARCValidator) AuthorizedReportURIs(policyDomain string, tag string, list string) []*ReportURI {
+	return v.AuthorizedReportURIsContext(context.Background(), policyDomain, tag, list)
+}
+
+/*
+ * Like AuthorizedReportURIs, looking up the authorizations with ctx.
+ * The queries are logged with the trace ID of ctx.
+ */
+func (v DMARCValidator) AuthorizedReportURIsContext(ctx context.Context, policyDomain string, tag string, list string) []*ReportURI {
+	resolver := traceResolver(ctx, v.Resolver, v.Logger, v.Metrics)
+	psl := v.PublicSuffixList
+	if psl == nil {
+		psl = DefaultPublicSuffixList()
+	}
+
+	policyDomain = strings.ToLower(strings.TrimSuffix(policyDomain, "."))
+	orgDomain := psl.OrganizationalDomain(policyDomain)
+
+	var authorized []*ReportURI
+	for _, s := range strings.Split(list, ",") {
+		uri, err := ParseReportURI(s)
+		if err != nil {
+			continue
+		}
+
+		domain := uri.Domain()
+		if domain == "" {
+			continue
+		}
+
+		if psl.OrganizationalDomain(domain) == orgDomain {
+			authorized = append(authorized, uri)
+			continue
+		}
+
+		ok, replacements := findReportAuthorization(ctx, resolver, policyDomain, domain, tag)
+		if !ok {
+			continue
+		}
+
+		if len(replacements) > 0 {
+			authorized = append(authorized, replacements...)
+		} else {
+			authorized = append(authorized, uri)
+		}
+	}
+
+	return authorized
+}
+
+/*
+ * Looks up the authorization of an external report receiver. Its
+ * record may replace the report URIs; these must be within the
+ * receiver domain itself.
+ */
+func findReportAuthorization(ctx context.Context, resolver Resolver, policyDomain string, domain string, tag string) (bool, []*ReportURI) {
+	records, err := resolver.LookupTXT(ctx, policyDomain+"._report._dmarc."+domain)
+	if err != nil {
+		return false, nil
+	}
+
+	for _, record := range records {
+		if !isDMARCRecord(record) {
+			continue
+		}
+
+		tags, err := parseTagList(record)
+		if err != nil || tags[tag] == "" {
+			return true, nil
+		}
+
+		var replacements []*ReportURI
+		for _, s := range strings.Split(tags[tag], ",") {
+			uri, err := ParseReportURI(s)
+			if err == nil && strings.HasSuffix("."+uri.Domain(), "."+domain) {
+				replacements = append(replacements, uri)
+			}
+		}
+		return true, replacements
+	}
+
+	return false, nil
+}
@@ -0,0 +1,90 @@
+package emailauth
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseReportURI(t *testing.T) {
+	tests := []struct {
+		uri     string
+		address string
+		size    int64
+	}{
+		{"mailto:dmarc@example.com", "dmarc@example.com", 0},
+		{" mailto:dmarc@example.com!50 ", "dmarc@example.com", 50},
+		{"mailto:dmarc@example.com!10k", "dmarc@example.com", 10 << 10},
+		{"mailto:dmarc@example.com!10m", "dmarc@example.com", 10 << 20},
+		{"mailto:dmarc@example.com!1G", "dmarc@example.com", 1 << 30},
+		{"mailto:dmarc%2Breports@example.com!2t", "dmarc+reports@example.com", 2 << 40},
+		{"https://reports.example.com/dmarc", "", 0},
+	}
+
+	for _, test := range tests {
+		uri, err := ParseReportURI(test.uri)
+		if err != nil {
+			t.Errorf("%s: %v", test.uri, err)
+			continue
+		}
+
+		assertStringEquals(test.address, uri.Address, t)
+		if uri.MaxSize != test.size {
+			t.Errorf("%s: expected size %d, got %d", test.uri, test.size, uri.MaxSize)
+		}
+	}
+
+	for _, uri := range []string{"dmarc@example.com", "mailto:dmarc@example.com!x", "mailto:dmarc@example.com!10p", "mailto:dmarc",
+		"mailto:@example.com", "mailto:a@example.com%2Cb@example.com"} {
+		if _, err := ParseReportURI(uri); err == nil {
+			t.Errorf("Expected error for %s", uri)
+		}
+	}
+
+	uri, _ := ParseReportURI("mailto:dmarc@example.com!1k")
+	if !uri.Accepts(1024) || uri.Accepts(1025) {
+		t.Error("Unexpected size limit check")
+	}
+}
+
+func TestAuthorizedReportURIs(t *testing.T) {
+	v := DMARCValidator{Resolver: fakeResolver{
+		"example.com._report._dmarc.reports.example.net": {"v=DMARC1"},
+		"example.com._report._dmarc.redirect.example":    {"v=DMARC1; rua=mailto:dmarc@mx.redirect.example!5m, mailto:x@evil.example"},
+		"example.com._report._dmarc.invalid.example":     {"v=spf1 -all"},
+	}}
+
+	uris := v.AuthorizedReportURIs("example.com", "rua", "mailto:a@example.com,mailto:b@reports.example.net,"+
+		"mailto:c@unauthorized.example,mailto:d@redirect.example,mailto:e@invalid.example,invalid")
+
+	var addresses []string
+	for _, uri := range uris {
+		addresses = append(addresses, uri.Address)
+	}
+
+	expected := []string{"a@example.com", "b@reports.example.net", "dmarc@mx.redirect.example"}
+	if len(addresses) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, addresses)
+	}
+	for i := range expected {
+		assertStringEquals(expected[i], addresses[i], t)
+	}
+
+	// the authorizations are looked up with the context
+	var buf bytes.Buffer
+	v.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: dropTime}))
+	v.Resolver = contextResolver{v.Resolver.(fakeResolver)}
+	ctx := WithTraceID(context.Background(), "5f0c3a9e81d2b674")
+	v.AuthorizedReportURIsContext(ctx, "example.com", "rua", "mailto:b@reports.example.net")
+	if !strings.HasPrefix(buf.String(), "level=DEBUG msg=dns trace-id=5f0c3a9e81d2b674 type=TXT name=example.com._report._dmarc.reports.example.net answers=1 ") {
+		t.Errorf("Unexpected log: %s", buf.String())
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if uris := v.AuthorizedReportURIsContext(ctx, "example.com", "rua", "mailto:b@reports.example.net"); len(uris) != 0 {
+		t.Errorf("Expected no authorized URIs after cancellation, got %v", uris)
+	}
+}
@@ -0,0 +1,225 @@
+package emailauth
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheEntries     = 10000
+	defaultCacheTTL         = 5 * time.Minute
+	defaultCacheNegativeTTL = time.Minute
+	defaultCacheMaxTTL      = 24 * time.Hour
+)
+
+/*
+ * CachingResolver caches the answers of Resolver, so that the lookups
+ * of SPF, DKIM and DMARC for the same domains reach the DNS once.
+ * Answers are kept for the TTL reported by Resolver (see DNSClient),
+ * otherwise for DefaultTTL, and at most for MaxTTL. Negative answers
+ * are cached as well (RFC 2308), without a reported TTL for
+ * NegativeTTL; temporary errors are not cached. Of at most MaxEntries
+ * answers, the least recently used are evicted first. Concurrent
+ * identical queries are passed to Resolver once. Zero values select
+ * the defaults: 10000 entries, five minutes, one minute and one day.
+ */
+type CachingResolver struct {
+	Resolver    Resolver
+	MaxEntries  int
+	DefaultTTL  time.Duration
+	NegativeTTL time.Duration
+	MaxTTL      time.Duration
+
+	mu      sync.Mutex
+	entries map[dnsCacheKey]*list.Element
+	lru     list.List // of *dnsCacheEntry, most recently used first
+	calls   map[dnsCacheKey]*dnsCacheCall
+	stats   CacheStats
+}
+
+/*
+ * CacheStats counts the lookups of a CachingResolver. Hits include
+ * NegativeHits; Shared counts lookups waiting for an identical query
+ * in progress, which are not counted as misses.
+ */
+type CacheStats struct {
+	Hits         uint64
+	NegativeHits uint64
+	Misses       uint64
+	Shared       uint64
+	Evictions    uint64
+	Entries      int
+}
+
+type dnsCacheKey struct {
+	qtype string
+	name  string
+}
+
+type dnsCacheEntry struct {
+	key     dnsCacheKey
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+type dnsCacheCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+func (c *CachingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	value, err := c.lookup(ctx, "TXT", name, func(ctx context.Context) (interface{}, error) {
+		return resolverOrDefault(c.Resolver).LookupTXT(ctx, name)
+	})
+	records, _ := value.([]string)
+	return records, err
+}
+
+func (c *CachingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	value, err := c.lookup(ctx, "A/AAAA", host, func(ctx context.Context) (interface{}, error) {
+		return resolverOrDefault(c.Resolver).LookupHost(ctx, host)
+	})
+	addrs, _ := value.([]string)
+	return addrs, err
+}
+
+func (c *CachingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	value, err := c.lookup(ctx, "MX", name, func(ctx context.Context) (interface{}, error) {
+		return resolverOrDefault(c.Resolver).LookupMX(ctx, name)
+	})
+	mxs, _ := value.([]*net.MX)
+	return mxs, err
+}
+
+/*
+ * Returns a snapshot of the statistics.
+ */
+func (c *CachingResolver) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+/*
+ * Removes all entries.
+ */
+func (c *CachingResolver) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[dnsCacheKey]*list.Element)
+	c.lru.Init()
+}
+
+/*
+ * Returns the cached answer, or starts the query unless an identical
+ * one is in progress. The query runs without the cancellation of ctx,
+ * as others may wait for it; this lookup returns when ctx is done.
+ */
+func (c *CachingResolver) lookup(ctx context.Context, qtype string, name string, query func(context.Context) (interface{}, error)) (interface{}, error) {
+	key := dnsCacheKey{qtype: qtype, name: strings.ToLower(strings.TrimSuffix(name, "."))}
+
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[dnsCacheKey]*list.Element)
+	}
+	if c.calls == nil {
+		c.calls = make(map[dnsCacheKey]*dnsCacheCall)
+	}
+
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*dnsCacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(e)
+			c.stats.Hits++
+			if entry.err != nil {
+				c.stats.NegativeHits++
+			}
+			c.mu.Unlock()
+			return entry.value, entry.err
+		}
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+
+	call, ok := c.calls[key]
+	if ok {
+		c.stats.Shared++
+	} else {
+		c.stats.Misses++
+		call = &dnsCacheCall{done: make(chan struct{})}
+		c.calls[key] = call
+
+		queryCtx, report := withTTLReport(context.WithoutCancel(ctx))
+		go func() {
+			value, err := query(queryCtx)
+			c.complete(key, call, value, err, report)
+		}()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return nil, &net.DNSError{Err: ctx.Err().Error(), Name: name, IsTimeout: ctx.Err() == context.DeadlineExceeded, IsTemporary: true}
+	}
+}
+
+func (c *CachingResolver) complete(key dnsCacheKey, call *dnsCacheCall, value interface{}, err error, report *ttlReport) {
+	call.value, call.err = value, err
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.calls, key)
+	close(call.done)
+
+	ttl, known := report.get()
+	switch {
+	case err == nil && !known:
+		ttl = c.ttl(c.DefaultTTL, defaultCacheTTL)
+	case isNotFoundDNSError(err) && !known:
+		ttl = c.ttl(c.NegativeTTL, defaultCacheNegativeTTL)
+	case err != nil && !isNotFoundDNSError(err):
+		ttl = 0
+	}
+
+	if maxTTL := c.ttl(c.MaxTTL, defaultCacheMaxTTL); ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&dnsCacheEntry{key: key, value: value, err: err, expires: time.Now().Add(ttl)})
+
+	maxEntries := c.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+	for c.lru.Len() > maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+func (c *CachingResolver) ttl(configured time.Duration, defaultTTL time.Duration) time.Duration {
+	if configured <= 0 {
+		return defaultTTL
+	}
+	return configured
+}
@@ -0,0 +1,151 @@
+package emailauth
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+ * countingResolver counts the lookups passed to fakeResolver. TTLs are
+ * reported if set, lookups wait for gate if it is not nil.
+ */
+type countingResolver struct {
+	fakeResolver
+	ttl     map[string]time.Duration
+	gate    chan struct{}
+	lookups int32
+}
+
+func (r *countingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	if r.gate != nil {
+		<-r.gate
+	}
+	if ttl, ok := r.ttl[name]; ok {
+		reportTTL(ctx, ttl)
+	}
+	if name == "temp.example.com" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return r.fakeResolver.LookupTXT(ctx, name)
+}
+
+func TestCachingResolver(t *testing.T) {
+	resolver := &countingResolver{fakeResolver: fakeResolver{"example.com": {"v=spf1 -all"}}}
+	c := &CachingResolver{Resolver: resolver}
+
+	for _, name := range []string{"example.com", "Example.COM.", "example.com"} {
+		records, err := c.LookupTXT(context.Background(), name)
+		if err != nil || len(records) != 1 || records[0] != "v=spf1 -all" {
+			t.Errorf("Unexpected answer for %s: %v (%v)", name, records, err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.LookupTXT(context.Background(), "missing.example.com"); !isNotFoundDNSError(err) {
+			t.Errorf("Expected negative answer but got %v", err)
+		}
+		if _, err := c.LookupTXT(context.Background(), "temp.example.com"); !isTemporaryDNSError(err) {
+			t.Errorf("Expected temporary error but got %v", err)
+		}
+	}
+
+	if resolver.lookups != 4 {
+		t.Errorf("Expected 4 lookups but got %d", resolver.lookups)
+	}
+	if stats := c.Stats(); stats != (CacheStats{Hits: 3, NegativeHits: 1, Misses: 4, Entries: 2}) {
+		t.Errorf("Unexpected statistics: %+v", stats)
+	}
+
+	c.Flush()
+	c.LookupTXT(context.Background(), "example.com")
+	if resolver.lookups != 5 {
+		t.Errorf("Expected lookup after flush, got %d lookups", resolver.lookups)
+	}
+}
+
+func TestCachingResolverTTL(t *testing.T) {
+	resolver := &countingResolver{
+		fakeResolver: fakeResolver{"short.example.com": {"short"}, "zero.example.com": {"zero"}, "long.example.com": {"long"}},
+		ttl:          map[string]time.Duration{"short.example.com": 50 * time.Millisecond, "zero.example.com": 0, "long.example.com": 48 * time.Hour},
+	}
+	c := &CachingResolver{Resolver: resolver, MaxTTL: 100 * time.Millisecond}
+
+	for _, name := range []string{"short.example.com", "zero.example.com", "long.example.com"} {
+		c.LookupTXT(context.Background(), name)
+		c.LookupTXT(context.Background(), name)
+	}
+	if resolver.lookups != 4 {
+		t.Errorf("Expected 4 lookups but got %d", resolver.lookups)
+	}
+
+	// the TTL of long.example.com is limited by MaxTTL
+	time.Sleep(150 * time.Millisecond)
+	c.LookupTXT(context.Background(), "short.example.com")
+	c.LookupTXT(context.Background(), "long.example.com")
+	if resolver.lookups != 6 {
+		t.Errorf("Expected expired entries, got %d lookups", resolver.lookups)
+	}
+}
+
+func TestCachingResolverEviction(t *testing.T) {
+	resolver := &countingResolver{fakeResolver: fakeResolver{"a.example": {"a"}, "b.example": {"b"}, "c.example": {"c"}}}
+	c := &CachingResolver{Resolver: resolver, MaxEntries: 2}
+
+	for _, name := range []string{"a.example", "b.example", "a.example", "c.example", "a.example", "b.example"} {
+		c.LookupTXT(context.Background(), name)
+	}
+
+	// b.example was evicted as the least recently used
+	if resolver.lookups != 4 {
+		t.Errorf("Expected 4 lookups but got %d", resolver.lookups)
+	}
+	if stats := c.Stats(); stats.Evictions != 2 || stats.Entries != 2 {
+		t.Errorf("Unexpected statistics: %+v", stats)
+	}
+}
+
+func TestCachingResolverSharedQueries(t *testing.T) {
+	resolver := &countingResolver{fakeResolver: fakeResolver{"example.com": {"v=spf1 -all"}}, gate: make(chan struct{})}
+	c := &CachingResolver{Resolver: resolver}
+
+	// a canceled lookup returns while the query continues
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := c.LookupTXT(ctx, "example.com")
+		canceled <- err
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if records, err := c.LookupTXT(context.Background(), "example.com"); err != nil || len(records) != 1 {
+				t.Errorf("Unexpected answer: %v (%v)", records, err)
+			}
+		}()
+	}
+
+	for stats := c.Stats(); stats.Misses+stats.Shared < 6; stats = c.Stats() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-canceled; !isTemporaryDNSError(err) {
+		t.Errorf("Expected temporary error but got %v", err)
+	}
+
+	close(resolver.gate)
+	wg.Wait()
+	if resolver.lookups != 1 {
+		t.Errorf("Expected 1 lookup but got %d", resolver.lookups)
+	}
+	if stats := c.Stats(); stats.Misses != 1 || stats.Shared != 5 {
+		t.Errorf("Unexpected statistics: %+v", stats)
+	}
+}
@@ -0,0 +1,465 @@
+package emailauth
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Stub resolver reporting TTLs (RFC 1035, section 4). Queries are sent
+ * over UDP with an EDNS0 buffer size (RFC 6891) and repeated over TCP
+ * if the response is truncated. Only the record types needed by the
+ * validators are supported.
+ */
+
+// record types and response codes
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeSOA   = 6
+	dnsTypeMX    = 15
+	dnsTypeTXT   = 16
+	dnsTypeAAAA  = 28
+	dnsTypeOPT   = 41
+
+	dnsClassIN = 1
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeNXDomain = 3
+
+	dnsUDPSize        = 1232
+	defaultDNSTimeout = 5 * time.Second
+)
+
+var errDNSMessage = errors.New("Invalid DNS message")
+
+/*
+ * DNSClient queries the DNS servers in Servers ("host:port"), starting
+ * with the next server for each query and trying the others if one
+ * fails. Timeout limits each attempt and defaults to five seconds.
+ * Unlike net.Resolver, it reports the TTLs of answers to a
+ * CachingResolver.
+ */
+type DNSClient struct {
+	Servers []string
+	Timeout time.Duration
+
+	next uint32
+}
+
+type dnsRecord struct {
+	Type uint16
+	TTL  uint32
+	Data []byte
+	msg  []byte // for names compressed in Data
+	off  int    // offset of Data in msg
+}
+
+type dnsResponse struct {
+	Rcode     int
+	Answers   []*dnsRecord
+	Authority []*dnsRecord
+}
+
+func (c *DNSClient) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, err := c.lookup(ctx, name, dnsTypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	txts := make([]string, 0, len(records))
+	for _, r := range records {
+		var txt strings.Builder
+		for data := r.Data; len(data) > 0; {
+			n := int(data[0])
+			if len(data) < 1+n {
+				return nil, &net.DNSError{Err: errDNSMessage.Error(), Name: name}
+			}
+			txt.Write(data[1 : 1+n])
+			data = data[1+n:]
+		}
+		txts = append(txts, txt.String())
+	}
+	return txts, nil
+}
+
+/*
+ * Looks up the IPv4 and IPv6 addresses of host. An error is only
+ * returned if neither query has an answer.
+ */
+func (c *DNSClient) LookupHost(ctx context.Context, host string) ([]string, error) {
+	var addrs []string
+	var lookupErr error
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		records, err := c.lookup(ctx, host, qtype)
+		if err != nil {
+			if lookupErr == nil || isTemporaryDNSError(err) {
+				lookupErr = err
+			}
+			continue
+		}
+
+		for _, r := range records {
+			if len(r.Data) == net.IPv4len || len(r.Data) == net.IPv6len {
+				addrs = append(addrs, net.IP(r.Data).String())
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		if lookupErr == nil {
+			lookupErr = &net.DNSError{Err: dnsNoRecords, Name: host, IsNotFound: true}
+		}
+		return nil, lookupErr
+	}
+	return addrs, nil
+}
+
+func (c *DNSClient) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, err := c.lookup(ctx, name, dnsTypeMX)
+	if err != nil {
+		return nil, err
+	}
+
+	mxs := make([]*net.MX, 0, len(records))
+	for _, r := range records {
+		if len(r.Data) < 3 {
+			return nil, &net.DNSError{Err: errDNSMessage.Error(), Name: name}
+		}
+		host, _, err := readDNSName(r.msg, r.off+2)
+		if err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: name}
+		}
+		mxs = append(mxs, &net.MX{Host: host, Pref: binary.BigEndian.Uint16(r.Data)})
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	return mxs, nil
+}
+
+/*
+ * Returns the records of type qtype answering the query. Negative
+ * answers are returned as errors with IsNotFound set, "no such host"
+ * if the name does not exist and "no such record" if it has no records
+ * of the type; their TTL is taken from the SOA record of the authority
+ * section (RFC 2308, section 5), without one they are not cached.
+ */
+func (c *DNSClient) lookup(ctx context.Context, name string, qtype uint16) ([]*dnsRecord, error) {
+	if len(c.Servers) == 0 {
+		return nil, &net.DNSError{Err: "No DNS servers", Name: name}
+	}
+
+	query, err := newDNSQuery(name, qtype)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+
+	start := int(atomic.AddUint32(&c.next, 1) - 1)
+	var lastErr *net.DNSError
+	for i := 0; i < len(c.Servers); i++ {
+		server := c.Servers[(start+i)%len(c.Servers)]
+		response, err := c.exchange(ctx, server, query)
+		if err != nil {
+			lastErr = &net.DNSError{Err: err.Error(), Name: name, Server: server, IsTemporary: true}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				lastErr.IsTimeout = true
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		switch response.Rcode {
+		case dnsRcodeSuccess, dnsRcodeNXDomain:
+		default:
+			lastErr = &net.DNSError{Err: "server misbehaving", Name: name, Server: server, IsTemporary: true}
+			continue
+		}
+
+		// the answer is valid as long as every record of a CNAME chain
+		var records []*dnsRecord
+		ttl := uint32(0)
+		for i, r := range response.Answers {
+			if i == 0 || r.TTL < ttl {
+				ttl = r.TTL
+			}
+			if r.Type == qtype {
+				records = append(records, r)
+			}
+		}
+
+		if len(records) > 0 {
+			reportTTL(ctx, time.Duration(ttl)*time.Second)
+			return records, nil
+		}
+
+		ttl = 0
+		for _, r := range response.Authority {
+			if r.Type == dnsTypeSOA && len(r.Data) >= 20 {
+				ttl = r.TTL
+				if minimum := binary.BigEndian.Uint32(r.Data[len(r.Data)-4:]); minimum < ttl {
+					ttl = minimum
+				}
+			}
+		}
+		reportTTL(ctx, time.Duration(ttl)*time.Second)
+		if response.Rcode == dnsRcodeNXDomain {
+			return nil, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+		}
+		return nil, &net.DNSError{Err: dnsNoRecords, Name: name, Server: server, IsNotFound: true}
+	}
+	return nil, lastErr
+}
+
+/*
+ * Sends a query to server over UDP, and over TCP if the response is
+ * truncated.
+ */
+func (c *DNSClient) exchange(ctx context.Context, server string, query []byte) (*dnsResponse, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+
+	msg, err := c.exchangeOver(ctx, "udp", server, query, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	response, truncated, err := parseDNSResponse(msg, query)
+	if err == nil && truncated {
+		if msg, err = c.exchangeOver(ctx, "tcp", server, query, timeout); err != nil {
+			return nil, err
+		}
+		response, _, err = parseDNSResponse(msg, query)
+	}
+	return response, err
+}
+
+func (c *DNSClient) exchangeOver(ctx context.Context, network string, server string, query []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	packet := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(packet, uint16(len(query)))
+	copy(packet[2:], query)
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+/*
+ * Builds a recursive query for name with an EDNS0 OPT record.
+ */
+func newDNSQuery(name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	rand.Read(msg[:2])                          // ID
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)      // QDCOUNT
+	binary.BigEndian.PutUint16(msg[10:], 1)     // ARCOUNT
+
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		if len(name) > 253 {
+			return nil, errors.New("Name too long")
+		}
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, errors.New("Invalid name")
+			}
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	// OPT: root name, type, UDP payload size, extended rcode and flags, no data
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeOPT)
+	msg = binary.BigEndian.AppendUint16(msg, dnsUDPSize)
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	return msg, nil
+}
+
+/*
+ * Parses the answer and authority sections of the response to query.
+ * Responses with another ID or question are rejected. Returns whether
+ * the response is truncated.
+ */
+func parseDNSResponse(msg []byte, query []byte) (*dnsResponse, bool, error) {
+	if len(msg) < 12 || msg[0] != query[0] || msg[1] != query[1] || msg[2]&0x80 == 0 {
+		return nil, false, errDNSMessage
+	}
+
+	// the question of the query, which has a single one
+	qname, qnext, _ := readDNSName(query, 12)
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, false, errDNSMessage
+	}
+	name, next, err := readDNSName(msg, 12)
+	if err != nil || next+4 > len(msg) || !strings.EqualFold(name, qname) || string(msg[next:next+4]) != string(query[qnext:qnext+4]) {
+		return nil, false, errDNSMessage
+	}
+	off := next + 4
+
+	if msg[2]&0x02 != 0 {
+		return nil, true, nil
+	}
+
+	response := &dnsResponse{Rcode: int(msg[3] & 0x0f)}
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+
+	for i := 0; i < ancount+nscount; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return nil, false, errDNSMessage
+		}
+
+		r := &dnsRecord{
+			Type: binary.BigEndian.Uint16(msg[next:]),
+			TTL:  binary.BigEndian.Uint32(msg[next+4:]),
+			msg:  msg,
+			off:  next + 10,
+		}
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		if r.off+length > len(msg) {
+			return nil, false, errDNSMessage
+		}
+		r.Data = msg[r.off : r.off+length]
+		off = r.off + length
+
+		if i < ancount {
+			response.Answers = append(response.Answers, r)
+		} else {
+			response.Authority = append(response.Authority, r)
+		}
+	}
+	return response, false, nil
+}
+
+/*
+ * Reads a possibly compressed name at off. Returns the name and the
+ * offset following it.
+ */
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMessage
+		}
+
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps >= 16 {
+				return "", 0, errDNSMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		case length > 63 || off+1+length > len(msg):
+			return "", 0, errDNSMessage
+		default:
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+type ttlReportKey struct{}
+
+/*
+ * ttlReport receives the TTLs of the answers to a lookup. Resolvers
+ * not reporting TTLs leave it unset.
+ */
+type ttlReport struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	known bool
+}
+
+func withTTLReport(ctx context.Context) (context.Context, *ttlReport) {
+	report := &ttlReport{}
+	return context.WithValue(ctx, ttlReportKey{}, report), report
+}
+
+/*
+ * Reports the TTL of an answer. Of several answers, e.g. for the IPv4
+ * and IPv6 addresses of a host, the lowest TTL is kept.
+ */
+func reportTTL(ctx context.Context, ttl time.Duration) {
+	report, ok := ctx.Value(ttlReportKey{}).(*ttlReport)
+	if !ok {
+		return
+	}
+
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	if !report.known || ttl < report.ttl {
+		report.ttl, report.known = ttl, true
+	}
+}
+
+func (r *ttlReport) get() (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ttl, r.known
+}
@@ -0,0 +1,250 @@
+package emailauth
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type testDNSAnswer struct {
+	rcode     byte
+	answers   [][]byte
+	authority [][]byte
+}
+
+/*
+ * Starts a DNS server on UDP and TCP answering from answers by name.
+ * UDP responses are truncated if truncate is set.
+ */
+func newTestDNSServer(t *testing.T, answers map[string]*testDNSAnswer, truncate bool) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Skip(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+		conn.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(testDNSResponse(buf[:n], answers, truncate), addr)
+		}
+	}()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(c)
+			var length uint16
+			binary.Read(r, binary.BigEndian, &length)
+			query := make([]byte, length)
+			io.ReadFull(r, query)
+			response := testDNSResponse(query, answers, false)
+			c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+			c.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func testDNSResponse(query []byte, answers map[string]*testDNSAnswer, truncate bool) []byte {
+	name, next, _ := readDNSName(query, 12)
+	answer, ok := answers[name]
+	if !ok {
+		answer = &testDNSAnswer{rcode: dnsRcodeNXDomain}
+	}
+
+	msg := append([]byte{}, query[:2]...)
+	flags := uint16(0x8180) | uint16(answer.rcode)
+	if truncate {
+		flags |= 0x0200
+	}
+	msg = binary.BigEndian.AppendUint16(msg, flags)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(answer.answers)))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(answer.authority)))
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = append(msg, query[12:next+4]...)
+	if !truncate {
+		for _, rr := range append(answer.answers, answer.authority...) {
+			msg = append(msg, rr...)
+		}
+	}
+	return msg
+}
+
+/*
+ * Returns a record owned by the name of the question.
+ */
+func testDNSRecord(qtype uint16, ttl uint32, data ...byte) []byte {
+	rr := []byte{0xc0, 12}
+	rr = binary.BigEndian.AppendUint16(rr, qtype)
+	rr = binary.BigEndian.AppendUint16(rr, dnsClassIN)
+	rr = binary.BigEndian.AppendUint32(rr, ttl)
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(data)))
+	return append(rr, data...)
+}
+
+func TestDNSClient(t *testing.T) {
+	soa := append([]byte{0, 0}, make([]byte, 16)...)
+	soa = binary.BigEndian.AppendUint32(soa, 300) // MINIMUM
+	answers := map[string]*testDNSAnswer{
+		"example.com": {answers: [][]byte{
+			testDNSRecord(dnsTypeTXT, 3600, append([]byte("\x05v=spf"), "\x061 -all"...)...),
+			testDNSRecord(dnsTypeTXT, 600, []byte("\x03foo")...),
+		}},
+		"alias.example.com": {answers: [][]byte{
+			testDNSRecord(dnsTypeCNAME, 60, []byte("\x07example\x03com\x00")...),
+			testDNSRecord(dnsTypeTXT, 3600, []byte("\x03foo")...),
+		}},
+		"nodata.example.com": {authority: [][]byte{testDNSRecord(dnsTypeSOA, 900, soa...)}},
+		"mx.example.com": {answers: [][]byte{
+			testDNSRecord(dnsTypeMX, 60, append([]byte{0, 20, 4}, "mail\xc0\x0c"...)...),
+			testDNSRecord(dnsTypeMX, 60, append([]byte{0, 10, 2}, "mx\xc0\x0c"...)...),
+		}},
+		"host.example.com":     {answers: [][]byte{testDNSRecord(dnsTypeA, 60, 192, 0, 2, 1)}},
+		"servfail.example.com": {rcode: 2},
+	}
+	client := &DNSClient{Servers: []string{newTestDNSServer(t, answers, false)}, Timeout: time.Second}
+
+	ctx, report := withTTLReport(context.Background())
+	records, err := client.LookupTXT(ctx, "example.com")
+	if err != nil || len(records) != 2 || records[0] != "v=spf1 -all" || records[1] != "foo" {
+		t.Errorf("Unexpected TXT records: %q (%v)", records, err)
+	}
+	if ttl, known := report.get(); !known || ttl != 600*time.Second {
+		t.Errorf("Unexpected TTL: %v", ttl)
+	}
+
+	// a CNAME expiring first limits the TTL of the answer
+	ctx, report = withTTLReport(context.Background())
+	records, err = client.LookupTXT(ctx, "alias.example.com")
+	if err != nil || len(records) != 1 || records[0] != "foo" {
+		t.Errorf("Unexpected TXT records: %q (%v)", records, err)
+	}
+	if ttl, known := report.get(); !known || ttl != 60*time.Second {
+		t.Errorf("Unexpected TTL: %v", ttl)
+	}
+
+	ctx, report = withTTLReport(context.Background())
+	if _, err := client.LookupTXT(ctx, "nodata.example.com"); !isNoRecordsDNSError(err) {
+		t.Errorf("Expected NODATA answer but got %v", err)
+	}
+	if ttl, known := report.get(); !known || ttl != 300*time.Second {
+		t.Errorf("Unexpected negative TTL: %v", ttl)
+	}
+
+	mxs, err := client.LookupMX(context.Background(), "mx.example.com")
+	if err != nil || len(mxs) != 2 || mxs[0].Host != "mx.mx.example.com" || mxs[1].Pref != 20 {
+		t.Errorf("Unexpected MX records: %v (%v)", mxs, err)
+	}
+
+	addrs, err := client.LookupHost(context.Background(), "host.example.com")
+	if err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Errorf("Unexpected addresses: %v (%v)", addrs, err)
+	}
+
+	if _, err := client.LookupHost(context.Background(), "missing.example.com"); !isNotFoundDNSError(err) || isNoRecordsDNSError(err) {
+		t.Errorf("Expected NXDOMAIN answer but got %v", err)
+	}
+	if _, err := client.LookupHost(context.Background(), "nodata.example.com"); !isNoRecordsDNSError(err) {
+		t.Errorf("Expected NODATA answer but got %v", err)
+	}
+	if _, err := client.LookupTXT(context.Background(), "servfail.example.com"); !isTemporaryDNSError(err) {
+		t.Errorf("Expected temporary error but got %v", err)
+	}
+}
+
+func TestDNSClientTruncated(t *testing.T) {
+	answers := map[string]*testDNSAnswer{"example.com": {answers: [][]byte{testDNSRecord(dnsTypeTXT, 60, []byte("\x03foo")...)}}}
+	client := &DNSClient{Servers: []string{newTestDNSServer(t, answers, true)}, Timeout: time.Second}
+
+	records, err := client.LookupTXT(context.Background(), "example.com")
+	if err != nil || len(records) != 1 || records[0] != "foo" {
+		t.Errorf("Unexpected TXT records: %q (%v)", records, err)
+	}
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	answers := map[string]*testDNSAnswer{
+		"example.com": {answers: [][]byte{testDNSRecord(dnsTypeTXT, 60, []byte("\x03foo")...)}},
+		"example.org": {answers: [][]byte{testDNSRecord(dnsTypeTXT, 60, []byte("\x03bar")...)}},
+		"EXAMPLE.com": {answers: [][]byte{testDNSRecord(dnsTypeTXT, 60, []byte("\x03foo")...)}},
+	}
+	query, err := newDNSQuery("example.com", dnsTypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, _, err := parseDNSResponse(testDNSResponse(query, answers, false), query)
+	if err != nil || len(response.Answers) != 1 {
+		t.Errorf("Unexpected response: %+v (%v)", response, err)
+	}
+
+	// the question may differ in case only
+	other := func(name string, qtype uint16) []byte {
+		msg, _ := newDNSQuery(name, qtype)
+		copy(msg, query[:2])
+		return testDNSResponse(msg, answers, false)
+	}
+	if _, _, err := parseDNSResponse(other("EXAMPLE.com", dnsTypeTXT), query); err != nil {
+		t.Errorf("Unexpected error for the name in other case: %v", err)
+	}
+
+	for _, msg := range [][]byte{
+		other("example.org", dnsTypeTXT),
+		other("example.com", dnsTypeMX),
+		other("example.com", dnsTypeTXT)[:12],
+	} {
+		if _, _, err := parseDNSResponse(msg, query); err == nil {
+			t.Errorf("Expected error for response to other question: %q", msg)
+		}
+	}
+
+	msg := testDNSResponse(query, answers, false)
+	msg[1]++
+	if _, _, err := parseDNSResponse(msg, query); err == nil {
+		t.Error("Expected error for response with other ID")
+	}
+}
+
+func TestReadDNSName(t *testing.T) {
+	msg := []byte("\x00\x00\x07example\x03com\x00\x03www\xc0\x02\xc0\x15")
+	for _, c := range []struct {
+		off      int
+		expected string
+		next     int
+	}{
+		{2, "example.com", 15},
+		{15, "www.example.com", 21},
+	} {
+		name, next, err := readDNSName(msg, c.off)
+		if err != nil || next != c.next {
+			t.Errorf("Unexpected result at %d: %d (%v)", c.off, next, err)
+		}
+		assertStringEquals(c.expected, name, t)
+	}
+
+	// a pointer to itself
+	if _, _, err := readDNSName(msg, 21); err == nil {
+		t.Error("Expected error for compression loop")
+	}
+}
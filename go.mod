@@ -0,0 +1,5 @@
+module github.com/steffentemplin/emailauth
+
+go 1.21
+
+require github.com/BurntSushi/toml v1.6.0
@@ -0,0 +1,411 @@
+package emailauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Logging of verdicts. Validators with a Logger record each result
+ * with its inputs:
+ *
+ *  level=INFO msg=spf ip=192.0.2.1 mail-from=joe@example.com helo=mail.example.com result=pass domain=example.com
+ *  level=INFO msg=dkim domain=example.com selector=brisbane result=pass reason="1024-bit key; unprotected key"
+ *  level=INFO msg=dmarc from=example.com policy-domain=example.com result=pass disposition=none
+ *
+ * Any slog.Handler can be used; NewSyslogHandler and RotatingFile
+ * provide the sinks of the daemon.
+ */
+
+// syslog facility mail and severities (RFC 5424, section 6.2.1)
+const (
+	syslogFacilityMail = 2
+
+	syslogError   = 3
+	syslogWarning = 4
+	syslogInfo    = 6
+	syslogDebug   = 7
+)
+
+var localSyslogAddresses = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+/*
+ * Logs a verdict with the trace ID of ctx: results indicating a
+ * temporary or permanent error are logged as warnings, all others as
+ * info.
+ */
+func logVerdict(ctx context.Context, logger *slog.Logger, method string, result Result, attrs ...slog.Attr) {
+	if logger == nil {
+		return
+	}
+
+	level := slog.LevelInfo
+	if result == Temperror || result == Permerror {
+		level = slog.LevelWarn
+	}
+	logger.LogAttrs(ctx, level, method, traceAttrs(ctx, attrs)...)
+}
+
+/*
+ * Parses a level name as used in the configuration.
+ */
+func ParseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("Invalid log level: %s", name)
+	}
+	return level, nil
+}
+
+/*
+ * SyslogHandler sends records to syslog with facility mail, the
+ * severity taken from the level. Records are formatted like by
+ * slog.TextHandler, without time and level.
+ */
+type SyslogHandler struct {
+	w       *syslogWriter
+	handler slog.Handler
+}
+
+type syslogWriter struct {
+	mu       sync.Mutex
+	network  string
+	address  string
+	tag      string
+	hostname string
+	conn     net.Conn
+	severity int
+}
+
+/*
+ * Creates a handler sending to the syslog daemon at address. An empty
+ * network connects to the local syslog socket, address may then
+ * be empty to try the usual socket paths. opts may be nil.
+ */
+func NewSyslogHandler(network string, address string, tag string, opts *slog.HandlerOptions) (*SyslogHandler, error) {
+	if tag == "" {
+		tag = "emailauth"
+	}
+
+	w := &syslogWriter{network: network, address: address, tag: tag}
+	if network != "" {
+		w.hostname, _ = os.Hostname()
+	}
+
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+
+	textOpts := slog.HandlerOptions{}
+	if opts != nil {
+		textOpts = *opts
+	}
+	replace := textOpts.ReplaceAttr
+	textOpts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+			return slog.Attr{}
+		}
+		if replace != nil {
+			return replace(groups, a)
+		}
+		return a
+	}
+
+	return &SyslogHandler{w: w, handler: slog.NewTextHandler(w, &textOpts)}, nil
+}
+
+func (h *SyslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *SyslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+
+	h.w.severity = syslogSeverity(r.Level)
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *SyslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &SyslogHandler{w: h.w, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *SyslogHandler) WithGroup(name string) slog.Handler {
+	return &SyslogHandler{w: h.w, handler: h.handler.WithGroup(name)}
+}
+
+func (h *SyslogHandler) Close() error {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+
+	if h.w.conn == nil {
+		return nil
+	}
+	err := h.w.conn.Close()
+	h.w.conn = nil
+	return err
+}
+
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return syslogError
+	case level >= slog.LevelWarn:
+		return syslogWarning
+	case level >= slog.LevelInfo:
+		return syslogInfo
+	}
+	return syslogDebug
+}
+
+func (w *syslogWriter) connect() error {
+	if w.network != "" {
+		conn, err := net.Dial(w.network, w.address)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+		return nil
+	}
+
+	addresses := localSyslogAddresses
+	if w.address != "" {
+		addresses = []string{w.address}
+	}
+
+	for _, address := range addresses {
+		for _, network := range []string{"unixgram", "unix"} {
+			if conn, err := net.Dial(network, address); err == nil {
+				w.conn = conn
+				return nil
+			}
+		}
+	}
+	return errors.New("Unable to connect to local syslog daemon")
+}
+
+/*
+ * Writes a single record, formatted as in RFC 3164. Messages to the
+ * local daemon carry no hostname. A failed connection is established
+ * again once. Called with mu held.
+ */
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	timestamp := time.Now().Format(time.Stamp)
+	header := fmt.Sprintf("<%d>%s %s[%d]: ", syslogFacilityMail*8+w.severity, timestamp, w.tag, os.Getpid())
+	if w.hostname != "" {
+		header = fmt.Sprintf("<%d>%s %s %s[%d]: ", syslogFacilityMail*8+w.severity, timestamp, w.hostname, w.tag, os.Getpid())
+	}
+
+	line := header + msg
+	if w.network == "tcp" || w.network == "tcp4" || w.network == "tcp6" {
+		line += "\n"
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if err := w.connect(); err != nil {
+				return 0, err
+			}
+		}
+
+		if _, err := w.conn.Write([]byte(line)); err != nil {
+			w.conn.Close()
+			w.conn = nil
+			continue
+		}
+		return len(p), nil
+	}
+	return 0, errors.New("Unable to write to syslog")
+}
+
+/*
+ * RotatingFile is a log file rotated when it would exceed MaxSize
+ * bytes: the file is renamed to "<Path>.1", earlier rotations are
+ * shifted up to "<Path>.<MaxBackups>". MaxSize 0 disables rotation.
+ * Reopen supports external rotation, e.g. by logrotate.
+ */
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+/*
+ * Opens the file for appending, creating it if necessary.
+ */
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+/*
+ * Closes and opens the file again.
+ */
+func (f *RotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil {
+		f.file.Close()
+	}
+	return f.open()
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+
+	if f.MaxBackups > 0 {
+		for i := f.MaxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.Path, i), fmt.Sprintf("%s.%d", f.Path, i+1))
+		}
+		if err := os.Rename(f.Path, f.Path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.Path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+/*
+ * fanoutHandler passes records to several handlers.
+ */
+type fanoutHandler []slog.Handler
+
+func (h fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []string
+	for _, handler := range h {
+		if !handler.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := handler.Handle(ctx, r.Clone()); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (h fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(fanoutHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (h fanoutHandler) WithGroup(name string) slog.Handler {
+	handlers := make(fanoutHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return handlers
+}
+
+/*
+ * closers closes several sinks.
+ */
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var errs []string
+	for _, closer := range c {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+/*
+ * Returns the signature tags identifying a DKIM result.
+ */
+func dkimLogAttrs(tags map[string]string) []slog.Attr {
+	var attrs []slog.Attr
+	for _, tag := range []struct{ name, key string }{{"d", "domain"}, {"s", "selector"}, {"i", "identity"}, {"a", "algorithm"}} {
+		if value := tags[tag.name]; value != "" {
+			attrs = append(attrs, slog.String(tag.key, value))
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,124 @@
+package emailauth
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogVerdict(t *testing.T) {
+	var buf bytes.Buffer
+	v := DMARCValidator{
+		Resolver: fakeResolver{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+		Logger:   slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{ReplaceAttr: dropTime})),
+	}
+
+	v.Validate(newTestDMARCMessage("a@example.com"), &SPFResult{Result: Pass, Domain: "example.com"}, nil)
+	v.Validate(newTestDMARCMessage("invalid"), nil, nil)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records but got %q", buf.String())
+	}
+	assertStringEquals(`level=INFO msg=dmarc from=example.com policy-domain=example.com result=pass policy=reject disposition=none spf-aligned=example.com dkim-aligned="" reason=""`, lines[0], t)
+	if !strings.HasPrefix(lines[1], "level=WARN msg=dmarc from=\"\" policy-domain=\"\" result=permerror ") {
+		t.Errorf("Unexpected record: %s", lines[1])
+	}
+
+	// no logger
+	v.Logger = nil
+	v.Validate(newTestDMARCMessage("a@example.com"), nil, nil)
+}
+
+func TestSyslogHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+
+	h, err := NewSyslogHandler("", path, "milter", &slog.HandlerOptions{Level: slog.LevelDebug})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	logger := slog.New(h).With(slog.String("queue-id", "4FxyZ1"))
+	logger.Info("spf", slog.String("result", "pass"))
+	logger.Warn("dkim", slog.String("result", "temperror"))
+	logger.Debug("dmarc")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	for _, expected := range []string{
+		"<22>[A-Z][a-z]{2} [ 0-9]\\d \\d{2}:\\d{2}:\\d{2} milter\\[\\d+\\]: msg=spf queue-id=4FxyZ1 result=pass$",
+		"<20>.* milter\\[\\d+\\]: msg=dkim queue-id=4FxyZ1 result=temperror$",
+		"<23>.* milter\\[\\d+\\]: msg=dmarc queue-id=4FxyZ1$",
+	} {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !regexp.MustCompile(expected).Match(buf[:n]) {
+			t.Errorf("Expected %s but got %q", expected, buf[:n])
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "emailauth.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, expected := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertStringEquals(expected, string(data), t)
+	}
+
+	// external rotation
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("fifth\n"))
+	data, _ := ioutil.ReadFile(path)
+	assertStringEquals("fifth\n", string(data), t)
+
+	f.Close()
+	if _, err := f.Write([]byte("sixth\n")); err != os.ErrClosed {
+		t.Errorf("Expected %v but got %v", os.ErrClosed, err)
+	}
+}
+
+func dropTime(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.TimeKey {
+		return slog.Attr{}
+	}
+	return a
+}
@@ -0,0 +1,352 @@
+package emailauth
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+/*
+ * Message is the input of the validators. Headers gives access to the
+ * unfolded header field values by name. RawHeaders, if known, holds the
+ * header fields as they appear in the message, which the DKIM and ARC
+ * header canonicalization needs to verify signatures reliably. Messages
+ * built from Headers only are hashed as if each field was written as
+ * "Name: value" in the order of the names.
+ */
+type Message struct {
+	Headers    *textproto.MIMEHeader
+	Body       io.Reader
+	RawHeaders Header
+}
+
+/*
+ * HeaderField is a header field as it appears in the message: Raw is
+ * the complete field including the name, the colon and any folding,
+ * without the final CRLF.
+ */
+type HeaderField struct {
+	Name string
+	Raw  string
+}
+
+/*
+ * Header holds the header fields of a message, top to bottom.
+ */
+type Header []HeaderField
+
+const maxHeaderSize = 1 << 20
+
+func NewHeaderField(name string, value string) HeaderField {
+	return HeaderField{Name: name, Raw: name + ": " + value}
+}
+
+/*
+ * Returns everything following the colon, including leading
+ * whitespace and folding.
+ */
+func (f HeaderField) Value() string {
+	return f.Raw[strings.IndexByte(f.Raw, ':')+1:]
+}
+
+/*
+ * Returns the fields of the given name, case-insensitive, top to
+ * bottom. Signatures select fields of the same name bottom-up, i.e.
+ * starting at the end of the returned list.
+ */
+func (h Header) Fields(name string) []HeaderField {
+	var fields []HeaderField
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+/*
+ * Returns the unfolded values of the fields of the given name.
+ */
+func (h Header) Values(name string) []string {
+	var values []string
+	for _, f := range h.Fields(name) {
+		values = append(values, unfoldHeaderValue(f.Value()))
+	}
+	return values
+}
+
+func (h Header) MIMEHeader() textproto.MIMEHeader {
+	headers := make(textproto.MIMEHeader)
+	for _, f := range h {
+		headers.Add(f.Name, unfoldHeaderValue(f.Value()))
+	}
+	return headers
+}
+
+/*
+ * Returns the header fields of the message: RawHeaders if known,
+ * otherwise the fields of Headers ordered by name.
+ */
+func (m *Message) Fields() Header {
+	if m.RawHeaders != nil || m.Headers == nil {
+		return m.RawHeaders
+	}
+
+	names := make([]string, 0, len(*m.Headers))
+	for name := range *m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var fields Header
+	for _, name := range names {
+		for _, value := range (*m.Headers)[name] {
+			fields = append(fields, NewHeaderField(name, value))
+		}
+	}
+	return fields
+}
+
+/*
+ * Adds a header field on top of the message, as done by trace and
+ * signature header fields.
+ */
+func (m *Message) PrependHeader(name string, value string) {
+	if m.Headers == nil {
+		m.Headers = &textproto.MIMEHeader{}
+	}
+
+	key := textproto.CanonicalMIMEHeaderKey(name)
+	(*m.Headers)[key] = append([]string{value}, (*m.Headers)[key]...)
+
+	if m.RawHeaders != nil {
+		m.RawHeaders = append(Header{NewHeaderField(name, value)}, m.RawHeaders...)
+	}
+}
+
+/*
+ * Reads the header of a message. The body is not read, it is left to
+ * the validators reading from the returned message.
+ */
+func ReadMessage(r io.Reader) (*Message, error) {
+	br := bufio.NewReader(r)
+	b := NewMessageBuilder()
+	for !b.inBody {
+		line, err := br.ReadSlice('\n')
+		if _, werr := b.Write(line); werr != nil {
+			return nil, werr
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+
+	if err := b.EndHeader(); err != nil {
+		return nil, err
+	}
+
+	headers := b.fields.MIMEHeader()
+	return &Message{Headers: &headers, Body: br, RawHeaders: b.fields}, nil
+}
+
+/*
+ * MessageBuilder builds messages from data arriving in chunks, e.g.
+ * from a milter or LMTP session. The header is collected either from
+ * raw message data passed to Write or field by field with AddHeader.
+ * Once the header is complete, each message returned by Message reads
+ * the body written afterwards through a pipe, so the body is never
+ * buffered: the readers must consume it concurrently, and readers that
+ * stop early should close the body.
+ */
+type MessageBuilder struct {
+	fields Header
+	field  []byte // current field, continuation lines included
+	line   []byte // incomplete line
+	size   int
+	inBody bool
+	bodies []*io.PipeWriter
+}
+
+func NewMessageBuilder() *MessageBuilder {
+	return &MessageBuilder{fields: Header{}}
+}
+
+/*
+ * Adds a header field. The value is everything following the colon,
+ * including leading whitespace and folding.
+ */
+func (b *MessageBuilder) AddHeader(name string, value string) error {
+	if b.inBody {
+		return errors.New("Header already complete")
+	}
+	return b.add(name + ":" + value)
+}
+
+/*
+ * Writes raw message data: header lines until the empty line ending
+ * the header, then the body.
+ */
+func (b *MessageBuilder) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && !b.inBody {
+		idx := bytes.IndexByte(p, '\n')
+		if idx < 0 {
+			b.line = append(b.line, p...)
+			p = nil
+			break
+		}
+
+		b.line = append(b.line, p[:idx+1]...)
+		p = p[idx+1:]
+		if err := b.headerLine(b.line); err != nil {
+			return 0, err
+		}
+		b.line = b.line[:0]
+	}
+
+	if len(b.line) > maxHeaderSize {
+		return 0, errors.New("Header too large")
+	}
+
+	if len(p) > 0 {
+		b.writeBody(p)
+	}
+	return n, nil
+}
+
+/*
+ * Marks the end of the header, if not already seen by Write.
+ */
+func (b *MessageBuilder) EndHeader() error {
+	if b.inBody {
+		return nil
+	}
+
+	if len(bytes.TrimRight(b.line, "\r\n")) > 0 {
+		if err := b.headerLine(b.line); err != nil {
+			return err
+		}
+	}
+
+	b.line = nil
+	b.inBody = true
+	return b.flushField()
+}
+
+/*
+ * Ends the header and returns a message reading the body written from
+ * now on.
+ */
+func (b *MessageBuilder) Message() (*Message, error) {
+	if err := b.EndHeader(); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	b.bodies = append(b.bodies, pw)
+	headers := b.fields.MIMEHeader()
+	return &Message{Headers: &headers, Body: pr, RawHeaders: b.fields}, nil
+}
+
+/*
+ * Ends the body of the messages.
+ */
+func (b *MessageBuilder) Close() error {
+	return b.CloseWithError(nil)
+}
+
+/*
+ * Ends the body of the messages; their readers get err instead of
+ * io.EOF, e.g. if the transaction was aborted.
+ */
+func (b *MessageBuilder) CloseWithError(err error) error {
+	for _, w := range b.bodies {
+		if w != nil {
+			w.CloseWithError(err)
+		}
+	}
+	b.bodies = nil
+	return nil
+}
+
+func (b *MessageBuilder) headerLine(line []byte) error {
+	if len(bytes.TrimRight(line, "\r\n")) == 0 {
+		b.inBody = true
+		return b.flushField()
+	}
+
+	b.size += len(line)
+	if b.size > maxHeaderSize {
+		return errors.New("Header too large")
+	}
+
+	if (line[0] == ' ' || line[0] == '\t') && b.field != nil {
+		b.field = append(b.field, line...)
+		return nil
+	}
+
+	if err := b.flushField(); err != nil {
+		return err
+	}
+	b.field = append([]byte(nil), line...)
+	return nil
+}
+
+func (b *MessageBuilder) flushField() error {
+	if b.field == nil {
+		return nil
+	}
+
+	raw := strings.TrimRight(string(b.field), "\r\n")
+	b.field = nil
+	return b.add(raw)
+}
+
+func (b *MessageBuilder) add(raw string) error {
+	// bare LF line endings are treated as CRLF
+	raw = strings.Replace(raw, "\r\n", "\n", -1)
+	raw = strings.Replace(raw, "\n", "\r\n", -1)
+
+	idx := strings.IndexByte(raw, ':')
+	if idx < 0 {
+		return errors.New("Invalid header line: " + sanitizeDomainForPrinting(raw))
+	}
+
+	name := strings.TrimRight(raw[:idx], " \t")
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return errors.New("Invalid header field name: " + sanitizeDomainForPrinting(name))
+	}
+
+	b.fields = append(b.fields, HeaderField{Name: name, Raw: raw})
+	return nil
+}
+
+/*
+ * Passes body data to all readers. Readers that were closed are
+ * skipped from then on.
+ */
+func (b *MessageBuilder) writeBody(p []byte) {
+	for i, w := range b.bodies {
+		if w == nil {
+			continue
+		}
+
+		if _, err := w.Write(p); err != nil {
+			b.bodies[i] = nil
+		}
+	}
+}
+
+func unfoldHeaderValue(value string) string {
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = strings.Replace(value, "\n", "", -1)
+	return strings.TrimSpace(value)
+}
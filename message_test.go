@@ -0,0 +1,191 @@
+package emailauth
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testRawHeader = "Received: from relay.example.net\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"subject:  Is dinner\r\n" +
+	"\tready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"Received: from mail.football.example.com\r\n"
+
+func readTestMessage(t *testing.T, data string) *Message {
+	message, err := ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+/*
+ * Serializes a message as read by ReadMessage.
+ */
+func writeTestMessage(message *Message) string {
+	var b strings.Builder
+	for _, field := range message.RawHeaders {
+		b.WriteString(field.Raw + "\r\n")
+	}
+	b.WriteString("\r\n" + testMessageBody)
+	return b.String()
+}
+
+func TestReadMessage(t *testing.T) {
+	message := readTestMessage(t, testRawHeader+"\r\n"+testMessageBody)
+	if len(message.RawHeaders) != 7 {
+		t.Fatalf("Expected 7 header fields but got %d", len(message.RawHeaders))
+	}
+
+	subject := message.RawHeaders[3]
+	assertStringEquals("subject", subject.Name, t)
+	assertStringEquals("subject:  Is dinner\r\n\tready?", subject.Raw, t)
+	assertStringEquals("Is dinner\tready?", message.Headers.Get("Subject"), t)
+
+	received := message.Fields().Values("received")
+	if len(received) != 2 || received[1] != "from mail.football.example.com" {
+		t.Errorf("Unexpected Received fields: %v", received)
+	}
+
+	body, err := ioutil.ReadAll(message.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStringEquals(testMessageBody, string(body), t)
+
+	// bare LF line endings and no body
+	message = readTestMessage(t, "From: joe@football.example.com\nSubject: a\n b\n")
+	assertStringEquals("Subject: a\r\n b", message.RawHeaders[1].Raw, t)
+
+	if _, err := ReadMessage(strings.NewReader("From joe@football.example.com\r\n\r\n")); err == nil {
+		t.Error("Expected error for invalid header line")
+	}
+}
+
+func TestDKIMValidateRawHeader(t *testing.T) {
+	key, pub := newTestKey(t, 1024)
+	v := DKIMValidator{Resolver: fakeResolver{"brisbane._domainkey.football.example.com": {"v=DKIM1; k=rsa; p=" + pub}}}
+
+	// the simple canonicalization relies on the original field names and folding
+	message := readTestMessage(t, testRawHeader+"\r\n"+testMessageBody)
+	signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=simple/simple; d=football.example.com; s=brisbane; h=From:Subject:Received")
+	data := writeTestMessage(message)
+	if !strings.HasPrefix(data, "DKIM-Signature: v=1;") {
+		t.Errorf("Expected signature on top: %s", data)
+	}
+
+	results := v.Validate(readTestMessage(t, data))
+	if results[0].Result != Pass {
+		t.Errorf("Expected 'pass' but got '%s' (%s)", results[0].Result, results[0].Reason)
+	}
+
+	// only the bottom-most Received field is signed
+	modified := strings.Replace(data, "from relay.example.net", "from other.example.net", 1)
+	results = v.Validate(readTestMessage(t, modified))
+	if results[0].Result != Pass {
+		t.Errorf("Expected 'pass' but got '%s' (%s)", results[0].Result, results[0].Reason)
+	}
+
+	for _, modified := range []string{
+		strings.Replace(data, "Is dinner\r\n\tready?", "Is dinner ready?", 1),
+		strings.Replace(data, "subject:", "Subject:", 1),
+		strings.Replace(data, "from mail.football.example.com", "from other.example.net", 1),
+	} {
+		results = v.Validate(readTestMessage(t, modified))
+		if results[0].Result != Fail {
+			t.Errorf("Expected 'fail' but got '%s' (%s)", results[0].Result, results[0].Reason)
+		}
+	}
+}
+
+func TestMessageBuilder(t *testing.T) {
+	data := testRawHeader + "\r\n" + testMessageBody
+	b := NewMessageBuilder()
+	if _, err := b.Write([]byte(data[:len(testRawHeader)+5])); err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []*Message
+	for i := 0; i < 2; i++ {
+		message, err := b.Message()
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, message)
+	}
+	if len(messages[0].RawHeaders) != 7 || messages[0].Headers.Get("From") != "Joe SixPack <joe@football.example.com>" {
+		t.Fatalf("Unexpected header: %v", messages[0].RawHeaders)
+	}
+
+	// the first reader stops early
+	bodies := make([]string, len(messages))
+	var wg sync.WaitGroup
+	for i, message := range messages {
+		wg.Add(1)
+		go func(i int, message *Message) {
+			defer wg.Done()
+			if i == 0 {
+				closeBody(message)
+				return
+			}
+			body, _ := ioutil.ReadAll(message.Body)
+			bodies[i] = string(body)
+		}(i, message)
+	}
+
+	// the body is passed on in small chunks
+	body := []byte(data[len(testRawHeader)+5:])
+	for len(body) > 0 {
+		n := 7
+		if n > len(body) {
+			n = len(body)
+		}
+		if _, err := b.Write(body[:n]); err != nil {
+			t.Fatal(err)
+		}
+		body = body[n:]
+	}
+	b.Close()
+	wg.Wait()
+
+	// the first 3 bytes of the body arrived before the readers were created
+	assertStringEquals(testMessageBody[3:], bodies[1], t)
+}
+
+func TestMessageBuilderAddHeader(t *testing.T) {
+	b := NewMessageBuilder()
+	b.AddHeader("From", " joe@football.example.com")
+	b.AddHeader("Subject", "Is dinner\n\tready?")
+	message, err := b.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertStringEquals("Subject:Is dinner\r\n\tready?", message.RawHeaders[1].Raw, t)
+	if err := b.AddHeader("To", " suzie@shopping.example.net"); err == nil {
+		t.Error("Expected error for header field after end of header")
+	}
+
+	aborted := errors.New("Aborted")
+	go func() {
+		b.Write([]byte("Hi.\r\n"))
+		b.CloseWithError(aborted)
+	}()
+
+	body, err := ioutil.ReadAll(message.Body)
+	if err != aborted || !bytes.Equal(body, []byte("Hi.\r\n")) {
+		t.Errorf("Expected partial body and error but got %q, %v", body, err)
+	}
+
+	if _, err := io.Copy(ioutil.Discard, message.Body); err != aborted {
+		t.Errorf("Expected error after abort but got %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package emailauth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Metrics of the validators. Validators with Metrics report each result,
+ * the DNS lookups of each evaluation and their latency, as seen by the
+ * validator (including cached answers). PrometheusMetrics exports them
+ * in the Prometheus text format (version 0.0.4):
+ *
+ *  emailauth_verdicts_total{method="dmarc",result="pass"} 1027
+ *  emailauth_dns_lookups_per_evaluation_bucket{method="spf",le="2"} 998
+ *  emailauth_dns_lookup_duration_seconds_bucket{type="TXT",le="0.01"} 3110
+ *  emailauth_limits_exceeded_total{method="spf"} 3
+ *  emailauth_dns_cache_hit_ratio 0.87
+ */
+
+/*
+ * Metrics receives the observations of the validators. It must be safe
+ * for concurrent use.
+ */
+type Metrics interface {
+	// a result of the validator of method ("spf", "dkim", "dkim-atps",
+	// "dkim-adsp", "dmarc", "arc")
+	ObserveVerdict(method string, result Result)
+	// the DNS lookups made by one evaluation of a message
+	ObserveEvaluation(method string, lookups int)
+	// a single lookup; err is nil for answers
+	ObserveLookup(qtype string, duration time.Duration, err error)
+	// an evaluation failed by a lookup limit: the SPF limit of RFC 7208
+	// (permerror) or the limit of the context (temperror)
+	ObserveLimitExceeded(method string)
+}
+
+var (
+	lookupsPerEvaluationBuckets = []float64{0, 1, 2, 3, 5, 10, 20}
+	lookupDurationBuckets       = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+)
+
+/*
+ * PrometheusMetrics collects the metrics in memory and writes them in
+ * the Prometheus text format, served over HTTP by ServeHTTP. The
+ * statistics of the cache set with SetCache are added when writing.
+ */
+type PrometheusMetrics struct {
+	mu         sync.Mutex
+	verdicts   map[[2]string]uint64
+	limits     map[string]uint64
+	lookupErrs map[[2]string]uint64
+	lookups    map[string]*histogram
+	durations  map[string]*histogram
+	cache      *CachingResolver
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		verdicts:   make(map[[2]string]uint64),
+		limits:     make(map[string]uint64),
+		lookupErrs: make(map[[2]string]uint64),
+		lookups:    make(map[string]*histogram),
+		durations:  make(map[string]*histogram),
+	}
+}
+
+func (m *PrometheusMetrics) ObserveVerdict(method string, result Result) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.verdicts[[2]string{method, result.String()}]++
+}
+
+func (m *PrometheusMetrics) ObserveEvaluation(method string, lookups int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	observe(m.lookups, method, lookupsPerEvaluationBuckets, float64(lookups))
+}
+
+func (m *PrometheusMetrics) ObserveLookup(qtype string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	observe(m.durations, qtype, lookupDurationBuckets, duration.Seconds())
+
+	switch {
+	case err == nil:
+	case isNotFoundDNSError(err):
+		m.lookupErrs[[2]string{qtype, "notfound"}]++
+	case isTemporaryDNSError(err):
+		m.lookupErrs[[2]string{qtype, "temporary"}]++
+	default:
+		m.lookupErrs[[2]string{qtype, "other"}]++
+	}
+}
+
+func (m *PrometheusMetrics) ObserveLimitExceeded(method string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limits[method]++
+}
+
+/*
+ * Sets the cache whose statistics are exported, nil for none.
+ */
+func (m *PrometheusMetrics) SetCache(cache *CachingResolver) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cache = cache
+}
+
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+/*
+ * Writes all metrics in the text format, sorted by name and labels.
+ */
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	m.mu.Lock()
+	writeMetricHeader(cw, "emailauth_verdicts_total", "counter", "Results of the validators.")
+	for _, key := range sortedLabelPairs(m.verdicts) {
+		fmt.Fprintf(cw, "emailauth_verdicts_total{method=%s,result=%s} %d\n", quoteLabel(key[0]), quoteLabel(key[1]), m.verdicts[key])
+	}
+
+	writeMetricHeader(cw, "emailauth_limits_exceeded_total", "counter", "Evaluations failed by a DNS lookup limit.")
+	for _, method := range sortedKeys(m.limits) {
+		fmt.Fprintf(cw, "emailauth_limits_exceeded_total{method=%s} %d\n", quoteLabel(method), m.limits[method])
+	}
+
+	writeHistograms(cw, "emailauth_dns_lookups_per_evaluation", "method", "DNS lookups of a single evaluation.", m.lookups)
+	writeHistograms(cw, "emailauth_dns_lookup_duration_seconds", "type", "Duration of DNS lookups, including cached answers.", m.durations)
+
+	writeMetricHeader(cw, "emailauth_dns_lookup_errors_total", "counter", "DNS lookups without answer.")
+	for _, key := range sortedLabelPairs(m.lookupErrs) {
+		fmt.Fprintf(cw, "emailauth_dns_lookup_errors_total{type=%s,error=%s} %d\n", quoteLabel(key[0]), quoteLabel(key[1]), m.lookupErrs[key])
+	}
+	cache := m.cache
+	m.mu.Unlock()
+
+	if cache != nil {
+		stats := cache.Stats()
+		for _, counter := range []struct {
+			name  string
+			help  string
+			value uint64
+		}{
+			{"emailauth_dns_cache_hits_total", "Lookups answered from the DNS cache, including negative answers.", stats.Hits},
+			{"emailauth_dns_cache_negative_hits_total", "Lookups answered from the DNS cache with a negative answer.", stats.NegativeHits},
+			{"emailauth_dns_cache_misses_total", "Lookups passed to DNS.", stats.Misses},
+			{"emailauth_dns_cache_shared_total", "Lookups waiting for an identical lookup in progress.", stats.Shared},
+			{"emailauth_dns_cache_evictions_total", "Answers evicted from the DNS cache.", stats.Evictions},
+		} {
+			writeMetricHeader(cw, counter.name, "counter", counter.help)
+			fmt.Fprintf(cw, "%s %d\n", counter.name, counter.value)
+		}
+
+		writeMetricHeader(cw, "emailauth_dns_cache_entries", "gauge", "Answers in the DNS cache.")
+		fmt.Fprintf(cw, "emailauth_dns_cache_entries %d\n", stats.Entries)
+
+		ratio := 0.0
+		if total := stats.Hits + stats.Shared + stats.Misses; total > 0 {
+			ratio = float64(stats.Hits+stats.Shared) / float64(total)
+		}
+		writeMetricHeader(cw, "emailauth_dns_cache_hit_ratio", "gauge", "Share of lookups not passed to DNS.")
+		fmt.Fprintf(cw, "emailauth_dns_cache_hit_ratio %s\n", formatFloat(ratio))
+	}
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+/*
+ * Reports the results of an evaluation and the lookups it made, and
+ * whether the lookup limit of its context failed it.
+ */
+func observeEvaluation(metrics Metrics, method string, resolver *tracedResolver, results ...Result) {
+	if metrics == nil {
+		return
+	}
+
+	if resolver.limitExceeded() {
+		metrics.ObserveLimitExceeded(method)
+	}
+	metrics.ObserveEvaluation(method, resolver.lookupCount())
+	for _, result := range results {
+		metrics.ObserveVerdict(method, result)
+	}
+}
+
+func observe(histograms map[string]*histogram, label string, buckets []float64, value float64) {
+	h, ok := histograms[label]
+	if !ok {
+		h = &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+		histograms[label] = h
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func writeHistograms(w io.Writer, name string, labelName string, help string, histograms map[string]*histogram) {
+	writeMetricHeader(w, name, "histogram", help)
+	for _, label := range sortedHistogramKeys(histograms) {
+		h := histograms[label]
+		labels := labelName + "=" + quoteLabel(label)
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+func writeMetricHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func quoteLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedHistogramKeys(m map[string]*histogram) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedLabelPairs(m map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
@@ -0,0 +1,122 @@
+package emailauth
+
+import (
+	"context"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics()
+	resolver := &CachingResolver{Resolver: fakeResolver{"_dmarc.example.com": {"v=DMARC1; p=reject"}}}
+	m.SetCache(resolver)
+
+	v := DMARCValidator{Resolver: resolver, Metrics: m}
+	v.Validate(newTestDMARCMessage("a@example.com"), &SPFResult{Result: Pass, Domain: "example.com"}, nil)
+	v.Validate(newTestDMARCMessage("b@example.com"), nil, nil)
+
+	dkim := DKIMValidator{Resolver: resolver, Metrics: m}
+	dkim.Validate(newTestMessage())
+
+	m.ObserveLookup("TXT", 30*time.Millisecond, nil)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assertStringEquals("text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"), t)
+	output := w.Body.String()
+
+	for _, expected := range []string{
+		`emailauth_verdicts_total{method="dkim",result="none"} 1`,
+		`emailauth_verdicts_total{method="dmarc",result="fail"} 1`,
+		`emailauth_verdicts_total{method="dmarc",result="pass"} 1`,
+		`emailauth_dns_lookups_per_evaluation_bucket{method="dkim",le="0"} 1`,
+		`emailauth_dns_lookups_per_evaluation_bucket{method="dmarc",le="0"} 0`,
+		`emailauth_dns_lookups_per_evaluation_bucket{method="dmarc",le="1"} 2`,
+		`emailauth_dns_lookups_per_evaluation_sum{method="dmarc"} 2`,
+		`emailauth_dns_lookups_per_evaluation_count{method="dmarc"} 2`,
+		`emailauth_dns_lookup_duration_seconds_bucket{type="TXT",le="0.025"} 2`,
+		`emailauth_dns_lookup_duration_seconds_bucket{type="TXT",le="0.05"} 3`,
+		`emailauth_dns_lookup_duration_seconds_bucket{type="TXT",le="+Inf"} 3`,
+		`emailauth_dns_lookup_duration_seconds_count{type="TXT"} 3`,
+		"emailauth_dns_cache_hits_total 1",
+		"emailauth_dns_cache_misses_total 1",
+		"emailauth_dns_cache_entries 1",
+		"emailauth_dns_cache_hit_ratio 0.5",
+		"# TYPE emailauth_dns_lookup_duration_seconds histogram",
+	} {
+		if !strings.Contains(output, expected+"\n") {
+			t.Errorf("Expected %s in:\n%s", expected, output)
+		}
+	}
+
+	// every line is a comment or a sample
+	sample := regexp.MustCompile(`^[a-z_]+(\{([a-z]+="[^"]*",?)+\})? [0-9.e+-]+$`)
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if !strings.HasPrefix(line, "# ") && !sample.MatchString(line) {
+			t.Errorf("Invalid line: %s", line)
+		}
+	}
+}
+
+func TestMetricsLimitExceeded(t *testing.T) {
+	m := NewPrometheusMetrics()
+	resolver := fakeResolver{"_dmarc.example.com": {"v=DMARC1; p=reject"}}
+	ctx := WithLookupLimit(context.Background(), 1)
+
+	// the policy is looked up, the existence of the author domain is not
+	dmarc := DMARCValidator{Resolver: resolver, Metrics: m}
+	if result := dmarc.ValidateContext(ctx, newTestDMARCMessage("a@example.com"), nil, nil); result.Result != Fail {
+		t.Errorf("Expected 'fail' but got '%s' (%s)", result.Result, result.Reason)
+	}
+	if result := dmarc.ValidateContext(ctx, newTestDMARCMessage("a@sub.example.com"), nil, nil); result.Result != Temperror {
+		t.Errorf("Expected 'temperror' but got '%s' (%s)", result.Result, result.Reason)
+	}
+
+	// signatures above the maximum are ignored, which is not an error
+	message := newTestMessage()
+	message.Headers.Add("DKIM-Signature", "v=1; a=rsa-sha256; d=example.com; s=a; h=from; bh=AA==; b=AA==")
+	message.Headers.Add("DKIM-Signature", "v=1; a=rsa-sha256; d=example.com; s=b; h=from; bh=AA==; b=AA==")
+	if results := (DKIMValidator{Resolver: resolver, MaxSignatures: 1, Metrics: m}).Validate(message); len(results) != 1 {
+		t.Errorf("Expected 1 result but got %d", len(results))
+	}
+
+	var b strings.Builder
+	m.WriteTo(&b)
+	for _, expected := range []string{
+		`emailauth_limits_exceeded_total{method="dmarc"} 1`,
+		`emailauth_verdicts_total{method="dmarc",result="temperror"} 1`,
+		`emailauth_verdicts_total{method="dkim",result="permerror"} 1`,
+	} {
+		if !strings.Contains(b.String(), expected+"\n") {
+			t.Errorf("Expected %s in:\n%s", expected, b.String())
+		}
+	}
+	if strings.Contains(b.String(), `emailauth_limits_exceeded_total{method="dkim"}`) {
+		t.Errorf("Expected no DKIM limit in:\n%s", b.String())
+	}
+}
+
+func TestMetricsLookupErrors(t *testing.T) {
+	m := NewPrometheusMetrics()
+	v := SPFValidator{Resolver: fakeResolver{}, Metrics: m}
+	v.ValidateContext(context.Background(), nil, "a@example.com", "mail.example.com")
+
+	var b strings.Builder
+	m.WriteTo(&b)
+	for _, expected := range []string{
+		`emailauth_verdicts_total{method="spf",result="none"} 1`,
+		`emailauth_dns_lookup_errors_total{type="TXT",error="notfound"} 1`,
+		`emailauth_dns_lookups_per_evaluation_bucket{method="spf",le="1"} 1`,
+	} {
+		if !strings.Contains(b.String(), expected+"\n") {
+			t.Errorf("Expected %s in:\n%s", expected, b.String())
+		}
+	}
+
+	if strings.Contains(b.String(), "emailauth_dns_cache_") {
+		t.Error("Expected no cache metrics without cache")
+	}
+}
@@ -0,0 +1,483 @@
+package emailauth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Milter server (Sendmail milter protocol version 6) running the
+ * validators on incoming messages, e.g. for Postfix:
+ *
+ *  smtpd_milters = inet:127.0.0.1:8891
+ *  milter_protocol = 6
+ *
+ * Each packet is a 32-bit length in network byte order followed by a
+ * command byte and the command data.
+ */
+
+/*
+ * Milter validates messages during the SMTP transaction. Each message
+ * gets an Authentication-Results header field. Messages failing DMARC
+ * are rejected or quarantined according to the applied disposition if
+ * RejectDMARC or QuarantineDMARC are set. If ARC is set, the DMARC
+ * policy may be overridden by trusted ARC sealers. If Reporter is set,
+ * DMARC results are recorded for aggregate reports. If Timeout is set,
+ * connections are closed when the MTA does not send the next command
+ * in time. If MaxLookups is set, each validator fails with "temperror"
+ * after that many DNS lookups for a message (see WithLookupLimit).
+ *
+ * Each message gets a trace ID passed to the validators, which log it
+ * with their results. If TraceComment is set, it is also added to the
+ * Authentication-Results header field.
+ */
+type Milter struct {
+	AuthServID      string
+	SPF             SPFValidator
+	DKIM            DKIMValidator
+	DMARC           DMARCValidator
+	ARC             *ARCValidator
+	RejectDMARC     bool
+	QuarantineDMARC bool
+	Reporter        *AggregateReporter
+	Timeout         time.Duration
+	MaxLookups      int
+	TraceComment    bool
+}
+
+// commands
+const (
+	milterAbort   = 'A'
+	milterBody    = 'B'
+	milterConnect = 'C'
+	milterMacro   = 'D'
+	milterEOB     = 'E'
+	milterHelo    = 'H'
+	milterQuitNC  = 'K'
+	milterHeader  = 'L'
+	milterMail    = 'M'
+	milterEOH     = 'N'
+	milterOptNeg  = 'O'
+	milterQuit    = 'Q'
+	milterRcpt    = 'R'
+	milterData    = 'T'
+	milterUnknown = 'U'
+)
+
+// responses
+const (
+	milterAccept     = 'a'
+	milterContinue   = 'c'
+	milterInsHeader  = 'i'
+	milterQuarantine = 'q'
+	milterReplyCode  = 'y'
+)
+
+// actions and protocol flags negotiated with OPTNEG
+const (
+	milterActionAddHeaders = 0x01
+	milterActionQuarantine = 0x20
+
+	milterProtoNoUnknown    = 0x100
+	milterProtoNoData       = 0x200
+	milterProtoLeadingSpace = 0x100000
+
+	milterVersion   = 6
+	maxMilterPacket = 1 << 20
+)
+
+/*
+ * Accepts connections from the MTA and serves each of them in its own
+ * goroutine. Returns when the listener fails, e.g. after it was closed.
+ */
+func (m *Milter) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go m.ServeConn(conn)
+	}
+}
+
+/*
+ * Serves a single MTA connection until the MTA quits. The connection
+ * is closed on return.
+ */
+func (m *Milter) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	s := &milterSession{milter: m, r: bufio.NewReader(conn), w: conn}
+	s.reset(true)
+	defer s.reset(true)
+
+	for {
+		if m.Timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(m.Timeout))
+		}
+
+		cmd, data, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		done, err := s.handle(cmd, data)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+type milterSession struct {
+	milter       *Milter
+	r            *bufio.Reader
+	w            io.Writer
+	actions      uint32
+	leadingSpace bool
+	macros       map[string]string
+	envelope     Envelope
+	builder      *MessageBuilder
+	traceID      string
+	cancel       context.CancelFunc
+	results      <-chan *AuthenticationResults
+}
+
+/*
+ * Resets the state of the current message, and of the connection if
+ * connection is set. Validations still running are aborted.
+ */
+func (s *milterSession) reset(connection bool) {
+	if connection {
+		s.envelope = Envelope{}
+		s.macros = make(map[string]string)
+	}
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	if s.results != nil {
+		s.builder.CloseWithError(errors.New("Message aborted"))
+		<-s.results
+	}
+
+	s.envelope.MailFrom = ""
+	s.envelope.RcptTo = nil
+	s.builder = NewMessageBuilder()
+	s.traceID = NewTraceID()
+	s.cancel = nil
+	s.results = nil
+}
+
+func (s *milterSession) handle(cmd byte, data []byte) (bool, error) {
+	switch cmd {
+	case milterOptNeg:
+		return false, s.negotiate(data)
+
+	case milterMacro:
+		// command byte followed by name/value pairs
+		if len(data) > 0 {
+			fields := splitMilterStrings(data[1:])
+			for i := 0; i+1 < len(fields); i += 2 {
+				s.macros[strings.Trim(fields[i], "{}")] = fields[i+1]
+			}
+		}
+		return false, nil
+
+	case milterConnect:
+		s.envelope.ClientIP = parseMilterAddress(data)
+	case milterHelo:
+		if fields := splitMilterStrings(data); len(fields) > 0 {
+			s.envelope.Helo = fields[0]
+		}
+	case milterMail:
+		s.reset(false)
+		if fields := splitMilterStrings(data); len(fields) > 0 {
+			s.envelope.MailFrom = strings.Trim(fields[0], "<>")
+		}
+	case milterRcpt:
+		if fields := splitMilterStrings(data); len(fields) > 0 {
+			s.envelope.RcptTo = append(s.envelope.RcptTo, strings.Trim(fields[0], "<>"))
+		}
+	case milterHeader:
+		fields := splitMilterStrings(data)
+		if len(fields) != 2 {
+			return false, errors.New("Invalid header packet")
+		}
+		value := fields[1]
+		if !s.leadingSpace {
+			value = " " + value
+		}
+		if err := s.builder.AddHeader(fields[0], value); err != nil {
+			return false, err
+		}
+	case milterEOH:
+		if err := s.startValidation(); err != nil {
+			return false, err
+		}
+	case milterBody:
+		if err := s.startValidation(); err != nil {
+			return false, err
+		}
+		s.builder.Write(data)
+	case milterEOB:
+		if err := s.startValidation(); err != nil {
+			return false, err
+		}
+		s.builder.Write(data)
+		s.builder.Close()
+		ar := <-s.results
+		s.results = nil
+		err := s.endOfMessage(ar)
+		s.reset(false)
+		return false, err
+
+	case milterAbort:
+		s.reset(false)
+		return false, nil
+	case milterQuitNC:
+		s.reset(true)
+		return false, nil
+	case milterQuit:
+		return true, nil
+
+	case milterData, milterUnknown:
+	default:
+		return false, fmt.Errorf("Unknown milter command: %q", cmd)
+	}
+
+	return false, s.write(milterContinue, nil)
+}
+
+/*
+ * Answers the option negotiation of the MTA with the actions and
+ * protocol steps needed.
+ */
+func (s *milterSession) negotiate(data []byte) error {
+	if len(data) < 12 {
+		return errors.New("Invalid option negotiation")
+	}
+
+	version := binary.BigEndian.Uint32(data)
+	if version < 2 {
+		return fmt.Errorf("Unsupported milter version: %d", version)
+	}
+	if version > milterVersion {
+		version = milterVersion
+	}
+
+	s.actions = binary.BigEndian.Uint32(data[4:]) & (milterActionAddHeaders | milterActionQuarantine)
+	protocol := binary.BigEndian.Uint32(data[8:]) & (milterProtoNoUnknown | milterProtoNoData | milterProtoLeadingSpace)
+	s.leadingSpace = protocol&milterProtoLeadingSpace != 0
+
+	reply := make([]byte, 12)
+	binary.BigEndian.PutUint32(reply, version)
+	binary.BigEndian.PutUint32(reply[4:], s.actions)
+	binary.BigEndian.PutUint32(reply[8:], protocol)
+	return s.write(milterOptNeg, reply)
+}
+
+/*
+ * Starts validating the message once the header is complete, so that
+ * the body is validated while it is received.
+ */
+func (s *milterSession) startValidation() error {
+	if s.results != nil {
+		return nil
+	}
+
+	ctx := WithLookupLimit(WithTraceID(context.Background(), s.traceID), s.milter.MaxLookups)
+	ctx, cancel := context.WithCancel(ctx)
+	results, err := s.milter.validate(ctx, s.envelope, s.builder)
+	if err != nil {
+		cancel()
+		return err
+	}
+	s.cancel = cancel
+	s.results = results
+	return nil
+}
+
+func (s *milterSession) endOfMessage(ar *AuthenticationResults) error {
+	dmarc := ar.DMARC
+	if ar.AuthServID == "" {
+		ar.AuthServID = s.macros["j"]
+	}
+
+	if s.actions&milterActionAddHeaders != 0 {
+		var data bytes.Buffer
+		binary.Write(&data, binary.BigEndian, uint32(0))
+		data.WriteString("Authentication-Results\x00" + ar.String() + "\x00")
+		if err := s.write(milterInsHeader, data.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if s.milter.Reporter != nil && dmarc != nil && dmarc.PolicyDomain != "" {
+		envelopeTo := ""
+		if len(s.envelope.RcptTo) > 0 {
+			envelopeTo = domainOfIdentity(s.envelope.RcptTo[0])
+		}
+		s.milter.Reporter.Record(s.envelope.ClientIP, envelopeTo, dmarc)
+	}
+
+	if dmarc != nil && dmarc.Result == Fail {
+		reason := fmt.Sprintf("DMARC policy of %s", dmarc.Domain)
+		switch {
+		case dmarc.Disposition == DispositionReject && s.milter.RejectDMARC:
+			return s.write(milterReplyCode, []byte("550 5.7.1 Rejected due to "+reason+"\x00"))
+		case dmarc.Disposition == DispositionQuarantine && s.milter.QuarantineDMARC && s.actions&milterActionQuarantine != 0:
+			if err := s.write(milterQuarantine, []byte("Quarantined due to "+reason+"\x00")); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.write(milterAccept, nil)
+}
+
+/*
+ * Starts the validators on a message whose header is complete. The
+ * body written to the builder is passed to the validators while they
+ * run; the results are sent once the builder is closed. Lookups are
+ * aborted when ctx is canceled.
+ */
+func (m *Milter) validate(ctx context.Context, envelope Envelope, builder *MessageBuilder) (<-chan *AuthenticationResults, error) {
+	message, err := builder.Message()
+	if err != nil {
+		return nil, err
+	}
+
+	var arcMessage *Message
+	if m.ARC != nil {
+		if arcMessage, err = builder.Message(); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make(chan *AuthenticationResults, 1)
+	go func() {
+		ar := &AuthenticationResults{AuthServID: m.AuthServID}
+		if m.TraceComment {
+			ar.TraceID = TraceID(ctx)
+		}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ar.DKIM = m.DKIM.ValidateContext(ctx, message)
+			closeBody(message)
+		}()
+
+		if arcMessage != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ar.ARC = m.ARC.ValidateContext(ctx, arcMessage)
+				closeBody(arcMessage)
+			}()
+		}
+
+		if envelope.ClientIP != nil {
+			from := envelope.MailFrom
+			if from == "" {
+				from = "postmaster@" + envelope.Helo
+			}
+			ar.SPF = m.SPF.ValidateContext(ctx, envelope.ClientIP, from, envelope.Helo)
+		}
+
+		wg.Wait()
+		ar.DMARC = m.DMARC.ValidateWithARCContext(ctx, message, ar.SPF, ar.DKIM, ar.ARC)
+		results <- ar
+	}()
+	return results, nil
+}
+
+/*
+ * Closes the body of a message read by a validator, so that body data
+ * the validator did not need does not block the session.
+ */
+func closeBody(message *Message) {
+	if c, ok := message.Body.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (s *milterSession) read() (byte, []byte, error) {
+	var length uint32
+	if err := binary.Read(s.r, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+
+	if length == 0 || length > maxMilterPacket {
+		return 0, nil, fmt.Errorf("Invalid milter packet length: %d", length)
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(s.r, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+func (s *milterSession) write(cmd byte, data []byte) error {
+	packet := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)+1))
+	packet[4] = cmd
+	copy(packet[5:], data)
+	_, err := s.w.Write(packet)
+	return err
+}
+
+/*
+ * Splits NUL-terminated strings.
+ */
+func splitMilterStrings(data []byte) []string {
+	var fields []string
+	for len(data) > 0 {
+		idx := bytes.IndexByte(data, 0)
+		if idx < 0 {
+			fields = append(fields, string(data))
+			break
+		}
+		fields = append(fields, string(data[:idx]))
+		data = data[idx+1:]
+	}
+	return fields
+}
+
+/*
+ * Parses the data of a connect command: host name, address family,
+ * port and address. Returns nil for other than IPv4 and IPv6.
+ */
+func parseMilterAddress(data []byte) net.IP {
+	idx := bytes.IndexByte(data, 0)
+	if idx < 0 || len(data) < idx+4 {
+		return nil
+	}
+
+	family := data[idx+1]
+	if family != '4' && family != '6' {
+		return nil
+	}
+
+	fields := splitMilterStrings(data[idx+4:])
+	if len(fields) == 0 {
+		return nil
+	}
+
+	address := strings.TrimPrefix(fields[0], "IPv6:")
+	return net.ParseIP(strings.Trim(address, "[]"))
+}
@@ -0,0 +1,196 @@
+package emailauth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+/*
+ * testMilterClient plays the part of the MTA.
+ */
+type testMilterClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestMilterClient(t *testing.T, m *Milter) (*testMilterClient, chan error) {
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- m.ServeConn(server) }()
+	return &testMilterClient{t: t, conn: client, r: bufio.NewReader(client)}, done
+}
+
+func (c *testMilterClient) send(cmd byte, data ...string) {
+	payload := []byte(strings.Join(data, ""))
+	packet := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(packet, uint32(len(payload)+1))
+	packet[4] = cmd
+	copy(packet[5:], payload)
+	if _, err := c.conn.Write(packet); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testMilterClient) receive() (byte, []byte) {
+	var length uint32
+	if err := binary.Read(c.r, binary.BigEndian, &length); err != nil {
+		c.t.Fatal(err)
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(c.r, packet); err != nil {
+		c.t.Fatal(err)
+	}
+	return packet[0], packet[1:]
+}
+
+func (c *testMilterClient) expect(cmd byte) []byte {
+	got, data := c.receive()
+	if got != cmd {
+		c.t.Fatalf("Expected response '%c' but got '%c' (%q)", cmd, got, data)
+	}
+	return data
+}
+
+func (c *testMilterClient) negotiate() {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data, 6)
+	binary.BigEndian.PutUint32(data[4:], 0x1ff)
+	binary.BigEndian.PutUint32(data[8:], 0x1fffff)
+	c.send(milterOptNeg, string(data))
+
+	reply := c.expect(milterOptNeg)
+	if binary.BigEndian.Uint32(reply) != 6 || binary.BigEndian.Uint32(reply[4:]) != milterActionAddHeaders|milterActionQuarantine {
+		c.t.Errorf("Unexpected negotiation reply: %v", reply)
+	}
+}
+
+/*
+ * Sends a complete message and returns the responses to end of body.
+ */
+func (c *testMilterClient) sendMessage(message *Message) map[byte][]byte {
+	c.send(milterMacro, "C", "j\x00mx.example.net\x00")
+	c.send(milterConnect, "mail.football.example.com\x00", "4", "\x00\x19", "192.0.2.1\x00")
+	c.expect(milterContinue)
+	c.send(milterHelo, "mail.football.example.com\x00")
+	c.expect(milterContinue)
+	c.send(milterMail, "<joe@localhost>\x00", "SIZE=100\x00")
+	c.expect(milterContinue)
+	c.send(milterRcpt, "<suzie@shopping.example.net>\x00")
+	c.expect(milterContinue)
+
+	for name, values := range *message.Headers {
+		for _, value := range values {
+			c.send(milterHeader, name, "\x00", value, "\x00")
+			c.expect(milterContinue)
+		}
+	}
+	c.send(milterEOH)
+	c.expect(milterContinue)
+
+	body := []byte(testMessageBody)
+	c.send(milterBody, string(body[:10]))
+	c.expect(milterContinue)
+	c.send(milterEOB, string(body[10:]))
+
+	responses := make(map[byte][]byte)
+	for {
+		cmd, data := c.receive()
+		responses[cmd] = data
+		if cmd == milterAccept || cmd == milterReplyCode {
+			return responses
+		}
+	}
+}
+
+func TestMilter(t *testing.T) {
+	key, pub := newTestKey(t, 1024)
+	resolver := fakeResolver{
+		"brisbane._domainkey.football.example.com": {"v=DKIM1; k=rsa; p=" + pub},
+		"_dmarc.football.example.com":              {"v=DMARC1; p=reject; rua=mailto:dmarc@football.example.com"},
+	}
+
+	store := NewMemoryReportStore()
+	m := &Milter{
+		DKIM:        DKIMValidator{Resolver: resolver},
+		DMARC:       DMARCValidator{Resolver: resolver},
+		RejectDMARC: true,
+		Reporter:    &AggregateReporter{Store: store},
+	}
+
+	c, done := newTestMilterClient(t, m)
+	c.negotiate()
+
+	message := newTestMessage()
+	signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=football.example.com; s=brisbane; h=From:To:Subject:Date:Message-ID")
+	responses := c.sendMessage(message)
+
+	header, ok := responses[milterInsHeader]
+	if !ok || binary.BigEndian.Uint32(header) != 0 {
+		t.Fatalf("Expected inserted header, got %v", responses)
+	}
+
+	fields := splitMilterStrings(header[4:])
+	assertStringEquals("Authentication-Results", fields[0], t)
+	if !strings.HasPrefix(fields[1], "mx.example.net; spf=none; dkim=pass") ||
+		!strings.Contains(fields[1], "dmarc=pass (p=REJECT sp=REJECT dis=NONE) header.from=football.example.com") {
+		t.Errorf("Unexpected Authentication-Results: %s", fields[1])
+	}
+
+	// a modified message in the same connection
+	message.Headers.Set("Subject", "Modified")
+	responses = c.sendMessage(message)
+	if reply, ok := responses[milterReplyCode]; !ok || !bytes.HasPrefix(reply, []byte("550 5.7.1 ")) {
+		t.Errorf("Expected rejection, got %v", responses)
+	}
+
+	c.send(milterQuit)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	if domains, _ := store.Domains(); len(domains) != 1 || domains[0] != "football.example.com" {
+		t.Errorf("Expected recorded results, got %v", domains)
+	}
+}
+
+func TestMilterQuarantine(t *testing.T) {
+	resolver := fakeResolver{"_dmarc.football.example.com": {"v=DMARC1; p=quarantine"}}
+	m := &Milter{AuthServID: "mx.example.org", DMARC: DMARCValidator{Resolver: resolver}, QuarantineDMARC: true}
+
+	c, done := newTestMilterClient(t, m)
+	c.negotiate()
+	responses := c.sendMessage(newTestMessage())
+	if _, ok := responses[milterQuarantine]; !ok {
+		t.Errorf("Expected quarantine, got %v", responses)
+	}
+
+	header := responses[milterInsHeader]
+	if !bytes.Contains(header, []byte("mx.example.org; spf=none; dkim=none reason=\"No signature\"; dmarc=fail")) {
+		t.Errorf("Unexpected header: %q", header)
+	}
+
+	// abort, then a protocol error closes the connection
+	c.send(milterAbort)
+	c.send('X')
+	if err := <-done; err == nil {
+		t.Error("Expected error for unknown command")
+	}
+}
+
+func TestParseMilterAddress(t *testing.T) {
+	for data, expected := range map[string]string{
+		"host\x004\x00\x19192.0.2.1\x00":        "192.0.2.1",
+		"host\x006\x00\x19IPv6:2001:db8::1\x00": "2001:db8::1",
+		"host\x00U\x00\x00/var/run/socket\x00":  "<nil>",
+		"host\x00":                              "<nil>",
+	} {
+		assertStringEquals(expected, parseMilterAddress([]byte(data)).String(), t)
+	}
+}
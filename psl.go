@@ -0,0 +1,273 @@
+package emailauth
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"strings"
+	"sync"
+)
+
+/*
+ * Public Suffix List (https://publicsuffix.org/list/), used to
+ * determine organizational domains (RFC 7489, section 3.2). A copy of
+ * the list is embedded; newer versions in the same format can be
+ * loaded with LoadPublicSuffixList and set on the DMARCValidator.
+ */
+
+//go:embed public_suffix_list.dat
+var embeddedPublicSuffixList string
+
+type PublicSuffixList struct {
+	rules      map[string]bool
+	wildcards  map[string]bool
+	exceptions map[string]bool
+}
+
+var (
+	defaultPSL     *PublicSuffixList
+	defaultPSLOnce sync.Once
+)
+
+/*
+ * Returns the public suffix list embedded in the package.
+ */
+func DefaultPublicSuffixList() *PublicSuffixList {
+	defaultPSLOnce.Do(func() {
+		defaultPSL, _ = LoadPublicSuffixList(strings.NewReader(embeddedPublicSuffixList))
+	})
+	return defaultPSL
+}
+
+/*
+ * Loads a list in the public_suffix_list.dat format: one rule per
+ * line, "//" comments, "*." wildcard and "!" exception rules.
+ * Rules from both the ICANN and the private section are used.
+ */
+func LoadPublicSuffixList(r io.Reader) (*PublicSuffixList, error) {
+	l := &PublicSuffixList{
+		rules:      make(map[string]bool),
+		wildcards:  make(map[string]bool),
+		exceptions: make(map[string]bool),
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		// rules end at the first whitespace
+		rule := strings.Fields(line)[0]
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			l.exceptions[domainToASCII(rule[1:])] = true
+		case strings.HasPrefix(rule, "*."):
+			l.wildcards[domainToASCII(rule[2:])] = true
+		default:
+			l.rules[domainToASCII(rule)] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+/*
+ * Returns the registrable domain, i.e. the public suffix plus one
+ * label, or an empty string if the domain is a public suffix itself
+ * or not a valid domain name. Labels are returned lower-cased in the
+ * form they were given, A-labels or U-labels.
+ */
+func (l *PublicSuffixList) RegistrableDomain(domain string) string {
+	labels := splitDomainLabels(domain)
+	if labels == nil {
+		return ""
+	}
+
+	n := l.suffixLabels(labels)
+	if n >= len(labels) {
+		return ""
+	}
+	return strings.Join(labels[len(labels)-n-1:], ".")
+}
+
+/*
+ * Returns the organizational domain (RFC 7489, section 3.2). Public
+ * suffixes are their own organizational domain.
+ */
+func (l *PublicSuffixList) OrganizationalDomain(domain string) string {
+	if orgDomain := l.RegistrableDomain(domain); orgDomain != "" {
+		return orgDomain
+	}
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+/*
+ * Returns the number of labels of the longest public suffix matching
+ * the domain (https://publicsuffix.org/list/ "Algorithm").
+ */
+func (l *PublicSuffixList) suffixLabels(labels []string) int {
+	ascii := make([]string, len(labels))
+	for i, label := range labels {
+		ascii[i] = labelToASCII(label)
+	}
+
+	for i := range ascii {
+		if l.exceptions[strings.Join(ascii[i:], ".")] {
+			return len(ascii) - i - 1
+		}
+	}
+
+	for i := range ascii {
+		if l.rules[strings.Join(ascii[i:], ".")] {
+			return len(ascii) - i
+		}
+		if i+1 < len(ascii) && l.wildcards[strings.Join(ascii[i+1:], ".")] {
+			return len(ascii) - i
+		}
+	}
+
+	// default rule "*"
+	return 1
+}
+
+func splitDomainLabels(domain string) []string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if domain == "" {
+		return nil
+	}
+
+	labels := strings.Split(domain, ".")
+	for _, label := range labels {
+		if label == "" {
+			return nil
+		}
+	}
+	return labels
+}
+
+func domainToASCII(domain string) string {
+	labels := strings.Split(strings.ToLower(domain), ".")
+	for i, label := range labels {
+		labels[i] = labelToASCII(label)
+	}
+	return strings.Join(labels, ".")
+}
+
+/*
+ * Converts a U-label to its A-label. Only the Punycode encoding is
+ * applied, IDNA mapping is expected to have happened before.
+ */
+func labelToASCII(label string) string {
+	for _, r := range label {
+		if r >= 0x80 {
+			return "xn--" + punycodeEncode(label)
+		}
+	}
+	return label
+}
+
+const (
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+)
+
+/*
+ * Punycode encoding as specified in RFC 3492, section 6.3.
+ */
+func punycodeEncode(s string) string {
+	runes := []rune(s)
+	out := make([]byte, 0, 2*len(runes))
+	for _, r := range runes {
+		if r < 0x80 {
+			out = append(out, byte(r))
+		}
+	}
+
+	b := len(out)
+	h := b
+	if b > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punycodeInitialN), 0, punycodeInitialBias
+	for h < len(runes) {
+		m := rune(0x10FFFF)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+
+		delta += int(m-n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+
+			if r != n {
+				continue
+			}
+
+			q := delta
+			for k := punycodeBase; ; k += punycodeBase {
+				t := k - bias
+				if t < punycodeTMin {
+					t = punycodeTMin
+				} else if t > punycodeTMax {
+					t = punycodeTMax
+				}
+
+				if q < t {
+					break
+				}
+
+				out = append(out, punycodeDigit(t+(q-t)%(punycodeBase-t)))
+				q = (q - t) / (punycodeBase - t)
+			}
+
+			out = append(out, punycodeDigit(q))
+			bias = punycodeAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+
+		delta++
+		n++
+	}
+
+	return string(out)
+}
+
+func punycodeAdapt(delta int, numPoints int, first bool) int {
+	if first {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punycodeBase-punycodeTMin)*punycodeTMax)/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
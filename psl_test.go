@@ -0,0 +1,140 @@
+package emailauth
+
+import (
+	"strings"
+	"testing"
+)
+
+// https://raw.githubusercontent.com/publicsuffix/list/master/tests/test_psl.txt
+var pslTestVectors = []struct {
+	domain      string
+	registrable string
+}{
+	// null input
+	{"", ""},
+	// Mixed case.
+	{"COM", ""},
+	{"example.COM", "example.com"},
+	{"WwW.example.COM", "example.com"},
+	// Leading dot.
+	{".com", ""},
+	{".example", ""},
+	{".example.com", ""},
+	{".example.example", ""},
+	// Unlisted TLD.
+	{"example", ""},
+	{"example.example", "example.example"},
+	{"b.example.example", "example.example"},
+	{"a.b.example.example", "example.example"},
+	// TLD with only 1 rule.
+	{"biz", ""},
+	{"domain.biz", "domain.biz"},
+	{"b.domain.biz", "domain.biz"},
+	{"a.b.domain.biz", "domain.biz"},
+	// TLD with some 2-level rules.
+	{"com", ""},
+	{"example.com", "example.com"},
+	{"b.example.com", "example.com"},
+	{"a.b.example.com", "example.com"},
+	{"uk.com", ""},
+	{"example.uk.com", "example.uk.com"},
+	{"b.example.uk.com", "example.uk.com"},
+	{"a.b.example.uk.com", "example.uk.com"},
+	{"test.ac", "test.ac"},
+	// TLD with only 1 (wildcard) rule.
+	{"mm", ""},
+	{"c.mm", ""},
+	{"b.c.mm", "b.c.mm"},
+	{"a.b.c.mm", "b.c.mm"},
+	// More complex TLD.
+	{"jp", ""},
+	{"test.jp", "test.jp"},
+	{"www.test.jp", "test.jp"},
+	{"ac.jp", ""},
+	{"test.ac.jp", "test.ac.jp"},
+	{"www.test.ac.jp", "test.ac.jp"},
+	{"kyoto.jp", ""},
+	{"test.kyoto.jp", "test.kyoto.jp"},
+	{"ide.kyoto.jp", ""},
+	{"b.ide.kyoto.jp", "b.ide.kyoto.jp"},
+	{"a.b.ide.kyoto.jp", "b.ide.kyoto.jp"},
+	{"c.kobe.jp", ""},
+	{"b.c.kobe.jp", "b.c.kobe.jp"},
+	{"a.b.c.kobe.jp", "b.c.kobe.jp"},
+	{"city.kobe.jp", "city.kobe.jp"},
+	{"www.city.kobe.jp", "city.kobe.jp"},
+	// TLD with a wildcard rule and exceptions.
+	{"ck", ""},
+	{"test.ck", ""},
+	{"b.test.ck", "b.test.ck"},
+	{"a.b.test.ck", "b.test.ck"},
+	{"www.ck", "www.ck"},
+	{"www.www.ck", "www.ck"},
+	// US K12.
+	{"us", ""},
+	{"test.us", "test.us"},
+	{"www.test.us", "test.us"},
+	{"ak.us", ""},
+	{"test.ak.us", "test.ak.us"},
+	{"www.test.ak.us", "test.ak.us"},
+	{"k12.ak.us", ""},
+	{"test.k12.ak.us", "test.k12.ak.us"},
+	{"www.test.k12.ak.us", "test.k12.ak.us"},
+	// IDN labels.
+	{"食狮.com.cn", "食狮.com.cn"},
+	{"食狮.公司.cn", "食狮.公司.cn"},
+	{"www.食狮.公司.cn", "食狮.公司.cn"},
+	{"shishi.公司.cn", "shishi.公司.cn"},
+	{"公司.cn", ""},
+	{"食狮.中国", "食狮.中国"},
+	{"www.食狮.中国", "食狮.中国"},
+	{"shishi.中国", "shishi.中国"},
+	{"中国", ""},
+	// Same as above, but punycoded.
+	{"xn--85x722f.com.cn", "xn--85x722f.com.cn"},
+	{"xn--85x722f.xn--55qx5d.cn", "xn--85x722f.xn--55qx5d.cn"},
+	{"www.xn--85x722f.xn--55qx5d.cn", "xn--85x722f.xn--55qx5d.cn"},
+	{"shishi.xn--55qx5d.cn", "shishi.xn--55qx5d.cn"},
+	{"xn--55qx5d.cn", ""},
+	{"xn--85x722f.xn--fiqs8s", "xn--85x722f.xn--fiqs8s"},
+	{"www.xn--85x722f.xn--fiqs8s", "xn--85x722f.xn--fiqs8s"},
+	{"shishi.xn--fiqs8s", "shishi.xn--fiqs8s"},
+	{"xn--fiqs8s", ""},
+}
+
+func TestPublicSuffixList(t *testing.T) {
+	l := DefaultPublicSuffixList()
+	for _, v := range pslTestVectors {
+		if r := l.RegistrableDomain(v.domain); r != v.registrable {
+			t.Errorf("Expected '%s' for '%s' but got '%s'", v.registrable, v.domain, r)
+		}
+	}
+}
+
+func TestLoadPublicSuffixList(t *testing.T) {
+	l, err := LoadPublicSuffixList(strings.NewReader("// comment\n\ncom\n*.example.com extra\n!www.example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertStringEquals("a.b.example.com", l.RegistrableDomain("x.a.b.example.com"), t)
+	assertStringEquals("www.example.com", l.RegistrableDomain("x.www.example.com"), t)
+	assertStringEquals("example.com", l.OrganizationalDomain("example.com"), t)
+	assertStringEquals("b.example.com", l.OrganizationalDomain("b.example.com"), t)
+
+	v := DMARCValidator{PublicSuffixList: l}
+	assertStringEquals("a.b.example.com", v.newDiscovery().organizationalDomain("x.a.b.example.com"), t)
+	assertStringEquals("example.co.uk", OrganizationalDomain("mail.example.co.uk"), t)
+}
+
+func TestPunycode(t *testing.T) {
+	expected := map[string]string{
+		"食狮":     "85x722f",
+		"公司":     "55qx5d",
+		"中国":     "fiqs8s",
+		"bücher": "bcher-kva",
+	}
+	for label, encoded := range expected {
+		assertStringEquals(encoded, punycodeEncode(label), t)
+	}
+}
@@ -2,9 +2,11 @@ package emailauth
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"regexp"
 	"strconv"
@@ -34,6 +36,7 @@ import (
 type SPFResult struct {
 	Result      Result
 	Explanation string
+	Domain      string
 }
 
 type SPFTerm interface {
@@ -71,7 +74,14 @@ func (m *SPFModifier) ToModifier() (bool, *SPFModifier) {
 	return true, m
 }
 
+/*
+ * SPFValidator evaluates SPF records. Records are looked up with
+ * Resolver, or the system resolver if it is nil.
+ */
 type SPFValidator struct {
+	Resolver Resolver
+	Logger   *slog.Logger
+	Metrics  Metrics
 }
 
 /*
@@ -150,6 +160,32 @@ var modifierExp = regexp.MustCompile("^(?P<name>[a-z][a-z0-9_\\-\\.]*)=(?P<macro
 var domainExp = regexp.MustCompile("^([^\\.]{1,63}\\.)+[^\\.]{1,63}(\\.)?$")
 
 func (v SPFValidator) Validate(ip net.IP, from string, heloName string) *SPFResult {
+	return v.ValidateContext(context.Background(), ip, from, heloName)
+}
+
+/*
+ * Like Validate, looking up the records with ctx. The result and
+ * queries are logged with the trace ID of ctx.
+ */
+func (v SPFValidator) ValidateContext(ctx context.Context, ip net.IP, from string, heloName string) *SPFResult {
+	resolver := traceResolver(ctx, v.Resolver, v.Logger, v.Metrics)
+	v.Resolver = resolver
+	result := v.validate(ip, from, heloName)
+	if result.Result == Permerror && result.Explanation == spfTooManyLookups && v.Metrics != nil {
+		v.Metrics.ObserveLimitExceeded("spf")
+	}
+	observeEvaluation(v.Metrics, "spf", resolver, result.Result)
+	logVerdict(ctx, v.Logger, "spf", result.Result,
+		slog.String("ip", ip.String()),
+		slog.String("mail-from", from),
+		slog.String("helo", heloName),
+		slog.String("result", result.Result.String()),
+		slog.String("domain", result.Domain),
+		slog.String("reason", result.Explanation))
+	return result
+}
+
+func (v SPFValidator) validate(ip net.IP, from string, heloName string) *SPFResult {
 	heloName = strings.TrimSpace(heloName)
 	if isValidDomain(heloName) {
 		// TODO: check HELO SPF
@@ -168,7 +204,7 @@ func (v SPFValidator) Validate(ip net.IP, from string, heloName string) *SPFResu
 		from = from[0 : len(from)-1]
 	}
 
-	fromParts := strings.SplitN(from, "@", 1)
+	fromParts := strings.SplitN(from, "@", 2)
 	if len(fromParts) != 2 {
 		fromParts = []string{"postmaster", from}
 	}
@@ -186,25 +222,29 @@ func (v SPFValidator) Validate(ip net.IP, from string, heloName string) *SPFResu
 	// TODO:
 	//  - "from" correct?
 	//  - isHeloDomain needed? if so, correct it
-	return checkHost(ip, domain, false, from, 0)
+	result := checkHost(resolverOrDefault(v.Resolver), ip, domain, false, from, 0)
+	result.Domain = strings.ToLower(domain)
+	return result
 }
 
+const spfTooManyLookups = "Too many DNS lookups"
+
 const (
 	lookupLimit    = 10
 	mxLookupLimit  = 10
 	ptrLookupLimit = 10
 )
 
-func checkHost(ip net.IP, domain string, isHeloDomain bool, sender string, lookups uint8) *SPFResult {
+func checkHost(resolver Resolver, ip net.IP, domain string, isHeloDomain bool, sender string, lookups uint8) *SPFResult {
 	if lookups > lookupLimit {
-		return newSPFResult(Permerror, "Too many DNS lookups")
+		return newSPFResult(Permerror, spfTooManyLookups)
 	}
 
 	if isInvalidDomain(domain) {
 		return newSPFResult(None, fmt.Sprintf("Invalid domain: %s", sanitizeDomainForPrinting(domain)))
 	}
 
-	rawRecord, errResult := findSPFRecord(domain)
+	rawRecord, errResult := findSPFRecord(resolver, domain)
 	if errResult != nil {
 		return errResult
 	}
@@ -343,8 +383,8 @@ func parseRecord(rawRecord string) ([]SPFTerm, *SPFResult) {
 	return terms, nil
 }
 
-func findSPFRecord(domain string) (string, *SPFResult) {
-	records, err := net.LookupTXT(domain)
+func findSPFRecord(resolver Resolver, domain string) (string, *SPFResult) {
+	records, err := resolver.LookupTXT(context.Background(), domain)
 	if err != nil {
 		if err, ok := err.(*net.DNSError); ok {
 			if err.IsTimeout || err.IsTemporary {
@@ -520,8 +560,7 @@ func expandMacro(macro string, ip net.IP, domain string, sender string, heloDoma
 				}
 
 				// TODO:
-				transformers = transformers
-				delimiters = delimiters
+				_, _ = transformers, delimiters
 				result.WriteString(replacement)
 			} else {
 				result.WriteRune(r)
@@ -25,10 +25,16 @@ func TestParseAndEvaluate(t *testing.T) {
 }
 
 func TestCheckHost(t *testing.T) {
-	result := new(SPFValidator).Validate(net.ParseIP("10.20.21.77"), "test@ox.io", "localhost")
-	if result.Result != None { // FIXME
+	v := SPFValidator{Resolver: fakeResolver{"ox.io": {"v=spf1 ip4:10.20.21.0/24 -all"}}}
+	result := v.Validate(net.ParseIP("10.20.21.77"), "test@ox.io", "localhost")
+	if result.Result != Pass {
 		t.Errorf("Expected 'pass' result but got '%s'", result.Result)
 	}
+
+	result = v.Validate(net.ParseIP("10.20.22.77"), "test@ox.io", "localhost")
+	if result.Result != Fail {
+		t.Errorf("Expected 'fail' result but got '%s'", result.Result)
+	}
 }
 
 func TestParseSPFDirective(t *testing.T) {
@@ -137,7 +143,7 @@ func assertStringEquals(expected string, actual string, t *testing.T) {
 
 func assertBoolEquals(expected bool, actual bool, t *testing.T) {
 	if expected != actual {
-		t.Errorf("Expected '%s' but got '%s'", expected, actual)
+		t.Errorf("Expected '%t' but got '%t'", expected, actual)
 	}
 }
 func TestNormalizeIPv6(t *testing.T) {
@@ -0,0 +1,159 @@
+package emailauth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Tracing of messages. The milter assigns each message a trace ID and
+ * passes it with the context to the ValidateContext methods of the
+ * validators, which log it with their verdicts and DNS queries:
+ *
+ *  level=DEBUG msg=dns trace-id=5f0c3a9e81d2b674 type=TXT name=brisbane._domainkey.example.com answers=1 duration=12.3ms
+ *  level=INFO msg=dkim trace-id=5f0c3a9e81d2b674 domain=example.com selector=brisbane result=pass reason=""
+ */
+
+type traceIDKey struct{}
+
+type lookupLimitKey struct{}
+
+/*
+ * Returns a context carrying the trace ID.
+ */
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+/*
+ * Returns the trace ID of the context, or an empty string.
+ */
+func TraceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+/*
+ * Returns a random trace ID of 16 hex digits.
+ */
+func NewTraceID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+/*
+ * Returns a context limiting the DNS lookups of each validation with
+ * it to limit, 0 for no limit. Further lookups fail with a temporary
+ * error, so that the validator returns "temperror".
+ */
+func WithLookupLimit(ctx context.Context, limit int) context.Context {
+	return context.WithValue(ctx, lookupLimitKey{}, limit)
+}
+
+func traceAttrs(ctx context.Context, attrs []slog.Attr) []slog.Attr {
+	if id := TraceID(ctx); id != "" {
+		return append([]slog.Attr{slog.String("trace-id", id)}, attrs...)
+	}
+	return attrs
+}
+
+/*
+ * tracedResolver performs the lookups of a validation with its context,
+ * so that they are aborted with it, logs them at debug level and
+ * reports them to the metrics. Lookups beyond the limit of the context
+ * are refused.
+ */
+type tracedResolver struct {
+	ctx      context.Context
+	resolver Resolver
+	logger   *slog.Logger
+	metrics  Metrics
+	limit    int32
+	started  int32
+	lookups  int32
+	limited  int32
+}
+
+/*
+ * Returns the resolver of a validator to be used during a validation
+ * with ctx.
+ */
+func traceResolver(ctx context.Context, resolver Resolver, logger *slog.Logger, metrics Metrics) *tracedResolver {
+	limit, _ := ctx.Value(lookupLimitKey{}).(int)
+	return &tracedResolver{ctx: ctx, resolver: resolverOrDefault(resolver), logger: logger, metrics: metrics, limit: int32(limit)}
+}
+
+func (r *tracedResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if err := r.checkLimit(name); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	records, err := r.resolver.LookupTXT(r.ctx, name)
+	r.log("TXT", name, len(records), err, start)
+	return records, err
+}
+
+func (r *tracedResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if err := r.checkLimit(host); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	addrs, err := r.resolver.LookupHost(r.ctx, host)
+	r.log("A/AAAA", host, len(addrs), err, start)
+	return addrs, err
+}
+
+func (r *tracedResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if err := r.checkLimit(name); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	mxs, err := r.resolver.LookupMX(r.ctx, name)
+	r.log("MX", name, len(mxs), err, start)
+	return mxs, err
+}
+
+func (r *tracedResolver) checkLimit(name string) error {
+	if r.limit > 0 && atomic.AddInt32(&r.started, 1) > r.limit {
+		atomic.StoreInt32(&r.limited, 1)
+		return &net.DNSError{Err: "Too many DNS lookups", Name: name, IsTemporary: true}
+	}
+	return nil
+}
+
+/*
+ * Returns whether a lookup was refused because of the limit.
+ */
+func (r *tracedResolver) limitExceeded() bool {
+	return atomic.LoadInt32(&r.limited) != 0
+}
+
+func (r *tracedResolver) lookupCount() int {
+	return int(atomic.LoadInt32(&r.lookups))
+}
+
+func (r *tracedResolver) log(qtype string, name string, answers int, err error, start time.Time) {
+	atomic.AddInt32(&r.lookups, 1)
+	if r.metrics != nil {
+		r.metrics.ObserveLookup(qtype, time.Since(start), err)
+	}
+
+	if r.logger == nil || !r.logger.Enabled(r.ctx, slog.LevelDebug) {
+		return
+	}
+
+	attrs := []slog.Attr{slog.String("type", qtype), slog.String("name", name)}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	} else {
+		attrs = append(attrs, slog.Int("answers", answers))
+	}
+	attrs = append(attrs, slog.Duration("duration", time.Since(start)))
+	r.logger.LogAttrs(r.ctx, slog.LevelDebug, "dns", traceAttrs(r.ctx, attrs)...)
+}
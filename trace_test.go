@@ -0,0 +1,172 @@
+package emailauth
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+/*
+ * contextResolver fails lookups with the error of a done context.
+ */
+type contextResolver struct {
+	fakeResolver
+}
+
+func (r contextResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name, IsTemporary: true}
+	}
+	return r.fakeResolver.LookupTXT(ctx, name)
+}
+
+func TestTraceID(t *testing.T) {
+	ctx := WithTraceID(context.Background(), "4711")
+	assertStringEquals("4711", TraceID(ctx), t)
+	assertStringEquals("", TraceID(context.Background()), t)
+
+	id := NewTraceID()
+	if !regexp.MustCompile("^[0-9a-f]{16}$").MatchString(id) || id == NewTraceID() {
+		t.Errorf("Unexpected trace ID: %s", id)
+	}
+}
+
+func TestValidateContext(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: dropTime}))
+	key, pub := newTestKey(t, 1024)
+	v := DKIMValidator{Resolver: contextResolver{fakeResolver{"brisbane._domainkey.football.example.com": {"v=DKIM1; k=rsa; p=" + pub}}}, Logger: logger}
+
+	message := newTestMessage()
+	signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=football.example.com; s=brisbane; h=From:To:Subject:Date:Message-ID")
+
+	ctx := WithTraceID(context.Background(), "5f0c3a9e81d2b674")
+	if results := v.ValidateContext(ctx, message); results[0].Result != Pass {
+		t.Errorf("Expected 'pass' but got '%s' (%s)", results[0].Result, results[0].Reason)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records but got %q", buf.String())
+	}
+	if !strings.HasPrefix(lines[0], "level=DEBUG msg=dns trace-id=5f0c3a9e81d2b674 type=TXT name=brisbane._domainkey.football.example.com answers=1 duration=") {
+		t.Errorf("Unexpected record: %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "level=INFO msg=dkim trace-id=5f0c3a9e81d2b674 domain=football.example.com selector=brisbane ") {
+		t.Errorf("Unexpected record: %s", lines[1])
+	}
+
+	// lookups are made with the context of the validation
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if results := v.ValidateContext(ctx, newTestMessage()); results[0].Result != None {
+		t.Errorf("Expected 'none' but got '%s'", results[0].Result)
+	}
+	message.Body = strings.NewReader(testMessageBody)
+	if results := v.ValidateContext(ctx, message); results[0].Result != Temperror {
+		t.Errorf("Expected 'temperror' but got '%s' (%s)", results[0].Result, results[0].Reason)
+	}
+}
+
+func TestValidateContextPolicies(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: dropTime}))
+	resolver := fakeResolver{
+		"_adsp._domainkey.example.org": {"dkim=all"},
+		"_dmarc.example.com":           {"v=DMARC1; p=none; sp=quarantine; np=reject"},
+	}
+	ctx := WithTraceID(context.Background(), "5f0c3a9e81d2b674")
+
+	v := DKIMValidator{Resolver: resolver, Logger: logger}
+	signed := &DKIMResult{Result: Pass, Tags: map[string]string{"d": "esp.example.net", "atps": "example.org", "atps-h": "none"}}
+	v.ValidateATPSContext(ctx, signed, "example.org")
+	v.ValidateADSPContext(ctx, "example.org", signed)
+
+	// the existence of the author domain is checked for "np="
+	dmarc := DMARCValidator{Resolver: resolver, Logger: logger}
+	if result := dmarc.ValidateContext(ctx, newTestDMARCMessage("a@nx.example.com"), nil, nil); result.Policy != DispositionReject {
+		t.Errorf("Expected np policy but got %s", result.Policy)
+	}
+
+	for _, expected := range []string{
+		"msg=dns trace-id=5f0c3a9e81d2b674 type=TXT name=esp.example.net._atps.example.org error=",
+		"msg=dkim-atps trace-id=5f0c3a9e81d2b674 from=example.org result=fail ",
+		"msg=dns trace-id=5f0c3a9e81d2b674 type=A/AAAA name=example.org answers=1 ",
+		"msg=dns trace-id=5f0c3a9e81d2b674 type=TXT name=_adsp._domainkey.example.org answers=1 ",
+		"msg=dkim-adsp trace-id=5f0c3a9e81d2b674 from=example.org practice=all result=fail ",
+		"msg=dns trace-id=5f0c3a9e81d2b674 type=A/AAAA name=nx.example.com error=",
+		"msg=dns trace-id=5f0c3a9e81d2b674 type=MX name=nx.example.com error=",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected %q in:\n%s", expected, buf.String())
+		}
+	}
+}
+
+func TestLookupLimit(t *testing.T) {
+	key, pub := newTestKey(t, 1024)
+	v := DKIMValidator{Resolver: fakeResolver{
+		"a._domainkey.example.com": {"v=DKIM1; p=" + pub},
+		"b._domainkey.example.com": {"v=DKIM1; p=" + pub},
+	}}
+
+	message := newTestMessage()
+	signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=a; h=From")
+	signTestMessage(t, message, key, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=b; h=From")
+
+	// signatures are verified concurrently, so either may exceed the limit
+	for limit, expected := range map[int]int{0: 0, 1: 1, 2: 0} {
+		message.Body = strings.NewReader(testMessageBody)
+		temperrors := 0
+		for _, r := range v.ValidateContext(WithLookupLimit(context.Background(), limit), message) {
+			if r.Result == Temperror {
+				temperrors++
+				assertStringEquals("lookup "+r.Tags["s"]+"._domainkey.example.com: Too many DNS lookups", r.Reason, t)
+			} else if r.Result != Pass {
+				t.Errorf("Limit %d: expected 'pass' but got '%s' (%s)", limit, r.Result, r.Reason)
+			}
+		}
+		if temperrors != expected {
+			t.Errorf("Limit %d: expected %d temperrors but got %d", limit, expected, temperrors)
+		}
+	}
+}
+
+func TestMilterTrace(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: dropTime}))
+	resolver := fakeResolver{"_dmarc.football.example.com": {"v=DMARC1; p=none"}}
+	m := &Milter{
+		AuthServID:   "mx.example.org",
+		DKIM:         DKIMValidator{Resolver: resolver, Logger: logger},
+		DMARC:        DMARCValidator{Resolver: resolver, Logger: logger},
+		TraceComment: true,
+	}
+
+	c, done := newTestMilterClient(t, m)
+	c.negotiate()
+	header := c.sendMessage(newTestMessage())[milterInsHeader]
+	c.send(milterQuit)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	match := regexp.MustCompile(`^mx\.example\.org \(trace-id ([0-9a-f]{16})\); spf=none; dkim=none`).FindStringSubmatch(splitMilterStrings(header[4:])[1])
+	if match == nil {
+		t.Fatalf("Unexpected header: %q", header)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) < 3 {
+		t.Fatalf("Expected records of DKIM, DMARC and DNS but got %q", buf.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, " trace-id="+match[1]+" ") {
+			t.Errorf("Expected trace ID %s in %s", match[1], line)
+		}
+	}
+}